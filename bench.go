@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// parseQuantity parses a non-negative integer with an optional suffix of
+// units, e.g. 10k or 1MB.
+func parseQuantity(s string, units map[string]int64) (int64, error) {
+	trimmed := strings.TrimSpace(s)
+	i := strings.IndexFunc(trimmed, func(r rune) bool { return r < '0' || r > '9' })
+	if i < 0 {
+		i = len(trimmed)
+	}
+
+	n, err := strconv.ParseInt(trimmed[:i], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid quantity %#v", s)
+	}
+	if i == len(trimmed) {
+		return n, nil
+	}
+	unit, ok := units[strings.ToUpper(trimmed[i:])]
+	if !ok {
+		return 0, fmt.Errorf("invalid unit in %#v", s)
+	}
+	return n * unit, nil
+}
+
+// parseCount parses a number of messages, optionally in thousands (k),
+// millions (M) or billions (G).
+func parseCount(s string) (int64, error) {
+	return parseQuantity(s, map[string]int64{"K": 1e3, "M": 1e6, "G": 1e9})
+}
+
+// parseSize parses a number of bytes, optionally in B, KB, MB or GB, which are
+// multiples of 1024.
+func parseSize(s string) (int64, error) {
+	return parseQuantity(s, map[string]int64{"B": 1, "KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30})
+}
+
+// benchPayloads is the number of random values that -bench cycles through, so
+// that generating values doesn't limit throughput.
+const benchPayloads = 64
+
+// benchLines sends count values of size random bytes to out, or unlimited
+// values for count 0, and closes out once done or quit is closed.
+func benchLines(size int, count int64, quit <-chan struct{}, out chan string) {
+	defer close(out)
+
+	payloads := make([]string, benchPayloads)
+	for i := range payloads {
+		payloads[i] = generateString(size)
+	}
+
+	for n := int64(0); count == 0 || n < count; n++ {
+		select {
+		case out <- payloads[n%benchPayloads]:
+		case <-quit:
+			return
+		}
+	}
+}
+
+type benchLatency struct {
+	duration time.Duration
+	messages int
+}
+
+// benchStats collects the latencies of the batches produced with -bench.
+type benchStats struct {
+	mu        sync.Mutex
+	latencies []benchLatency
+}
+
+// record adds the latency d of a batch of n messages.
+func (b *benchStats) record(d time.Duration, n int) {
+	b.mu.Lock()
+	b.latencies = append(b.latencies, benchLatency{duration: d, messages: n})
+	b.mu.Unlock()
+}
+
+// percentiles returns the latencies below which the given fractions of
+// messages were acknowledged.
+func (b *benchStats) percentiles(ps ...float64) []time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sort.Slice(b.latencies, func(i, j int) bool { return b.latencies[i].duration < b.latencies[j].duration })
+	var total int
+	for _, l := range b.latencies {
+		total += l.messages
+	}
+
+	result := make([]time.Duration, len(ps))
+	for i, p := range ps {
+		var seen int
+		for _, l := range b.latencies {
+			seen += l.messages
+			result[i] = l.duration
+			if float64(seen) >= p*float64(total) {
+				break
+			}
+		}
+	}
+	return result
+}
+
+type benchLatencies struct {
+	P50  string `json:"p50"`
+	P95  string `json:"p95"`
+	P99  string `json:"p99"`
+	P999 string `json:"p99.9"`
+	Max  string `json:"max"`
+}
+
+type benchReport struct {
+	Messages          int64          `json:"messages"`
+	Failed            int64          `json:"failed"`
+	Bytes             int64          `json:"bytes"`
+	Duration          string         `json:"duration"`
+	MessagesPerSecond float64        `json:"messagesPerSecond"`
+	MBPerSecond       float64        `json:"mbPerSecond"`
+	Latency           benchLatencies `json:"latency"`
+}
+
+// report returns the throughput of delivered messages of size bytes each
+// over d, and the latency percentiles.
+func (b *benchStats) report(delivered, failed int64, size int, d time.Duration) benchReport {
+	ls := b.percentiles(0.5, 0.95, 0.99, 0.999, 1)
+	r := benchReport{
+		Messages: delivered,
+		Failed:   failed,
+		Bytes:    delivered * int64(size),
+		Duration: d.String(),
+		Latency: benchLatencies{
+			P50:  ls[0].String(),
+			P95:  ls[1].String(),
+			P99:  ls[2].String(),
+			P999: ls[3].String(),
+			Max:  ls[4].String(),
+		},
+	}
+	if secs := d.Seconds(); secs > 0 {
+		r.MessagesPerSecond = float64(delivered) / secs
+		r.MBPerSecond = float64(r.Bytes) / (1 << 20) / secs
+	}
+	return r
+}
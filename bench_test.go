@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCountAndSize(t *testing.T) {
+	counts := map[string]int64{"0": 0, "1000": 1000, "10k": 10000, "1M": 1000000, "2G": 2000000000}
+	for s, expected := range counts {
+		actual, err := parseCount(s)
+		require.NoError(t, err, s)
+		require.Equal(t, expected, actual, s)
+	}
+
+	sizes := map[string]int64{"100": 100, "512B": 512, "1KB": 1024, "1kb": 1024, "2MB": 2 << 20}
+	for s, expected := range sizes {
+		actual, err := parseSize(s)
+		require.NoError(t, err, s)
+		require.Equal(t, expected, actual, s)
+	}
+
+	for _, s := range []string{"", "-1", "k", "1X", "1.5M"} {
+		_, err := parseCount(s)
+		require.Error(t, err, s)
+	}
+	_, err := parseSize("1M")
+	require.Error(t, err)
+}
+
+func TestBenchLines(t *testing.T) {
+	out := make(chan string, 200)
+	benchLines(16, 100, make(chan struct{}), out)
+
+	values := map[string]bool{}
+	for v := range out {
+		require.Len(t, v, 16)
+		values[v] = true
+	}
+	require.Len(t, values, benchPayloads)
+
+	quit := make(chan struct{})
+	close(quit)
+	out = make(chan string)
+	benchLines(16, 0, quit, out)
+	_, ok := <-out
+	require.False(t, ok)
+}
+
+func TestBenchReport(t *testing.T) {
+	stats := &benchStats{}
+	stats.record(30*time.Millisecond, 10)
+	stats.record(10*time.Millisecond, 80)
+	stats.record(20*time.Millisecond, 10)
+
+	require.Equal(t, []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 30 * time.Millisecond}, stats.percentiles(0.5, 0.9, 1))
+
+	actual := stats.report(100, 2, 1024, 2*time.Second)
+	require.Equal(t, benchReport{
+		Messages:          100,
+		Failed:            2,
+		Bytes:             102400,
+		Duration:          "2s",
+		MessagesPerSecond: 50,
+		MBPerSecond:       102400.0 / (1 << 20) / 2,
+		Latency:           benchLatencies{P50: "10ms", P95: "30ms", P99: "30ms", P999: "30ms", Max: "30ms"},
+	}, actual)
+
+	require.Equal(t, "0s", (&benchStats{}).report(0, 0, 1024, 0).Latency.Max)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// readFrames sends the binary payloads of r to out as they are, and closes out
+// once r is read. With length framing every payload is prefixed by its length
+// as 4 byte big endian integer, with nul framing payloads are terminated by a
+// NUL byte. Payloads are limited to max bytes.
+func readFrames(name string, r io.Reader, framing string, max int, out chan string) error {
+	var err error
+	switch framing {
+	case "length":
+		err = readLengthFrames(name, bufio.NewReader(r), max, out)
+	case "nul":
+		err = readNULFrames(name, r, max, out)
+	default:
+		err = fmt.Errorf("unsupported framing %#v", framing)
+	}
+	if err != nil {
+		return err
+	}
+
+	close(out)
+	return nil
+}
+
+func readLengthFrames(name string, r io.Reader, max int, out chan string) error {
+	var size [4]byte
+	for n := 1; ; n++ {
+		if _, err := io.ReadFull(r, size[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%v: truncated length of frame %d err=%v", name, n, err)
+		}
+
+		l := binary.BigEndian.Uint32(size[:])
+		if uint64(l) > uint64(max) {
+			return fmt.Errorf("%v: frame %d of %d bytes exceeds buffersize %d", name, n, l, max)
+		}
+		buf := make([]byte, l)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return fmt.Errorf("%v: truncated frame %d err=%v", name, n, err)
+		}
+		out <- string(buf)
+	}
+}
+
+func readNULFrames(name string, r io.Reader, max int, out chan string) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, max), max)
+	scanner.Split(scanNUL)
+
+	for scanner.Scan() {
+		out <- scanner.Text()
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read %v err=%v", name, err)
+	}
+	return nil
+}
+
+// scanNUL is a bufio.SplitFunc that returns the data up to each NUL byte.
+func scanNUL(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
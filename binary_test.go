@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadFrames(t *testing.T) {
+	data := []struct {
+		name     string
+		framing  string
+		input    string
+		expected []string
+		err      string
+	}{
+		{
+			name:     "length",
+			framing:  "length",
+			input:    "\x00\x00\x00\x03a\nb\x00\x00\x00\x00\x00\x00\x00\x02\x00\xff",
+			expected: []string{"a\nb", "", "\x00\xff"},
+		},
+		{
+			name:    "length-truncated",
+			framing: "length",
+			input:   "\x00\x00\x00\x03ab",
+			err:     "test: truncated frame 1 err=unexpected EOF",
+		},
+		{
+			name:    "length-truncated-size",
+			framing: "length",
+			input:   "\x00\x00\x00\x01a\x00\x00",
+			err:     "test: truncated length of frame 2 err=unexpected EOF",
+		},
+		{
+			name:    "length-too-large",
+			framing: "length",
+			input:   "\x00\x00\x01\x00",
+			err:     "test: frame 1 of 256 bytes exceeds buffersize 16",
+		},
+		{
+			name:     "nul",
+			framing:  "nul",
+			input:    "a\nb\x00\x00\xff\x00c",
+			expected: []string{"a\nb", "", "\xff", "c"},
+		},
+		{
+			name:     "nul-terminated",
+			framing:  "nul",
+			input:    "a\x00b\x00",
+			expected: []string{"a", "b"},
+		},
+	}
+
+	for _, d := range data {
+		out := make(chan string, 10)
+		err := readFrames("test", strings.NewReader(d.input), d.framing, 16, out)
+		if d.err != "" {
+			require.EqualError(t, err, d.err, d.name)
+			continue
+		}
+		require.NoError(t, err, d.name)
+
+		actual := []string{}
+		for l := range out {
+			actual = append(actual, l)
+		}
+		require.Equal(t, d.expected, actual, d.name)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// checkpointInterval is the interval at which consumed offsets are written to
+// the checkpoint file.
+const checkpointInterval = time.Second
+
+// checkpoint maps topics and partitions to the next offset to consume.
+type checkpoint map[string]map[int32]int64
+
+// readCheckpoint reads the checkpoint stored at path. A missing file results in
+// an empty checkpoint.
+func readCheckpoint(path string) (checkpoint, error) {
+	cp := checkpoint{}
+
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cp, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint err=%v", err)
+	}
+
+	if err = json.Unmarshal(buf, &cp); err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint %v err=%v", path, err)
+	}
+
+	return cp, nil
+}
+
+// writeCheckpoint replaces the checkpoint stored at path with cp.
+func writeCheckpoint(path string, cp checkpoint) error {
+	buf, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(buf); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// currentCheckpoint returns the resumed offsets updated with the offsets
+// following the last received message per partition.
+func (cmd *consumeCmd) currentCheckpoint() checkpoint {
+	cp := checkpoint{}
+	for t, ps := range cmd.resumed {
+		cp[t] = map[int32]int64{}
+		for p, o := range ps {
+			cp[t][p] = o
+		}
+	}
+
+	for t, ps := range cmd.received.snapshot().Partitions {
+		if cp[t] == nil {
+			cp[t] = map[int32]int64{}
+		}
+		for p, st := range ps {
+			cp[t][p] = st.Last + 1
+		}
+	}
+
+	return cp
+}
+
+// saveCheckpoint writes the current checkpoint, after flushing the output
+// files so that they contain all messages the checkpoint includes.
+func (cmd *consumeCmd) saveCheckpoint() {
+	cmd.checkpointMu.Lock()
+	defer cmd.checkpointMu.Unlock()
+
+	cp := cmd.currentCheckpoint()
+	if cmd.outGzip {
+		cmd.flushOutFiles()
+	}
+	if err := writeCheckpoint(cmd.checkpoint, cp); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write checkpoint %v err=%v\n", cmd.checkpoint, err)
+	}
+}
+
+// writeCheckpoints periodically saves the checkpoint until consumption is
+// stopped.
+func (cmd *consumeCmd) writeCheckpoints() {
+	ticker := time.NewTicker(checkpointInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			cmd.saveCheckpoint()
+		case <-cmd.quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kt-checkpoint")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "offsets.json")
+
+	cp, err := readCheckpoint(path)
+	require.NoError(t, err)
+	require.Empty(t, cp)
+
+	target := &consumeCmd{
+		checkpoint: path,
+		resumed:    checkpoint{"hans": {0: 10, 1: 5}},
+	}
+	target.received.record(&sarama.ConsumerMessage{Topic: "hans", Partition: 0, Offset: 12})
+	target.received.record(&sarama.ConsumerMessage{Topic: "peter", Partition: 3, Offset: 7})
+	target.saveCheckpoint()
+
+	cp, err = readCheckpoint(path)
+	require.NoError(t, err)
+	require.Equal(t, checkpoint{"hans": {0: 13, 1: 5}, "peter": {3: 8}}, cp)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("nope"), 0644))
+	_, err = readCheckpoint(path)
+	require.Error(t, err)
+}
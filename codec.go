@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/ianaindex"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// jsonValue holds JSON that is embedded when marshalling and printed as is
+// in templates.
+type jsonValue []byte
+
+func (v jsonValue) MarshalJSON() ([]byte, error) { return v, nil }
+func (v jsonValue) String() string               { return string(v) }
+
+// valueDecrypter decrypts a message value.
+type valueDecrypter func(data []byte) ([]byte, error)
+
+// aesGCMDecrypter decrypts values that consist of the nonce followed by the
+// AES-GCM sealed data, using the raw 16, 24 or 32 byte key stored at keyPath.
+func aesGCMDecrypter(keyPath string) (valueDecrypter, error) {
+	key, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file err=%v", err)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key in %v err=%v", keyPath, err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(data []byte) ([]byte, error) {
+		if len(data) < aead.NonceSize() {
+			return nil, fmt.Errorf("value is shorter than the nonce")
+		}
+		nonce, sealed := data[:aead.NonceSize()], data[aead.NonceSize():]
+		return aead.Open(nil, nonce, sealed, nil)
+	}, nil
+}
+
+// findCharset returns the encoding of the given charset name. IANA names are
+// preferred over the WHATWG names used by browsers, so that e.g. latin1 is
+// ISO-8859-1 rather than windows-1252.
+func findCharset(name string) (encoding.Encoding, error) {
+	for _, n := range []string{name, strings.Replace(name, "-", "_", -1)} {
+		if enc, err := ianaindex.IANA.Encoding(n); err == nil && enc != nil {
+			return enc, nil
+		}
+		if enc, err := htmlindex.Get(n); err == nil {
+			return enc, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported charset %#v", name)
+}
+
+// valueDecoder transcodes a message value into JSON for presentation.
+type valueDecoder func(data []byte) (json.RawMessage, error)
+
+func protoDecoder(descriptorPath, typeName string) (valueDecoder, error) {
+	var (
+		err   error
+		buf   []byte
+		set   descriptorpb.FileDescriptorSet
+		desc  protoreflect.Descriptor
+		files interface {
+			FindDescriptorByName(protoreflect.FullName) (protoreflect.Descriptor, error)
+		}
+	)
+
+	if buf, err = ioutil.ReadFile(descriptorPath); err != nil {
+		return nil, fmt.Errorf("failed to read proto descriptor err=%v", err)
+	}
+
+	if err = proto.Unmarshal(buf, &set); err != nil {
+		return nil, fmt.Errorf("failed to parse proto descriptor, expected FileDescriptorSet err=%v", err)
+	}
+
+	if files, err = protodesc.NewFiles(&set); err != nil {
+		return nil, fmt.Errorf("failed to load proto descriptor err=%v", err)
+	}
+
+	if desc, err = files.FindDescriptorByName(protoreflect.FullName(typeName)); err != nil {
+		return nil, fmt.Errorf("failed to find proto type %#v err=%v", typeName, err)
+	}
+
+	md, ok := desc.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("proto type %#v is not a message", typeName)
+	}
+
+	return func(data []byte) (json.RawMessage, error) {
+		msg := dynamicpb.NewMessage(md)
+		if err := proto.Unmarshal(data, msg); err != nil {
+			return nil, err
+		}
+		return protojson.Marshal(msg)
+	}, nil
+}
+
+func msgpackDecoder(data []byte) (json.RawMessage, error) {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetMapDecoder(func(d *msgpack.Decoder) (interface{}, error) { return d.DecodeUntypedMap() })
+	v, err := dec.DecodeInterface()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonCompatible(v))
+}
+
+func cborDecoder(data []byte) (json.RawMessage, error) {
+	var v interface{}
+	if err := cbor.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonCompatible(v))
+}
+
+// jsonCompatible converts maps with non-string keys as produced by msgpack
+// and CBOR into maps that can be marshalled to JSON.
+func jsonCompatible(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprintf("%v", k)] = jsonCompatible(e)
+		}
+		return m
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = jsonCompatible(e)
+		}
+		return v
+	case []interface{}:
+		for i, e := range v {
+			v[i] = jsonCompatible(e)
+		}
+		return v
+	}
+	return v
+}
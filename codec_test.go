@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+func TestProtoDecoder(t *testing.T) {
+	fd := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("greeting.proto"),
+		Package: proto.String("kt.test"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Greeting"),
+			Field: []*descriptorpb.FieldDescriptorProto{{
+				Name:     proto.String("text"),
+				JsonName: proto.String("text"),
+				Number:   proto.Int32(1),
+				Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+				Type:     descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+			}},
+		}},
+	}
+	buf, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{fd}})
+	require.NoError(t, err)
+
+	f, err := ioutil.TempFile("", "kt-proto-descriptor")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.Write(buf)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	file, err := protodesc.NewFile(fd, nil)
+	require.NoError(t, err)
+	md := file.Messages().ByName("Greeting")
+	msg := dynamicpb.NewMessage(md)
+	msg.Set(md.Fields().ByName("text"), protoreflect.ValueOfString("hello"))
+	data, err := proto.Marshal(msg)
+	require.NoError(t, err)
+
+	decode, err := protoDecoder(f.Name(), "kt.test.Greeting")
+	require.NoError(t, err)
+	actual, err := decode(data)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"text": "hello"}`, string(actual))
+
+	_, err = decode([]byte{0xff})
+	require.Error(t, err)
+
+	_, err = protoDecoder(f.Name(), "kt.test.Missing")
+	require.Error(t, err)
+}
+
+func TestMsgpackDecoder(t *testing.T) {
+	data, err := msgpack.Marshal(map[string]interface{}{"a": 1, "b": []interface{}{"c", true}})
+	require.NoError(t, err)
+	actual, err := msgpackDecoder(data)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"a": 1, "b": ["c", true]}`, string(actual))
+
+	data, err = msgpack.Marshal(map[int]string{1: "x"})
+	require.NoError(t, err)
+	actual, err = msgpackDecoder(data)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"1": "x"}`, string(actual))
+
+	_, err = msgpackDecoder([]byte{0xc1})
+	require.Error(t, err)
+}
+
+func TestCBORDecoder(t *testing.T) {
+	data, err := cbor.Marshal(map[string]interface{}{"a": 1, "b": []interface{}{"c", true, 1.5}})
+	require.NoError(t, err)
+	actual, err := cborDecoder(data)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"a": 1, "b": ["c", true, 1.5]}`, string(actual))
+
+	data, err = cbor.Marshal(map[int]string{1: "x"})
+	require.NoError(t, err)
+	actual, err = cborDecoder(data)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"1": "x"}`, string(actual))
+
+	_, err = cborDecoder([]byte{0xff})
+	require.Error(t, err)
+}
+
+func TestFindCharset(t *testing.T) {
+	data := []struct {
+		name     string
+		value    []byte
+		expected string
+	}{
+		{name: "latin1", value: []byte{'c', 0xe9, 0x80}, expected: "c\u00e9\u0080"},
+		{name: "windows-1252", value: []byte{'c', 0xe9, 0x80}, expected: "c\u00e9\u20ac"},
+		{name: "shift-jis", value: []byte{0x93, 0xfa, 0x96, 0x7b}, expected: "\u65e5\u672c"},
+		{name: "Shift_JIS", value: []byte{0x93, 0xfa, 0x96, 0x7b}, expected: "\u65e5\u672c"},
+	}
+
+	for _, d := range data {
+		enc, err := findCharset(d.name)
+		require.NoError(t, err, d.name)
+		actual, err := enc.NewDecoder().Bytes(d.value)
+		require.NoError(t, err, d.name)
+		require.Equal(t, d.expected, string(actual), d.name)
+	}
+
+	_, err := findCharset("hans")
+	require.EqualError(t, err, `unsupported charset "hans"`)
+}
+
+func TestAESGCMDecrypter(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	f, err := ioutil.TempFile("", "kt-key")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.Write(key)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	block, err := aes.NewCipher(key)
+	require.NoError(t, err)
+	aead, err := cipher.NewGCM(block)
+	require.NoError(t, err)
+	nonce := []byte("0123456789ab")
+	data := aead.Seal(append([]byte{}, nonce...), nonce, []byte("hans"), nil)
+
+	decrypt, err := aesGCMDecrypter(f.Name())
+	require.NoError(t, err)
+	actual, err := decrypt(data)
+	require.NoError(t, err)
+	require.Equal(t, "hans", string(actual))
+
+	data[len(data)-1] ^= 0xff
+	_, err = decrypt(data)
+	require.Error(t, err)
+
+	_, err = decrypt([]byte("short"))
+	require.Error(t, err)
+}
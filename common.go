@@ -13,6 +13,7 @@ import (
 	"os/user"
 	"regexp"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 	"unicode/utf16"
@@ -42,31 +43,74 @@ func listenForInterrupt(q chan struct{}) {
 
 func kafkaVersion(s string) sarama.KafkaVersion {
 	dflt := sarama.V0_10_0_0
-	switch s {
-	case "v0.8.2.0":
-		return sarama.V0_8_2_0
-	case "v0.8.2.1":
-		return sarama.V0_8_2_1
-	case "v0.8.2.2":
-		return sarama.V0_8_2_2
-	case "v0.9.0.0":
-		return sarama.V0_9_0_0
-	case "v0.9.0.1":
-		return sarama.V0_9_0_1
-	case "v0.10.0.0":
-		return sarama.V0_10_0_0
-	case "v0.10.0.1":
-		return sarama.V0_10_0_1
-	case "v0.10.1.0":
-		return sarama.V0_10_1_0
-	case "v0.10.2.0":
-		return sarama.V0_10_2_0
-	case "":
+	if s == "" {
 		return dflt
 	}
 
-	failf("unsupported kafka version %#v - supported: v0.8.2.0, v0.8.2.1, v0.8.2.2, v0.9.0.0, v0.9.0.1, v0.10.0.0, v0.10.0.1, v0.10.1.0, v0.10.2.0", s)
-	return dflt
+	v, err := sarama.ParseKafkaVersion(strings.TrimPrefix(s, "v"))
+	if err != nil {
+		failf("unsupported kafka version %#v - supported: v%v to v%v", s, sarama.MinVersion, sarama.MaxVersion)
+	}
+
+	return v
+}
+
+// fetchAPIKey identifies fetch requests in the broker's supported API versions.
+const fetchAPIKey = 1
+
+// detectKafkaVersion asks the first reachable broker for its supported API
+// versions and returns the Kafka version matching its newest fetch request.
+func detectKafkaVersion(brokers []string, cfg *sarama.Config) (sarama.KafkaVersion, error) {
+	var err error
+
+	for _, addr := range brokers {
+		var res *sarama.ApiVersionsResponse
+
+		broker := sarama.NewBroker(addr)
+		if err = broker.Open(cfg); err != nil {
+			continue
+		}
+
+		res, err = broker.ApiVersions(&sarama.ApiVersionsRequest{})
+		logClose(fmt.Sprintf("broker %v", addr), broker)
+		if err != nil {
+			continue
+		}
+
+		for _, k := range res.ApiKeys {
+			if k.ApiKey == fetchAPIKey {
+				return fetchKafkaVersion(k.MaxVersion), nil
+			}
+		}
+		err = fmt.Errorf("broker %v does not list fetch requests as supported", addr)
+	}
+
+	return cfg.Version, err
+}
+
+// fetchKafkaVersion returns the oldest Kafka version that supports the given
+// fetch request version.
+func fetchKafkaVersion(v int16) sarama.KafkaVersion {
+	switch {
+	case v >= 12:
+		return sarama.V2_7_0_0
+	case v == 11:
+		return sarama.V2_3_0_0
+	case v >= 9:
+		return sarama.V2_1_0_0
+	case v == 8:
+		return sarama.V2_0_0_0
+	case v == 7:
+		return sarama.V1_1_0_0
+	case v == 6:
+		return sarama.V1_0_0_0
+	case v >= 4:
+		return sarama.V0_11_0_0
+	case v == 3:
+		return sarama.V0_10_1_0
+	default:
+		return sarama.V0_10_0_0
+	}
 }
 
 func logClose(name string, c io.Closer) {
@@ -75,6 +119,9 @@ func logClose(name string, c io.Closer) {
 	}
 }
 
+// rawOutput is printed as is rather than marshalled to JSON.
+type rawOutput string
+
 type printContext struct {
 	output interface{}
 	done   chan struct{}
@@ -93,6 +140,12 @@ func print(in <-chan printContext, pretty bool) {
 
 	for {
 		ctx := <-in
+		if raw, ok := ctx.output.(rawOutput); ok {
+			fmt.Println(string(raw))
+			close(ctx.done)
+			continue
+		}
+
 		if buf, err = marshal(ctx.output); err != nil {
 			failf("failed to marshal output %#v, err=%v", ctx.output, err)
 		}
@@ -102,17 +155,41 @@ func print(in <-chan printContext, pretty bool) {
 	}
 }
 
+var (
+	failMu    sync.Mutex
+	failHooks []func()
+)
+
+// onFail registers f to run before failf exits, e.g. to close partially
+// written files.
+func onFail(f func()) {
+	failMu.Lock()
+	defer failMu.Unlock()
+	failHooks = append(failHooks, f)
+}
+
+// failf prints the message and exits with status 1 after running the hooks
+// registered via onFail. Concurrent calls wait for the first one to exit.
 func failf(msg string, args ...interface{}) {
 	fmt.Fprintf(os.Stderr, msg+"\n", args...)
+	failMu.Lock()
+	for _, f := range failHooks {
+		f()
+	}
 	os.Exit(1)
 }
 
-func readStdinLines(max int, out chan string) {
+// readStdinLines sends the lines of stdin to out, with multi-line JSON
+// messages merged into one line unless literal, see scanMessages.
+func readStdinLines(max int, literal bool, out chan string) {
 	scanner := bufio.NewScanner(os.Stdin)
 	scanner.Buffer(make([]byte, max), max)
-
-	for scanner.Scan() {
-		out <- scanner.Text()
+	if literal {
+		for scanner.Scan() {
+			out <- scanner.Text()
+		}
+	} else {
+		scanMessages(scanner, max, out)
 	}
 
 	if err := scanner.Err(); err != nil {
@@ -157,6 +234,53 @@ func hashCodePartition(key string, partitions int32) int32 {
 	return kafkaAbs(hashCode(key)) % partitions
 }
 
+// murmur2 imitates the murmur2 hash the Java client's default partitioner
+// applies to keys, as does librdkafka's murmur2 partitioner.
+func murmur2(data []byte) int32 {
+	const (
+		seed = uint32(0x9747b28c)
+		m    = uint32(0x5bd1e995)
+		r    = 24
+	)
+
+	l := len(data)
+	h := seed ^ uint32(l)
+	for i := 0; i+4 <= l; i += 4 {
+		k := uint32(data[i]) | uint32(data[i+1])<<8 | uint32(data[i+2])<<16 | uint32(data[i+3])<<24
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+
+	tail := data[l&^3:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
+
+func murmur2Partition(key []byte, partitions int32) int32 {
+	if partitions <= 0 {
+		return -1
+	}
+
+	return (murmur2(key) & 0x7fffffff) % partitions
+}
+
 func sanitizeUsername(u string) string {
 	// Windows user may have format "DOMAIN|MACHINE\username", remove domain/machine if present
 	s := strings.Split(u, "\\")
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestFetchKafkaVersion(t *testing.T) {
+	data := []struct {
+		fetch    int16
+		expected sarama.KafkaVersion
+	}{
+		{fetch: 2, expected: sarama.V0_10_0_0},
+		{fetch: 3, expected: sarama.V0_10_1_0},
+		{fetch: 5, expected: sarama.V0_11_0_0},
+		{fetch: 7, expected: sarama.V1_1_0_0},
+		{fetch: 10, expected: sarama.V2_1_0_0},
+		{fetch: 11, expected: sarama.V2_3_0_0},
+		{fetch: 13, expected: sarama.V2_7_0_0},
+	}
+
+	for _, d := range data {
+		actual := fetchKafkaVersion(d.fetch)
+		if actual != d.expected {
+			t.Errorf("expected %v but found %v for fetch version %v", d.expected, actual, d.fetch)
+		}
+	}
+}
@@ -1,42 +1,124 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/base64"
+	"encoding/csv"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"math"
+	"math/rand"
+	"net"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
+	"unicode/utf8"
 
 	"github.com/Shopify/sarama"
+	"golang.org/x/text/encoding"
 )
 
 type consumeCmd struct {
-	topic       string
-	brokers     []string
-	offsets     map[int32]interval
-	timeout     time.Duration
-	verbose     bool
-	config      *sarama.Config
-	encodeValue string
-	encodeKey   string
-	pretty      bool
-	client      sarama.Client
-	consumer    sarama.Consumer
+	topic           string
+	topicRegexp     *regexp.Regexp
+	skipInternal    bool
+	brokers         []string
+	offsets         map[int32]interval
+	exclude         map[int32]bool
+	since           time.Time
+	until           time.Time
+	tail            int64
+	count           int64
+	sample          float64
+	pace            *pacer
+	noFollow        bool
+	newest          map[string]map[int32]int64
+	timeout         time.Duration
+	idleTimeout     time.Duration
+	stats           time.Duration
+	retries         int
+	concurrency     int
+	retryBackoff    time.Duration
+	verbose         bool
+	config          *sarama.Config
+	autoVersion     bool
+	encodeValue     string
+	encodeKey       string
+	decodeValue     valueDecoder
+	decodeKey       valueDecoder
+	decryptValue    valueDecrypter
+	registry        *schemaRegistry
+	schemaInfo      bool
+	valueCharset    encoding.Encoding
+	filterKey       *regexp.Regexp
+	filterValue     *regexp.Regexp
+	filterHeaders   []headerFilter
+	minSize         int
+	maxSize         int
+	rawOut          string
+	checkpoint      string
+	resumed         checkpoint
+	template        *template.Template
+	csvColumns      []string
+	printField      string
+	restProxy       bool
+	outPrefix       string
+	outGzip         bool
+	exec            string
+	skipUndecodable bool
+	lag             bool
+	watermarks      bool
+	latest          *latestMessages
+	commitOnExit    bool
+	epochMillis     bool
+	timestampTypes  map[string]string
+	merge           *mergedMessages
+	pretty          bool
+	group           string
+	client          sarama.Client
+	consumer        sarama.Consumer
+
+	emitted      int64
+	undecodable  int64
+	abandoned    int64
+	seen         int64
+	received     consumeStats
+	activity     chan struct{}
+	quit         chan struct{}
+	stopOnce     sync.Once
+	pause        pauseGate
+	multiTopic   bool
+	outFilesMu   sync.Mutex
+	outFiles     map[string]map[int32]*outFile
+	oldestMu     sync.Mutex
+	oldest       map[string]map[int32]cachedOffset
+	checkpointMu sync.Mutex
 }
 
 type offset struct {
 	relative bool
 	start    int64
 	diff     int64
+	percent  bool // diff is a percentage of the partition's messages
 }
 
-func (cmd *consumeCmd) resolveOffset(o offset, partition int32) (int64, error) {
+func (cmd *consumeCmd) resolveOffset(o offset, topic string, partition int32) (int64, error) {
 	if !o.relative {
 		return o.start, nil
 	}
@@ -47,7 +129,7 @@ func (cmd *consumeCmd) resolveOffset(o offset, partition int32) (int64, error) {
 	)
 
 	if o.start == sarama.OffsetNewest || o.start == sarama.OffsetOldest {
-		if res, err = cmd.client.GetOffset(cmd.topic, partition, o.start); err != nil {
+		if res, err = cmd.client.GetOffset(topic, partition, o.start); err != nil {
 			return 0, err
 		}
 
@@ -55,49 +137,175 @@ func (cmd *consumeCmd) resolveOffset(o offset, partition int32) (int64, error) {
 			res = res - 1
 		}
 
-		return res + o.diff, nil
+		diff := o.diff
+		if o.percent {
+			if diff, err = cmd.percentOfPartition(o.diff, topic, partition); err != nil {
+				return 0, err
+			}
+		}
+
+		return res + diff, nil
 	}
 
 	return o.start + o.diff, nil
 }
 
+// percentOfPartition returns the given percentage of the number of messages
+// currently available on the given partition.
+func (cmd *consumeCmd) percentOfPartition(pct int64, topic string, partition int32) (int64, error) {
+	oldest, err := cmd.client.GetOffset(topic, partition, sarama.OffsetOldest)
+	if err != nil {
+		return 0, err
+	}
+
+	newest, err := cmd.client.GetOffset(topic, partition, sarama.OffsetNewest)
+	if err != nil {
+		return 0, err
+	}
+
+	return (newest - oldest) * pct / 100, nil
+}
+
+// resolveTime returns the offset of the first message on the given partition
+// with a timestamp at or after t. If there is no such message, the newest
+// offset is returned.
+func (cmd *consumeCmd) resolveTime(t time.Time, topic string, partition int32) (int64, error) {
+	ms := t.UnixNano() / int64(time.Millisecond)
+	res, err := cmd.client.GetOffset(topic, partition, ms)
+	if err != nil {
+		return 0, err
+	}
+
+	if res == -1 {
+		return cmd.client.GetOffset(topic, partition, sarama.OffsetNewest)
+	}
+
+	return res, nil
+}
+
+// resolveTail returns the offset of the message that is cmd.tail messages
+// before the newest offset on the given partition, or the oldest offset when
+// the partition holds fewer messages.
+func (cmd *consumeCmd) resolveTail(topic string, partition int32) (int64, error) {
+	oldest, err := cmd.client.GetOffset(topic, partition, sarama.OffsetOldest)
+	if err != nil {
+		return 0, err
+	}
+
+	newest, err := cmd.client.GetOffset(topic, partition, sarama.OffsetNewest)
+	if err != nil {
+		return 0, err
+	}
+
+	if start := newest - cmd.tail; start > oldest {
+		return start, nil
+	}
+
+	return oldest, nil
+}
+
 type interval struct {
 	start offset
 	end   offset
 }
 
 type consumeArgs struct {
-	topic       string
-	brokers     string
-	timeout     time.Duration
-	offsets     string
-	verbose     bool
-	encodeValue string
-	encodeKey   string
-	pretty      bool
-	tls         bool
-	clientCert  string
-	conn        connectionArgs
+	topic             string
+	skipInternal      bool
+	brokers           string
+	timeout           time.Duration
+	idleTimeout       time.Duration
+	stats             time.Duration
+	offsets           string
+	exclude           string
+	since             string
+	until             string
+	tail              int64
+	count             int64
+	sample            float64
+	pace              float64
+	noFollow          bool
+	verbose           bool
+	encodeValue       string
+	encodeKey         string
+	valueCodec        string
+	valueCharset      string
+	protoDesc         string
+	protoType         string
+	filterKey         string
+	filterValue       string
+	filterHeaders     stringsFlag
+	minSize           int
+	maxSize           int
+	rawOut            string
+	checkpoint        string
+	resume            bool
+	template          string
+	output            string
+	columns           string
+	print             string
+	decrypt           string
+	registry          string
+	registryDecode    string
+	schemaInfo        bool
+	clientRack        string
+	fetchMinBytes     int
+	fetchMaxBytes     int
+	maxWait           time.Duration
+	bufferSize        int
+	concurrency       int
+	keyFile           string
+	outPrefix         string
+	outCompress       string
+	exec              string
+	skipUndecodable   bool
+	lag               bool
+	watermarks        bool
+	latestByKey       bool
+	mergeByTime       bool
+	mergeWindow       time.Duration
+	commitInterval    time.Duration
+	commitOnExit      bool
+	instanceID        string
+	rebalanceStrategy string
+	offsetReset       string
+	isolation         string
+	retries           int
+	retryBackoff      time.Duration
+	timestampFormat   string
+	pretty            bool
+	group             string
+	tls               bool
+	clientCert        string
+	conn              connectionArgs
 }
 
 func parseOffset(str string) (offset, error) {
 	result := offset{}
-	re := regexp.MustCompile("(oldest|newest)?(-|\\+)?(\\d+)?")
+	re := regexp.MustCompile("(oldest|newest)?(-|\\+)?(\\d+)?(%)?")
 	matches := re.FindAllStringSubmatch(str, -1)
 
-	if len(matches) == 0 || len(matches[0]) < 4 {
+	if len(matches) == 0 || len(matches[0]) < 5 {
 		return result, fmt.Errorf("Could not parse offset [%v]", str)
 	}
 
 	startStr := matches[0][1]
 	qualifierStr := matches[0][2]
 	intStr := matches[0][3]
+	percentStr := matches[0][4]
 
 	var err error
 	if result.start, err = strconv.ParseInt(intStr, 10, 64); err != nil && len(intStr) > 0 {
 		return result, fmt.Errorf("Invalid offset [%v]", str)
 	}
 
+	if len(percentStr) > 0 {
+		if len(qualifierStr) == 0 || result.start > 100 {
+			return result, fmt.Errorf("Invalid percentage offset [%v]", str)
+		}
+		result.percent = true
+	}
+
 	if len(qualifierStr) > 0 {
 		result.relative = true
 		result.diff = result.start
@@ -179,6 +387,87 @@ func parseOffsets(str string) (map[int32]interval, error) {
 	return result, nil
 }
 
+// finiteOffsets reports whether all intervals in offsets end, so that
+// consuming a partition eventually finishes.
+func finiteOffsets(offsets map[int32]interval) bool {
+	for _, i := range offsets {
+		if !i.end.relative && i.end.start == 1<<63-1 {
+			return false
+		}
+	}
+	return true
+}
+
+// offsetsFilePath returns the path of the offsets file if the offsets argument
+// refers to one, i.e. starts with @ or contains a dot or path separator, which
+// the offsets syntax never does.
+func offsetsFilePath(str string) (string, bool) {
+	if strings.HasPrefix(str, "@") {
+		return str[1:], true
+	}
+	return str, strings.ContainsAny(str, "./"+string(os.PathSeparator))
+}
+
+type offsetsFileEntry struct {
+	Start interface{} `json:"start"`
+	End   interface{} `json:"end"`
+}
+
+// readOffsetsFile reads a JSON object mapping partitions to start and end
+// offsets from the given file and returns it in the syntax of -offsets.
+func readOffsetsFile(path string) (string, error) {
+	var (
+		entries map[string]offsetsFileEntry
+		specs   []string
+	)
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read offsets file err=%v", err)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	if err = dec.Decode(&entries); err != nil {
+		return "", fmt.Errorf("failed to parse offsets file %v err=%v", path, err)
+	}
+
+	for p, e := range entries {
+		if _, err := strconv.ParseInt(p, 10, 32); err != nil && p != "all" {
+			return "", fmt.Errorf("invalid partition %#v in offsets file %v", p, path)
+		}
+		specs = append(specs, fmt.Sprintf("%s=%s:%s", p, offsetsFileValue(e.Start), offsetsFileValue(e.End)))
+	}
+	sort.Strings(specs)
+
+	return strings.Join(specs, ","), nil
+}
+
+// parsePartitionList parses a comma separated list of partition ids.
+func parsePartitionList(str string) (map[int32]bool, error) {
+	res := map[int32]bool{}
+	if str == "" {
+		return res, nil
+	}
+
+	for _, ps := range strings.Split(str, ",") {
+		p, err := strconv.ParseInt(strings.TrimSpace(ps), 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		res[int32(p)] = true
+	}
+
+	return res, nil
+}
+
+func offsetsFileValue(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
 func (cmd *consumeCmd) failStartup(msg string) {
 	fmt.Fprintln(os.Stderr, msg)
 	failf("use \"kt consume -help\" for more information")
@@ -199,7 +488,13 @@ func (cmd *consumeCmd) parseArgs(as []string) {
 		args.topic = envTopic
 	}
 	cmd.topic = args.topic
+	cmd.skipInternal = args.skipInternal
+	if cmd.topicRegexp, err = compileTopics(args.topic); err != nil {
+		cmd.failStartup(fmt.Sprintf("invalid regex for topic err=%v", err))
+	}
 	cmd.timeout = args.timeout
+	cmd.idleTimeout = args.idleTimeout
+	cmd.stats = args.stats
 	cmd.verbose = args.verbose
 	cmd.pretty = args.pretty
 
@@ -210,11 +505,187 @@ func (cmd *consumeCmd) parseArgs(as []string) {
 	cmd.encodeValue = args.encodeValue
 
 	if args.encodeKey != "string" && args.encodeKey != "hex" && args.encodeKey != "base64" {
-		cmd.failStartup(fmt.Sprintf(`unsupported encodekey argument %#v, only string, hex and base64 are supported.`, args.encodeValue))
+		cmd.failStartup(fmt.Sprintf(`unsupported encodekey argument %#v, only string, hex and base64 are supported.`, args.encodeKey))
 		return
 	}
 	cmd.encodeKey = args.encodeKey
 
+	switch args.valueCodec {
+	case "":
+	case "proto":
+		if args.protoDesc == "" || args.protoType == "" {
+			cmd.failStartup("proto-descriptor and proto-type are required for the proto value codec.")
+		}
+		if cmd.decodeValue, err = protoDecoder(args.protoDesc, args.protoType); err != nil {
+			cmd.failStartup(fmt.Sprintf("%s", err))
+		}
+	case "msgpack":
+		cmd.decodeValue = msgpackDecoder
+	case "cbor":
+		cmd.decodeValue = cborDecoder
+	default:
+		cmd.failStartup(fmt.Sprintf(`unsupported value-codec argument %#v, only proto, msgpack and cbor are supported.`, args.valueCodec))
+	}
+
+	if args.valueCharset != "" {
+		if cmd.valueCharset, err = findCharset(args.valueCharset); err != nil {
+			cmd.failStartup(fmt.Sprintf("%s", err))
+		}
+	}
+
+	switch args.decrypt {
+	case "":
+		if args.keyFile != "" {
+			cmd.failStartup("key-file requires decrypt.")
+		}
+	case "aes-gcm":
+		if args.keyFile == "" {
+			cmd.failStartup("key-file is required for aes-gcm decryption.")
+		}
+		if cmd.decryptValue, err = aesGCMDecrypter(args.keyFile); err != nil {
+			cmd.failStartup(fmt.Sprintf("%s", err))
+		}
+	default:
+		cmd.failStartup(fmt.Sprintf(`unsupported decrypt argument %#v, only aes-gcm is supported.`, args.decrypt))
+	}
+
+	if args.registry != "" {
+		var key, value bool
+		for _, f := range strings.Split(args.registryDecode, ",") {
+			switch strings.TrimSpace(f) {
+			case "key":
+				key = true
+			case "value":
+				value = true
+			default:
+				cmd.failStartup(fmt.Sprintf(`unsupported registry-decode argument %#v, only key, value and key,value are supported.`, args.registryDecode))
+			}
+		}
+		if value && args.valueCodec != "" {
+			cmd.failStartup("registry cannot decode values when combined with value-codec.")
+		}
+		cmd.registry = newSchemaRegistry(args.registry)
+		if key {
+			cmd.decodeKey = cmd.registry.decode
+		}
+		if value {
+			cmd.decodeValue = cmd.registry.decode
+		}
+	}
+	if args.schemaInfo && args.registry == "" {
+		cmd.failStartup("schema-info requires registry.")
+	}
+	cmd.schemaInfo = args.schemaInfo
+
+	if args.filterKey != "" {
+		if cmd.filterKey, err = regexp.Compile(args.filterKey); err != nil {
+			cmd.failStartup(fmt.Sprintf("invalid regex for filter-key err=%v", err))
+		}
+	}
+
+	if args.filterValue != "" {
+		if cmd.filterValue, err = regexp.Compile(args.filterValue); err != nil {
+			cmd.failStartup(fmt.Sprintf("invalid regex for filter-value err=%v", err))
+		}
+	}
+
+	for _, f := range args.filterHeaders {
+		hf := headerFilter{key: f}
+		if i := strings.Index(f, "="); i >= 0 {
+			hf.key = f[:i]
+			if hf.value, err = regexp.Compile(f[i+1:]); err != nil {
+				cmd.failStartup(fmt.Sprintf("invalid regex for filter-header %#v err=%v", f, err))
+			}
+		}
+		cmd.filterHeaders = append(cmd.filterHeaders, hf)
+	}
+
+	if args.minSize < 0 || args.maxSize < 0 {
+		cmd.failStartup("min-size and max-size have to be a positive number of bytes.")
+	}
+	if args.maxSize > 0 && args.maxSize < args.minSize {
+		cmd.failStartup("max-size cannot be less than min-size.")
+	}
+	cmd.minSize = args.minSize
+	cmd.maxSize = args.maxSize
+
+	if args.rawOut != "" {
+		if err = os.MkdirAll(args.rawOut, 0755); err != nil {
+			cmd.failStartup(fmt.Sprintf("failed to create raw-out directory err=%v", err))
+		}
+	}
+	cmd.rawOut = args.rawOut
+
+	if args.template != "" {
+		if cmd.template, err = template.New("consume").Parse(args.template); err != nil {
+			cmd.failStartup(fmt.Sprintf("invalid template err=%v", err))
+		}
+	}
+
+	switch args.output {
+	case "json":
+	case "csv":
+		if cmd.template != nil {
+			cmd.failStartup("template cannot be combined with csv output.")
+		}
+		for _, c := range strings.Split(args.columns, ",") {
+			c = strings.TrimSpace(c)
+			if !validCSVColumns[c] {
+				cmd.failStartup(fmt.Sprintf(`unsupported column %#v, only topic, partition, offset, timestamp, key and value are supported.`, c))
+			}
+			cmd.csvColumns = append(cmd.csvColumns, c)
+		}
+	case "rest-proxy":
+		if cmd.template != nil || args.valueCodec != "" || args.registry != "" {
+			cmd.failStartup("rest-proxy output cannot be combined with template, value-codec or registry.")
+		}
+		cmd.restProxy = true
+		cmd.encodeKey, cmd.encodeValue = "base64", "base64"
+	default:
+		cmd.failStartup(fmt.Sprintf(`unsupported output argument %#v, only json, csv and rest-proxy are supported.`, args.output))
+	}
+
+	switch args.print {
+	case "", "all":
+	case "key", "value":
+		if cmd.template != nil || len(cmd.csvColumns) > 0 || cmd.restProxy {
+			cmd.failStartup("print cannot be combined with template, csv or rest-proxy output.")
+		}
+		cmd.printField = args.print
+	default:
+		cmd.failStartup(fmt.Sprintf(`unsupported print argument %#v, only key, value and all are supported.`, args.print))
+	}
+
+	if args.outPrefix != "" && args.rawOut != "" {
+		cmd.failStartup("out-prefix cannot be combined with raw-out.")
+	}
+	cmd.outPrefix = args.outPrefix
+
+	switch args.outCompress {
+	case "":
+	case "gzip":
+		if args.outPrefix == "" {
+			cmd.failStartup("out-compress requires out-prefix.")
+		}
+		cmd.outGzip = true
+	default:
+		cmd.failStartup(fmt.Sprintf(`unsupported out-compress argument %#v, only gzip is supported.`, args.outCompress))
+	}
+	cmd.exec = args.exec
+	cmd.skipUndecodable = args.skipUndecodable
+	cmd.lag = args.lag
+	cmd.watermarks = args.watermarks
+
+	if args.resume && args.checkpoint == "" {
+		cmd.failStartup("resume requires a checkpoint file.")
+	}
+	cmd.checkpoint = args.checkpoint
+	if args.resume {
+		if cmd.resumed, err = readCheckpoint(args.checkpoint); err != nil {
+			cmd.failStartup(fmt.Sprintf("%s", err))
+		}
+	}
+
 	envBrokers := os.Getenv("KT_BROKERS")
 	if args.brokers == "" {
 		if envBrokers != "" {
@@ -230,25 +701,307 @@ func (cmd *consumeCmd) parseArgs(as []string) {
 		}
 	}
 
+	if path, ok := offsetsFilePath(args.offsets); ok {
+		if args.offsets, err = readOffsetsFile(path); err != nil {
+			cmd.failStartup(fmt.Sprintf("%s", err))
+		}
+	}
+
 	cmd.offsets, err = parseOffsets(args.offsets)
 	if err != nil {
 		cmd.failStartup(fmt.Sprintf("%s", err))
 	}
+
+	if cmd.exclude, err = parsePartitionList(args.exclude); err != nil {
+		cmd.failStartup(fmt.Sprintf("invalid exclude-partitions argument %#v err=%v", args.exclude, err))
+	}
 	cmd.config = saramaConfig(&args.conn, "consume")
+	cmd.autoVersion = args.conn.version == ""
+
+	now := time.Now()
+	if cmd.since, err = parseTime(args.since, now); err != nil {
+		cmd.failStartup(fmt.Sprintf("invalid since argument %#v err=%v", args.since, err))
+	}
+	if cmd.until, err = parseTime(args.until, now); err != nil {
+		cmd.failStartup(fmt.Sprintf("invalid until argument %#v err=%v", args.until, err))
+	}
+
+	if args.tail < 0 {
+		cmd.failStartup("tail has to be a positive number of messages.")
+	}
+	if args.tail > 0 && args.since != "" {
+		cmd.failStartup("tail cannot be combined with since.")
+	}
+	cmd.tail = args.tail
+
+	if args.count < 0 {
+		cmd.failStartup("count has to be a positive number of messages.")
+	}
+	cmd.count = args.count
+
+	if args.sample < 0 || (args.sample > 1 && args.sample != math.Trunc(args.sample)) {
+		cmd.failStartup("sample has to be a whole number of messages or a fraction between 0 and 1.")
+	}
+	cmd.sample = args.sample
+	cmd.noFollow = args.noFollow
+
+	if args.latestByKey {
+		cmd.latest = &latestMessages{}
+		cmd.noFollow = true
+	}
+
+	if args.mergeByTime {
+		if args.latestByKey {
+			cmd.failStartup("merge-by-time cannot be combined with latest-by-key.")
+		}
+		if args.mergeWindow < 0 {
+			cmd.failStartup("merge-window has to be a positive duration.")
+		}
+		cmd.merge = &mergedMessages{window: args.mergeWindow}
+	}
+
+	if args.pace < 0 {
+		cmd.failStartup("pace has to be a positive number.")
+	}
+	if args.pace > 0 {
+		cmd.pace = &pacer{speed: args.pace}
+	}
+
+	switch args.timestampFormat {
+	case "", "rfc3339":
+	case "epoch-millis":
+		cmd.epochMillis = true
+	default:
+		cmd.failStartup(fmt.Sprintf(`unsupported timestamp-format argument %#v, only rfc3339 and epoch-millis are supported.`, args.timestampFormat))
+	}
+
+	cmd.config.RackID = args.clientRack
+
+	if args.fetchMinBytes <= 0 || args.fetchMinBytes > math.MaxInt32 {
+		cmd.failStartup("fetch-min-bytes has to be a positive 32 bit number.")
+	}
+	if args.fetchMaxBytes < 0 || args.fetchMaxBytes > math.MaxInt32 {
+		cmd.failStartup("fetch-max-bytes has to be a positive 32 bit number or 0.")
+	}
+	if args.maxWait < time.Millisecond {
+		cmd.failStartup("max-wait has to be at least 1ms.")
+	}
+	cmd.config.Consumer.Fetch.Min = int32(args.fetchMinBytes)
+	cmd.config.Consumer.Fetch.Max = int32(args.fetchMaxBytes)
+	if f := cmd.config.Consumer.Fetch; f.Max > 0 && f.Max < f.Default {
+		cmd.config.Consumer.Fetch.Default = f.Max
+	}
+	cmd.config.Consumer.MaxWaitTime = args.maxWait
+
+	if args.concurrency < 0 {
+		cmd.failStartup("concurrency cannot be negative.")
+	}
+	if args.concurrency > 0 && !cmd.noFollow && args.until == "" && !finiteOffsets(cmd.offsets) {
+		cmd.failStartup("concurrency requires no-follow, until or end offsets, as partitions that are followed never make room for the remaining ones.")
+	}
+	cmd.concurrency = args.concurrency
+
+	if args.bufferSize < 0 {
+		cmd.failStartup("buffer-size cannot be negative.")
+	}
+	cmd.config.ChannelBufferSize = args.bufferSize
+
+	switch args.isolation {
+	case "", "read_uncommitted":
+	case "read_committed":
+		cmd.config.Consumer.IsolationLevel = sarama.ReadCommitted
+	default:
+		cmd.failStartup(fmt.Sprintf(`unsupported isolation argument %#v, only read_uncommitted and read_committed are supported.`, args.isolation))
+	}
+
+	if args.retries < 0 {
+		cmd.failStartup("retries has to be a positive number.")
+	}
+	if args.retryBackoff <= 0 {
+		cmd.failStartup("retry-backoff has to be a positive duration.")
+	}
+	cmd.retries = args.retries
+	cmd.retryBackoff = args.retryBackoff
+	cmd.config.Consumer.Return.Errors = true
+
+	cmd.group = args.group
+	if cmd.group != "" {
+		if args.offsets != "" || args.since != "" || args.until != "" || args.tail > 0 || args.noFollow || args.exclude != "" || args.checkpoint != "" || args.latestByKey || args.mergeByTime || args.concurrency > 0 {
+			cmd.failStartup("offsets, since, until, tail, no-follow, exclude-partitions, checkpoint, latest-by-key, merge-by-time and concurrency are not supported when consuming with a group.")
+		}
+		if args.commitInterval < 0 {
+			cmd.failStartup("commit-interval has to be a positive duration.")
+		}
+		cmd.config.Consumer.Offsets.AutoCommit.Enable = args.commitInterval > 0
+		if args.commitInterval > 0 {
+			cmd.config.Consumer.Offsets.AutoCommit.Interval = args.commitInterval
+		}
+		if !args.commitOnExit && args.commitInterval > 0 {
+			cmd.failStartup("commit-on-exit=false requires commit-interval 0, as periodically committed offsets are also committed when leaving the group.")
+		}
+		cmd.commitOnExit = args.commitOnExit
+		cmd.config.Consumer.Group.InstanceId = args.instanceID
+
+		if args.rebalanceStrategy != "" {
+			strategies, err := parseBalanceStrategies(args.rebalanceStrategy)
+			if err != nil {
+				cmd.failStartup(err.Error())
+			}
+			cmd.config.Consumer.Group.Rebalance.GroupStrategies = strategies
+		}
+
+		switch args.offsetReset {
+		case "", "oldest":
+			cmd.config.Consumer.Offsets.Initial = sarama.OffsetOldest
+		case "newest":
+			cmd.config.Consumer.Offsets.Initial = sarama.OffsetNewest
+		default:
+			cmd.failStartup(fmt.Sprintf(`unsupported offset-reset argument %#v, only oldest and newest are supported.`, args.offsetReset))
+		}
+	} else if args.offsetReset != "" || args.instanceID != "" || args.rebalanceStrategy != "" {
+		cmd.failStartup("offset-reset, instance-id and rebalance-strategy are only supported when consuming with a group.")
+	}
+}
+
+// parseBalanceStrategies parses the comma separated, priority-ordered list of
+// rebalance strategies to offer when joining a group.
+func parseBalanceStrategies(str string) ([]sarama.BalanceStrategy, error) {
+	var res []sarama.BalanceStrategy
+	for _, name := range strings.Split(str, ",") {
+		switch name = strings.TrimSpace(name); name {
+		case sarama.RangeBalanceStrategyName:
+			res = append(res, sarama.BalanceStrategyRange)
+		case sarama.RoundRobinBalanceStrategyName:
+			res = append(res, sarama.BalanceStrategyRoundRobin)
+		case sarama.StickyBalanceStrategyName:
+			res = append(res, sarama.BalanceStrategySticky)
+		case "cooperative-sticky":
+			return nil, fmt.Errorf("rebalance-strategy cooperative-sticky is not supported, only eager rebalancing with range, roundrobin and sticky is.")
+		default:
+			return nil, fmt.Errorf("unsupported rebalance-strategy %#v, only range, roundrobin and sticky are supported.", name)
+		}
+	}
+	return res, nil
+}
+
+func (cmd *consumeCmd) checkVersion() {
+	if (!cmd.since.IsZero() || !cmd.until.IsZero()) && !cmd.config.Version.IsAtLeast(sarama.V0_10_1_0) {
+		cmd.failStartup("since and until require -version v0.10.1.0 or later.")
+	}
+
+	if cmd.group != "" && !cmd.config.Version.IsAtLeast(sarama.V0_10_2_0) {
+		cmd.failStartup("group requires -version v0.10.2.0 or later.")
+	}
+
+	if cmd.config.Consumer.Group.InstanceId != "" && !cmd.config.Version.IsAtLeast(sarama.V2_3_0_0) {
+		cmd.failStartup("instance-id requires -version v2.3.0.0 or later.")
+	}
+
+	if cmd.config.RackID != "" && !cmd.config.Version.IsAtLeast(sarama.V2_3_0_0) {
+		cmd.failStartup("client-rack requires -version v2.3.0.0 or later.")
+	}
+
+	if cmd.config.Consumer.IsolationLevel == sarama.ReadCommitted && !cmd.config.Version.IsAtLeast(sarama.V0_11_0_0) {
+		cmd.failStartup("read_committed isolation requires -version v0.11.0.0 or later.")
+	}
+}
+
+// parseTime interprets str as either an RFC3339 timestamp, a duration
+// relative to now (e.g. 2h for two hours ago) or milliseconds since the epoch.
+// The zero time is returned for an empty string.
+func parseTime(str string, now time.Time) (time.Time, error) {
+	if str == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, str); err == nil {
+		return t, nil
+	}
+
+	if d, err := time.ParseDuration(str); err == nil {
+		return now.Add(-d), nil
+	}
+
+	ms, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected RFC3339 timestamp, duration or epoch milliseconds")
+	}
+
+	return time.Unix(0, ms*int64(time.Millisecond)), nil
 }
 
 func (cmd *consumeCmd) parseFlags(as []string) consumeArgs {
 	var args consumeArgs
 	flags := flag.NewFlagSet("consume", flag.ExitOnError)
 	parseConnectionFlags(flags, &args.conn)
-	flags.StringVar(&args.topic, "topic", "", "Topic to consume (required).")
+	flags.StringVar(&args.topic, "topic", "", "Topic to consume, or comma separated list of topics or regexes matching the topics to consume (required).")
+	flags.BoolVar(&args.skipInternal, "skip-internal", false, "Never consume internal topics whose names start with __, e.g. __consumer_offsets.")
 	flags.StringVar(&args.brokers, "brokers", "", "Comma separated list of brokers. Port defaults to 9092 when omitted (defaults to localhost:9092).")
-	flags.StringVar(&args.offsets, "offsets", "", "Specifies what messages to read by partition and offset range (defaults to all).")
+	flags.StringVar(&args.offsets, "offsets", "", "Specifies what messages to read by partition and offset range, or a JSON file with them (defaults to all).")
+	flags.StringVar(&args.exclude, "exclude-partitions", "", "Comma separated list of partitions to skip.")
+	flags.StringVar(&args.since, "since", "", "Start consuming at the first message produced at or after this time (RFC3339, duration ago or epoch millis).")
+	flags.StringVar(&args.until, "until", "", "Stop consuming at the last message produced before this time (RFC3339, duration ago or epoch millis).")
+	flags.Int64Var(&args.tail, "tail", 0, "Start consuming with the newest given number of messages per partition.")
+	flags.Float64Var(&args.sample, "sample", 0, "Only print every Nth message when >= 1, or each message with the given probability when < 1 (default 0 to disable).")
+	flags.Int64Var(&args.count, "count", 0, "Stop consuming after printing the given number of messages (default 0 to disable).")
+	flags.BoolVar(&args.mergeByTime, "merge-by-time", false, "Print the messages of all partitions ordered by timestamp.")
+	flags.DurationVar(&args.mergeWindow, "merge-window", time.Second, "Duration to buffer messages for merge-by-time before printing them when following partitions.")
+	flags.Float64Var(&args.pace, "pace", 0, "Print messages with the time between their timestamps divided by this speed, e.g. 1 for real time or 10 for 10x faster (default 0 to disable).")
+	flags.BoolVar(&args.latestByKey, "latest-by-key", false, "Only print the latest message per key once consumption finished, implies no-follow.")
+	flags.BoolVar(&args.noFollow, "no-follow", false, "Stop consuming each partition at the newest offset at startup.")
+	flags.BoolVar(&args.noFollow, "until-end", false, "Alias for no-follow.")
 	flags.DurationVar(&args.timeout, "timeout", time.Duration(0), "Timeout after not reading messages (default 0 to disable).")
+	flags.DurationVar(&args.idleTimeout, "idle-timeout", time.Duration(0), "Stop consuming after not reading messages from any partition (default 0 to disable).")
+	flags.DurationVar(&args.stats, "stats", time.Duration(0), "Interval to print consumption throughput to stderr (default 0 to disable).")
 	flags.BoolVar(&args.verbose, "verbose", false, "More verbose logging to stderr.")
 	flags.BoolVar(&args.pretty, "pretty", true, "Control output pretty printing.")
 	flags.StringVar(&args.encodeValue, "encodevalue", "string", "Present message value as (string|hex|base64), defaults to string.")
 	flags.StringVar(&args.encodeKey, "encodekey", "string", "Present message key as (string|hex|base64), defaults to string.")
+	flags.StringVar(&args.encodeValue, "value-encoding", "string", "Alias for encodevalue.")
+	flags.StringVar(&args.encodeKey, "key-encoding", "string", "Alias for encodekey.")
+	flags.StringVar(&args.valueCharset, "value-charset", "", "Convert message values from this charset (e.g. latin1, shift_jis, windows-1252) to UTF-8.")
+	flags.StringVar(&args.valueCodec, "value-codec", "", "Decode message value with (proto|msgpack|cbor) and present it as JSON, overrides encodevalue.")
+	flags.StringVar(&args.protoDesc, "proto-descriptor", "", "Path to FileDescriptorSet with the message type for the proto value codec.")
+	flags.StringVar(&args.protoType, "proto-type", "", "Fully qualified message type for the proto value codec, e.g. my.pkg.Message.")
+	flags.BoolVar(&args.skipUndecodable, "skip-undecodable", false, "Skip messages whose key or value cannot be decoded or decrypted rather than failing.")
+	flags.StringVar(&args.registry, "registry", "", "URL of a Schema Registry to decode keys and values in its wire format with.")
+	flags.StringVar(&args.registryDecode, "registry-decode", "key,value", "Decode (key|value|key,value) via registry.")
+	flags.BoolVar(&args.schemaInfo, "schema-info", false, "Include the id, subject and version of the schema keys and values were decoded with via registry.")
+	flags.StringVar(&args.decrypt, "decrypt", "", "Decrypt message values with (aes-gcm) before presenting them.")
+	flags.StringVar(&args.keyFile, "key-file", "", "File with the raw key to decrypt message values with.")
+	flags.StringVar(&args.filterKey, "filter-key", "", "Only print messages with a key matching this regex.")
+	flags.StringVar(&args.filterValue, "filter-value", "", "Only print messages with a value matching this regex.")
+	flags.Var(&args.filterHeaders, "filter-header", "Only print messages with a header key=regex where the header value matches the regex, or with a header key. Can be repeated.")
+	flags.IntVar(&args.minSize, "min-size", 0, "Only print messages whose key and value are at least this many bytes combined.")
+	flags.IntVar(&args.maxSize, "max-size", 0, "Only print messages whose key and value are at most this many bytes combined (default 0 to disable).")
+	flags.StringVar(&args.rawOut, "raw-out", "", "Write each message value verbatim to a file named topic-partition-offset in this directory instead of printing it.")
+	flags.StringVar(&args.template, "template", "", "Go text/template to format each message with instead of printing JSON.")
+	flags.StringVar(&args.print, "print", "", "Print only the (key|value) of each message, or (all) of it, defaults to all.")
+	flags.StringVar(&args.output, "output", "json", "Output format (json|csv|rest-proxy), defaults to json.")
+	flags.StringVar(&args.columns, "columns", "topic,partition,offset,timestamp,key,value", "Comma separated list of columns to print for csv output.")
+	flags.BoolVar(&args.watermarks, "watermarks", false, "Include the oldest and newest offset of the partition of each message.")
+	flags.BoolVar(&args.lag, "lag", false, "Include the number of messages following each message in its partition as lag.")
+	flags.StringVar(&args.exec, "exec", "", "Shell command that is fed each message value on stdin and whose stdout is presented as the value.")
+	flags.StringVar(&args.outPrefix, "out-prefix", "", "Write the messages of partition P to the file prefix.P.jsonl instead of stdout.")
+	flags.StringVar(&args.outCompress, "out-compress", "", "Compress the files written via out-prefix, only gzip is supported.")
+	flags.StringVar(&args.checkpoint, "checkpoint", "", "Periodically write the consumed offsets to this file.")
+	flags.BoolVar(&args.resume, "resume", false, "Start consuming at the offsets stored in the checkpoint file.")
+	flags.StringVar(&args.timestampFormat, "timestamp-format", "", "Present message timestamps as (rfc3339|epoch-millis), defaults to rfc3339.")
+	flags.IntVar(&args.retries, "retries", 10, "Number of times to retry consuming a partition after a temporary error, e.g. a leader change. Followed partitions are retried until stopped.")
+	flags.DurationVar(&args.retryBackoff, "retry-backoff", time.Second, "Initial backoff between retries, doubled for every retry up to 30s.")
+	flags.IntVar(&args.fetchMinBytes, "fetch-min-bytes", 1, "Minimum number of bytes the broker waits for before answering a fetch request.")
+	flags.IntVar(&args.fetchMaxBytes, "fetch-max-bytes", 0, "Maximum number of bytes to fetch per partition in a single request, 0 for no limit.")
+	flags.DurationVar(&args.maxWait, "max-wait", 500*time.Millisecond, "Maximum time the broker waits for fetch-min-bytes before answering a fetch request.")
+	flags.IntVar(&args.concurrency, "concurrency", 0, "Maximum number of partitions to consume at the same time (default 0 for all).")
+	flags.IntVar(&args.bufferSize, "buffer-size", 256, "Maximum number of messages buffered per partition while waiting to be printed.")
+	flags.StringVar(&args.clientRack, "client-rack", "", "Rack of this client, allows fetching from the closest replica rather than the leader.")
+	flags.StringVar(&args.isolation, "isolation", "", "Isolation level for reading transactional messages (read_uncommitted|read_committed), defaults to read_uncommitted.")
+	flags.StringVar(&args.group, "group", "", "Consumer group to join. Partitions are assigned by the group and consumed offsets are committed.")
+	flags.DurationVar(&args.commitInterval, "commit-interval", time.Second, "Interval at which consumed offsets are committed when consuming with a group, 0 to disable.")
+	flags.BoolVar(&args.commitOnExit, "commit-on-exit", true, "Commit consumed offsets when leaving the group.")
+	flags.StringVar(&args.instanceID, "instance-id", "", "Static group instance id (group.instance.id) to rejoin the group without a rebalance after a restart.")
+	flags.StringVar(&args.rebalanceStrategy, "rebalance-strategy", "", "Comma separated list of rebalance strategies to offer when consuming with a group in order of preference (range|roundrobin|sticky), defaults to range.")
+	flags.StringVar(&args.offsetReset, "offset-reset", "", "Where to start consuming partitions without committed offset when consuming with a group (oldest|newest), defaults to oldest.")
 
 	flags.Usage = func() {
 		fmt.Fprintln(os.Stderr, "Usage of consume:")
@@ -275,6 +1028,12 @@ func (cmd *consumeCmd) setupClient() {
 
 func (cmd *consumeCmd) run(args []string) {
 	var err error
+	defer func() {
+		if n := atomic.LoadInt64(&cmd.abandoned); n > 0 {
+			fmt.Fprintf(os.Stderr, "gave up consuming %v partitions\n", n)
+			os.Exit(1)
+		}
+	}()
 
 	cmd.parseArgs(args)
 
@@ -282,22 +1041,107 @@ func (cmd *consumeCmd) run(args []string) {
 		sarama.Logger = log.New(os.Stderr, "", log.LstdFlags)
 	}
 
+	if cmd.autoVersion {
+		if v, err := detectKafkaVersion(cmd.brokers, cmd.config); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to detect kafka version, falling back to %v err=%v\n", cmd.config.Version, err)
+		} else {
+			cmd.config.Version = v
+		}
+	}
+	cmd.checkVersion()
+
+	cmd.quit = make(chan struct{})
+	cmd.activity = make(chan struct{}, 1)
 	cmd.setupClient()
+	defer logClose("client", cmd.client)
 
 	if cmd.consumer, err = sarama.NewConsumerFromClient(cmd.client); err != nil {
 		failf("failed to create consumer err=%v", err)
 	}
 	defer logClose("consumer", cmd.consumer)
+	if cmd.group == "" {
+		go cmd.listenForPause(cmd.consumer)
+	}
+
+	topics := cmd.findTopics()
+	if len(topics) == 0 {
+		failf("Found no topics matching %#v", cmd.topic)
+	}
+	cmd.multiTopic = len(topics) > 1
+	cmd.findTimestampTypes(topics)
+
+	if cmd.outPrefix != "" {
+		onFail(cmd.closeOutFiles)
+		defer cmd.closeOutFiles()
+		if cmd.outGzip {
+			go cmd.flushOutFilesPeriodically()
+		}
+	}
+
+	idle := cmd.idleTimeout
+	if cmd.group != "" && cmd.timeout > 0 && (idle == 0 || cmd.timeout < idle) {
+		idle = cmd.timeout
+	}
+	if idle > 0 {
+		go cmd.watchIdle(idle, time.After)
+	}
+
+	if cmd.stats > 0 {
+		go cmd.reportStats(cmd.stats)
+	}
+
+	started := time.Now()
+	q := make(chan struct{})
+	go listenForInterrupt(q)
+	go func() {
+		select {
+		case <-q:
+			cmd.stop()
+		case <-cmd.quit:
+		}
+	}()
+	defer func() {
+		select {
+		case <-q:
+			cmd.printSummary(time.Since(started))
+		default:
+		}
+	}()
+	defer func() {
+		if n := atomic.LoadInt64(&cmd.undecodable); n > 0 {
+			fmt.Fprintf(os.Stderr, "skipped %v messages that could not be decoded\n", n)
+		}
+	}()
+
+	if len(cmd.csvColumns) > 0 && cmd.outPrefix == "" {
+		fmt.Println(csvLine(cmd.csvColumns))
+	}
+
+	if cmd.checkpoint != "" {
+		go cmd.writeCheckpoints()
+		defer cmd.saveCheckpoint()
+	}
 
-	partitions := cmd.findPartitions()
+	if cmd.group != "" {
+		cmd.consumeGroup(topics)
+		return
+	}
+
+	partitions := map[string][]int32{}
+	for _, t := range topics {
+		if ps := cmd.findPartitions(t); len(ps) > 0 {
+			partitions[t] = ps
+		}
+	}
 	if len(partitions) == 0 {
 		failf("Found no partitions to consume")
 	}
 
 	cmd.consume(partitions)
+	cmd.stop()
 }
 
-func (cmd *consumeCmd) consume(partitions []int32) {
+func (cmd *consumeCmd) consume(partitions map[string][]int32) {
 	var (
 		wg  sync.WaitGroup
 		out = make(chan printContext)
@@ -305,66 +1149,1042 @@ func (cmd *consumeCmd) consume(partitions []int32) {
 
 	go print(out, cmd.pretty)
 
-	wg.Add(len(partitions))
-	for _, p := range partitions {
-		go func(p int32) { defer wg.Done(); cmd.consumePartition(out, p) }(p)
+	if cmd.merge != nil {
+		defer cmd.writeAllMerged(out)
+		if !cmd.noFollow {
+			done, merged := make(chan struct{}), make(chan struct{})
+			go func() { defer close(merged); cmd.writeMerged(out, done) }()
+			defer func() { close(done); <-merged }()
+		}
 	}
-	wg.Wait()
-}
 
-func (cmd *consumeCmd) consumePartition(out chan printContext, partition int32) {
-	var (
-		offsets interval
-		err     error
-		pcon    sarama.PartitionConsumer
-		start   int64
-		end     int64
-		ok      bool
-	)
-
-	if offsets, ok = cmd.offsets[partition]; !ok {
-		offsets, ok = cmd.offsets[-1]
+	if cmd.noFollow {
+		cmd.newest = cmd.newestOffsets(partitions)
 	}
 
-	if start, err = cmd.resolveOffset(offsets.start, partition); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to read start offset for partition %v err=%v\n", partition, err)
-		return
+	var slots chan struct{}
+	if cmd.concurrency > 0 {
+		slots = make(chan struct{}, cmd.concurrency)
 	}
 
-	if end, err = cmd.resolveOffset(offsets.end, partition); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to read end offset for partition %v err=%v\n", partition, err)
-		return
+	for t, ps := range partitions {
+		wg.Add(len(ps))
+		for _, p := range ps {
+			go func(t string, p int32) {
+				defer wg.Done()
+				if slots != nil {
+					select {
+					case slots <- struct{}{}:
+						defer func() { <-slots }()
+					case <-cmd.quit:
+						return
+					}
+				}
+				cmd.consumePartition(out, t, p)
+			}(t, p)
+		}
 	}
+	wg.Wait()
 
-	if pcon, err = cmd.consumer.ConsumePartition(cmd.topic, partition, start); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to consume partition %v err=%v\n", partition, err)
-		return
+	if cmd.latest != nil {
+		for _, l := range cmd.latest.sorted() {
+			cmd.write(out, l.msg, l.hwm)
+		}
+	}
+}
+
+// newestOffsets reads the newest offsets of all partitions, so that
+// partitions that are consumed later, e.g. with -concurrency, stop at the
+// same point in time. Partitions whose newest offset cannot be read are
+// missing from the result.
+func (cmd *consumeCmd) newestOffsets(partitions map[string][]int32) map[string]map[int32]int64 {
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		result = map[string]map[int32]int64{}
+	)
+	for t := range partitions {
+		result[t] = map[int32]int64{}
+	}
+	for t, ps := range partitions {
+		wg.Add(len(ps))
+		for _, p := range ps {
+			go func(t string, p int32) {
+				defer wg.Done()
+				newest, err := cmd.client.GetOffset(t, p, sarama.OffsetNewest)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Failed to read newest offset for topic %v partition %v err=%v\n", t, p, err)
+					return
+				}
+				mu.Lock()
+				result[t][p] = newest
+				mu.Unlock()
+			}(t, p)
+		}
+	}
+	wg.Wait()
+	return result
+}
+
+func (cmd *consumeCmd) consumeGroup(topics []string) {
+	var (
+		err     error
+		grp     sarama.ConsumerGroup
+		out     = make(chan printContext)
+		handler = &groupHandler{cmd: cmd, out: out}
+	)
+
+	if grp, err = sarama.NewConsumerGroupFromClient(cmd.group, cmd.client); err != nil {
+		failf("failed to create consumer group %v err=%v", cmd.group, err)
+	}
+	defer logClose("consumer group", grp)
+	go cmd.listenForPause(grp)
+
+	go func() {
+		for err := range grp.Errors() {
+			fmt.Fprintf(os.Stderr, "consumer group %v encountered err %v\n", cmd.group, err)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go print(out, cmd.pretty)
+	go func() {
+		<-cmd.quit
+		cancel()
+	}()
+
+	for ctx.Err() == nil {
+		if err = grp.Consume(ctx, topics, handler); err != nil {
+			failf("failed to consume with group %v err=%v", cmd.group, err)
+		}
+	}
+}
+
+// groupHandler prints the messages of all partitions claimed by the group
+// member and marks them as consumed so that their offsets are committed.
+type groupHandler struct {
+	cmd *consumeCmd
+	out chan printContext
+}
+
+func (h *groupHandler) Setup(s sarama.ConsumerGroupSession) error {
+	if h.cmd.verbose {
+		fmt.Fprintf(os.Stderr, "joined group %v as member %v with claims %v\n", h.cmd.group, s.MemberID(), s.Claims())
+	}
+	return nil
+}
+
+func (h *groupHandler) Cleanup(s sarama.ConsumerGroupSession) error {
+	if h.cmd.verbose {
+		fmt.Fprintf(os.Stderr, "releasing claims %v of group %v\n", s.Claims(), h.cmd.group)
+	}
+	select {
+	case <-h.cmd.quit: // leaving the group rather than rebalancing
+		if h.cmd.commitOnExit {
+			s.Commit()
+		}
+	default:
+	}
+	return nil
+}
+
+func (h *groupHandler) ConsumeClaim(s sarama.ConsumerGroupSession, c sarama.ConsumerGroupClaim) error {
+	next := c.InitialOffset()
+	for {
+		select {
+		case <-s.Context().Done():
+			return nil
+		case msg, ok := <-c.Messages():
+			if !ok {
+				return nil
+			}
+
+			h.cmd.reportGap(msg, next)
+			if !h.cmd.emit(h.out, msg, c.HighWaterMarkOffset()) {
+				return nil
+			}
+			h.cmd.receive(msg)
+			s.MarkMessage(msg, "")
+			next = msg.Offset + 1
+		}
+	}
+}
+
+func (cmd *consumeCmd) consumePartition(out chan printContext, topic string, partition int32) {
+	var (
+		offsets interval
+		err     error
+		start   int64
+		end     int64
+		ok      bool
+	)
+
+	if offsets, ok = cmd.offsets[partition]; !ok {
+		offsets, ok = cmd.offsets[-1]
+	}
+
+	if start, err = cmd.resolveOffset(offsets.start, topic, partition); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read start offset for topic %v partition %v err=%v\n", topic, partition, err)
+		return
+	}
+
+	if end, err = cmd.resolveOffset(offsets.end, topic, partition); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read end offset for topic %v partition %v err=%v\n", topic, partition, err)
+		return
+	}
+
+	if !cmd.since.IsZero() {
+		if start, err = cmd.resolveTime(cmd.since, topic, partition); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read start offset for topic %v partition %v at %v err=%v\n", topic, partition, cmd.since, err)
+			return
+		}
+	}
+
+	if cmd.tail > 0 {
+		if start, err = cmd.resolveTail(topic, partition); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read offsets to tail topic %v partition %v err=%v\n", topic, partition, err)
+			return
+		}
+	}
+
+	if !cmd.until.IsZero() {
+		if end, err = cmd.resolveTime(cmd.until, topic, partition); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read end offset for topic %v partition %v at %v err=%v\n", topic, partition, cmd.until, err)
+			return
+		}
+		end = end - 1
+
+		if end < start {
+			if cmd.verbose {
+				fmt.Fprintf(os.Stderr, "no messages to consume on topic %v partition %v between offsets %v and %v\n", topic, partition, start, end)
+			}
+			return
+		}
+	}
+
+	if o, ok := cmd.resumed[topic][partition]; ok {
+		start = o
+	}
+
+	if cmd.noFollow {
+		newest, ok := cmd.newest[topic][partition]
+		if !ok {
+			return
+		}
+
+		if newest-1 < end {
+			end = newest - 1
+		}
+
+		if end < start {
+			if cmd.verbose {
+				fmt.Fprintf(os.Stderr, "no messages to consume on topic %v partition %v before newest offset %v\n", topic, partition, newest)
+			}
+			return
+		}
+	}
+
+	if end >= 0 && end < start {
+		if cmd.verbose {
+			fmt.Fprintf(os.Stderr, "no messages to consume on topic %v partition %v between offsets %v and %v\n", topic, partition, start, end)
+		}
+		return
+	}
+
+	cmd.consumeFrom(out, topic, partition, start, end)
+}
+
+// errMessagesClosed is reported when a partition consumer stops delivering
+// messages unexpectedly.
+var errMessagesClosed = errors.New("unexpected closed messages chan")
+
+// consumeFrom consumes the given partition from offset start until end. When
+// consumption fails with a retriable error e.g. during a leader change, it is
+// retried with exponential backoff starting after the last consumed message.
+// Partitions that are followed without end offset are retried until
+// consumption is stopped, others are given up on after cmd.retries retries.
+// Partitions that are given up on make kt exit with status 1.
+func (cmd *consumeCmd) consumeFrom(out chan printContext, topic string, partition int32, start, end int64) {
+	var (
+		err          error
+		pcon         sarama.PartitionConsumer
+		next         = start
+		retries      int
+		attempts     int
+		disconnected time.Time
+		following    = end == 1<<63-1
+	)
+
+	for {
+		if pcon, err = cmd.consumer.ConsumePartition(topic, partition, next); err == nil {
+			var connected func()
+			if !disconnected.IsZero() {
+				offset := next
+				connected = func() {
+					cmd.reportConnection(connectionEvent{Event: "reconnected", Topic: topic, Partition: partition, Offset: offset, Attempt: attempts, Downtime: time.Since(disconnected).String()})
+					disconnected, attempts = time.Time{}, 0
+				}
+			}
+
+			var n int64
+			if n, err = cmd.partitionLoop(out, pcon, topic, partition, next, end, connected); err == nil {
+				return
+			}
+			if n > next {
+				next, retries = n, 0
+			}
+		}
+
+		if !isRetriable(err) || (!following && retries >= cmd.retries) {
+			fmt.Fprintf(os.Stderr, "Failed to consume topic %v partition %v err=%v\n", topic, partition, err)
+			atomic.AddInt64(&cmd.abandoned, 1)
+			return
+		}
+
+		backoff := jitter(retryBackoff(cmd.retryBackoff, retries))
+		retries++
+		attempts++
+		if disconnected.IsZero() {
+			disconnected = time.Now()
+		}
+		cmd.reportConnection(connectionEvent{Event: "disconnected", Topic: topic, Partition: partition, Offset: next, Attempt: attempts, RetryIn: backoff.String(), Error: err.Error()})
+
+		select {
+		case <-time.After(backoff):
+		case <-cmd.quit:
+			return
+		}
+	}
+}
+
+// connectedPollInterval is how often a reconnected partition consumer is
+// checked for its first fetch response.
+const connectedPollInterval = 100 * time.Millisecond
+
+// maxRetryBackoff limits the exponential backoff between retries.
+const maxRetryBackoff = 30 * time.Second
+
+// retryBackoff returns the backoff before the given retry, doubling base for
+// each previous retry up to maxRetryBackoff.
+func retryBackoff(base time.Duration, retries int) time.Duration {
+	backoff := base << uint(retries)
+	if backoff <= 0 || backoff > maxRetryBackoff {
+		backoff = maxRetryBackoff
+	}
+	return backoff
+}
+
+// jitter returns a random duration between half of d and d, so that
+// partitions don't all reconnect at the same time after a broker outage.
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d-d/2)+1))
+}
+
+// connectionEvent reports that consuming a partition failed and is retried,
+// or that it was resumed afterwards.
+type connectionEvent struct {
+	Event     string `json:"event"`
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+	Offset    int64  `json:"offset"`
+	Attempt   int    `json:"attempt"`
+	RetryIn   string `json:"retryIn,omitempty"`
+	Downtime  string `json:"downtime,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+func (cmd *consumeCmd) reportConnection(ev connectionEvent) {
+	buf, err := json.Marshal(ev)
+	if err != nil {
+		failf("failed to marshal connection event err=%v", err)
+	}
+	fmt.Fprintln(os.Stderr, string(buf))
+}
+
+// isRetriable reports whether err is expected to be temporary, e.g. because
+// of a leader change or a broker that is restarting.
+func isRetriable(err error) bool {
+	var kerr sarama.KError
+	if errors.As(err, &kerr) {
+		switch kerr {
+		case sarama.ErrNotLeaderForPartition,
+			sarama.ErrLeaderNotAvailable,
+			sarama.ErrReplicaNotAvailable,
+			sarama.ErrBrokerNotAvailable,
+			sarama.ErrRequestTimedOut,
+			sarama.ErrNetworkException,
+			sarama.ErrUnknownLeaderEpoch,
+			sarama.ErrFencedLeaderEpoch,
+			sarama.ErrOffsetNotAvailable:
+			return true
+		}
+		return false
+	}
+
+	var nerr net.Error
+	return errors.As(err, &nerr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, sarama.ErrOutOfBrokers) ||
+		errors.Is(err, sarama.ErrNotConnected) ||
+		errors.Is(err, errMessagesClosed)
+}
+
+type consumedMessage struct {
+	Topic         string            `json:"topic"`
+	Partition     int32             `json:"partition"`
+	Offset        int64             `json:"offset"`
+	Key           interface{}       `json:"key"`
+	KeyEncoding   string            `json:"keyEncoding,omitempty"`
+	Value         interface{}       `json:"value"`
+	ValueEncoding string            `json:"valueEncoding,omitempty"`
+	Timestamp     *messageTimestamp `json:"timestamp,omitempty"`
+	TimestampType string            `json:"timestampType,omitempty"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	Lag           *int64            `json:"lag,omitempty"`
+	Watermarks    *watermarks       `json:"watermarks,omitempty"`
+	KeySchema     *schemaInfo       `json:"keySchema,omitempty"`
+	ValueSchema   *schemaInfo       `json:"valueSchema,omitempty"`
+}
+
+type watermarks struct {
+	Oldest int64 `json:"oldest"`
+	Newest int64 `json:"newest"`
+}
+
+// emit prints msg unless it is dropped by the key or value filters or
+// sampling. With latest-by-key, msg is held back until consumption finished.
+// hwm is the partition's current high water mark offset. It returns false if
+// msg was dropped because cmd.count messages were already written, so that
+// it isn't recorded as consumed.
+func (cmd *consumeCmd) emit(out chan printContext, msg *sarama.ConsumerMessage, hwm int64) bool {
+	if !cmd.matches(msg) || !cmd.sampled() {
+		return true
+	}
+
+	if cmd.latest != nil {
+		cmd.latest.add(msg, hwm)
+		return true
+	}
+
+	if cmd.merge != nil {
+		cmd.merge.add(msg, hwm, time.Now())
+		return true
+	}
+
+	return cmd.write(out, msg, hwm)
+}
+
+// write prints msg, or writes it to the configured output files. Once
+// cmd.count messages have been written, consumption is stopped and write
+// returns false for further messages.
+func (cmd *consumeCmd) write(out chan printContext, msg *sarama.ConsumerMessage, hwm int64) bool {
+	var (
+		m   consumedMessage
+		err error
+	)
+
+	cmd.pause.wait(cmd.quit)
+	if cmd.pace != nil {
+		cmd.pace.wait(msg.Timestamp, cmd.quit)
+	}
+
+	if cmd.rawOut == "" {
+		if m, err = cmd.newConsumedMessage(msg); err != nil {
+			if !cmd.skipUndecodable {
+				failf("%s", err)
+			}
+			atomic.AddInt64(&cmd.undecodable, 1)
+			if cmd.verbose {
+				fmt.Fprintf(os.Stderr, "skipping %s\n", err)
+			}
+			return true
+		}
+	}
+
+	if cmd.count > 0 {
+		n := atomic.AddInt64(&cmd.emitted, 1)
+		if n > cmd.count {
+			return false
+		}
+		if n == cmd.count {
+			defer cmd.stop()
+		}
+	}
+
+	if cmd.rawOut != "" {
+		cmd.writeRaw(msg)
+		return true
+	}
+
+	if cmd.lag {
+		lag := hwm - msg.Offset - 1
+		m.Lag = &lag
+	}
+
+	if cmd.watermarks {
+		m.Watermarks = &watermarks{Oldest: cmd.oldestOffset(msg.Topic, msg.Partition), Newest: hwm}
+	}
+
+	if cmd.outPrefix != "" {
+		cmd.writeOut(m)
+		return true
+	}
+
+	ctx := printContext{output: cmd.output(m), done: make(chan struct{})}
+	out <- ctx
+	<-ctx.done
+	return true
+}
+
+// output returns what should be printed for m.
+func (cmd *consumeCmd) output(m consumedMessage) interface{} {
+	if len(cmd.csvColumns) > 0 {
+		return rawOutput(csvLine(m.csvRecord(cmd.csvColumns)))
+	}
+
+	if cmd.printField != "" {
+		return rawOutput(m.csvRecord([]string{cmd.printField})[0])
+	}
+
+	if cmd.restProxy {
+		return restProxyRecord{Topic: m.Topic, Key: m.Key, Value: m.Value, Partition: m.Partition, Offset: m.Offset}
+	}
+
+	if cmd.template == nil {
+		return m
+	}
+
+	var buf bytes.Buffer
+	if err := cmd.template.Execute(&buf, m); err != nil {
+		failf("failed to execute template for message on topic %v partition %v offset %v err=%v", m.Topic, m.Partition, m.Offset, err)
+	}
+
+	return rawOutput(buf.String())
+}
+
+// restProxyRecord is a consumed record in the binary embedded format of the
+// Confluent REST Proxy, with base64 encoded key and value.
+type restProxyRecord struct {
+	Topic     string      `json:"topic"`
+	Key       interface{} `json:"key"`
+	Value     interface{} `json:"value"`
+	Partition int32       `json:"partition"`
+	Offset    int64       `json:"offset"`
+}
+
+var validCSVColumns = map[string]bool{
+	"topic":     true,
+	"partition": true,
+	"offset":    true,
+	"timestamp": true,
+	"key":       true,
+	"value":     true,
+}
+
+// csvRecord returns the given columns of m. Null keys, values and timestamps
+// are represented as empty fields.
+func (m consumedMessage) csvRecord(columns []string) []string {
+	record := make([]string, len(columns))
+	for i, c := range columns {
+		switch c {
+		case "topic":
+			record[i] = m.Topic
+		case "partition":
+			record[i] = strconv.FormatInt(int64(m.Partition), 10)
+		case "offset":
+			record[i] = strconv.FormatInt(m.Offset, 10)
+		case "timestamp":
+			if m.Timestamp != nil {
+				record[i] = m.Timestamp.String()
+			}
+		case "key":
+			record[i] = fieldString(m.Key)
+		case "value":
+			record[i] = fieldString(m.Value)
+		}
+	}
+	return record
+}
+
+// fieldString returns the text of a key or value, or the empty string if it
+// is null.
+func fieldString(v interface{}) string {
+	switch v := v.(type) {
+	case *string:
+		if v != nil {
+			return *v
+		}
+	case jsonValue:
+		return v.String()
+	}
+	return ""
+}
+
+func csvLine(record []string) string {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(record)
+	w.Flush()
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+func (cmd *consumeCmd) writeRaw(msg *sarama.ConsumerMessage) {
+	fn := filepath.Join(cmd.rawOut, fmt.Sprintf("%s-%d-%d", msg.Topic, msg.Partition, msg.Offset))
+	if err := ioutil.WriteFile(fn, msg.Value, 0644); err != nil {
+		failf("failed to write message value to %v err=%v", fn, err)
+	}
+
+	if cmd.verbose {
+		fmt.Fprintf(os.Stderr, "wrote %v bytes to %v\n", len(msg.Value), fn)
+	}
+}
+
+// outFlushInterval is the interval at which gzip compressed output files are
+// flushed.
+const outFlushInterval = time.Second
+
+type outFile struct {
+	sync.Mutex
+	*os.File
+	w  io.Writer
+	gz *gzip.Writer
+}
+
+func (f *outFile) Close() error {
+	if f.gz != nil {
+		if err := f.gz.Close(); err != nil {
+			f.File.Close()
+			return err
+		}
+	}
+	return f.File.Close()
+}
+
+// outFileName returns the file that messages of the given partition are
+// written to. The topic is only included when consuming multiple topics.
+func (cmd *consumeCmd) outFileName(topic string, partition int32) string {
+	ext := "jsonl"
+	if cmd.outGzip {
+		ext = "jsonl.gz"
+	}
+	if cmd.multiTopic {
+		return fmt.Sprintf("%s.%s.%d.%s", cmd.outPrefix, topic, partition, ext)
+	}
+	return fmt.Sprintf("%s.%d.%s", cmd.outPrefix, partition, ext)
+}
+
+func (cmd *consumeCmd) openOutFile(topic string, partition int32) (*outFile, error) {
+	cmd.outFilesMu.Lock()
+	defer cmd.outFilesMu.Unlock()
+
+	if cmd.outFiles == nil {
+		cmd.outFiles = map[string]map[int32]*outFile{}
+	}
+	if cmd.outFiles[topic] == nil {
+		cmd.outFiles[topic] = map[int32]*outFile{}
+	}
+	if f, ok := cmd.outFiles[topic][partition]; ok {
+		return f, nil
+	}
+
+	fn := cmd.outFileName(topic, partition)
+	f, err := os.OpenFile(fn, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open output file %v err=%v", fn, err)
+	}
+
+	of := &outFile{File: f, w: f}
+	if cmd.outGzip {
+		of.gz = gzip.NewWriter(f)
+		of.w = of.gz
+	}
+
+	if len(cmd.csvColumns) > 0 {
+		if fi, err := f.Stat(); err == nil && fi.Size() == 0 {
+			fmt.Fprintln(of.w, csvLine(cmd.csvColumns))
+		}
+	}
+
+	cmd.outFiles[topic][partition] = of
+	return of, nil
+}
+
+// writeOut appends m to the output file of its partition.
+func (cmd *consumeCmd) writeOut(m consumedMessage) {
+	var buf []byte
+	var err error
+
+	switch o := cmd.output(m).(type) {
+	case rawOutput:
+		buf = []byte(o)
+	default:
+		if buf, err = json.Marshal(o); err != nil {
+			failf("failed to marshal output %#v, err=%v", o, err)
+		}
+	}
+
+	f, err := cmd.openOutFile(m.Topic, m.Partition)
+	if err != nil {
+		failf("%v", err)
+	}
+
+	// failf closes the output files, so the lock is released first.
+	f.Lock()
+	_, err = f.w.Write(append(buf, '\n'))
+	f.Unlock()
+	if err != nil {
+		failf("failed to write to output file %v err=%v", f.Name(), err)
+	}
+}
+
+// flushOutFiles writes the data that gzip buffered so far to the output
+// files, so that it can be read even if kt is killed.
+func (cmd *consumeCmd) flushOutFiles() {
+	cmd.outFilesMu.Lock()
+	defer cmd.outFilesMu.Unlock()
+
+	for _, ps := range cmd.outFiles {
+		for _, f := range ps {
+			f.Lock()
+			if f.gz != nil {
+				if err := f.gz.Flush(); err != nil {
+					fmt.Fprintf(os.Stderr, "failed to flush output file %v err=%v\n", f.Name(), err)
+				}
+			}
+			f.Unlock()
+		}
+	}
+}
+
+// flushOutFilesPeriodically flushes the output files every outFlushInterval
+// until consumption is stopped.
+func (cmd *consumeCmd) flushOutFilesPeriodically() {
+	ticker := time.NewTicker(outFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			cmd.flushOutFiles()
+		case <-cmd.quit:
+			return
+		}
+	}
+}
+
+func (cmd *consumeCmd) closeOutFiles() {
+	cmd.outFilesMu.Lock()
+	defer cmd.outFilesMu.Unlock()
+
+	for _, ps := range cmd.outFiles {
+		for _, f := range ps {
+			f.Lock()
+			logClose(f.Name(), f)
+			f.Unlock()
+		}
+	}
+}
+
+// oldestOffsetTTL is how long the oldest offset of a partition is cached for
+// -watermarks.
+const oldestOffsetTTL = 10 * time.Second
+
+type cachedOffset struct {
+	offset  int64
+	fetched time.Time
+}
+
+// oldestOffset returns the oldest offset of the given partition, which is
+// refreshed at most every oldestOffsetTTL. It returns -1 if the offset could
+// never be read.
+func (cmd *consumeCmd) oldestOffset(topic string, partition int32) int64 {
+	cmd.oldestMu.Lock()
+	defer cmd.oldestMu.Unlock()
+
+	if cmd.oldest == nil {
+		cmd.oldest = map[string]map[int32]cachedOffset{}
+	}
+	if cmd.oldest[topic] == nil {
+		cmd.oldest[topic] = map[int32]cachedOffset{}
+	}
+
+	c, ok := cmd.oldest[topic][partition]
+	if ok && time.Since(c.fetched) < oldestOffsetTTL {
+		return c.offset
+	}
+
+	o, err := cmd.client.GetOffset(topic, partition, sarama.OffsetOldest)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read oldest offset for topic %v partition %v err=%v\n", topic, partition, err)
+		o = -1
+		if ok {
+			o = c.offset
+		}
+	}
+
+	cmd.oldest[topic][partition] = cachedOffset{offset: o, fetched: time.Now()}
+	return o
+}
+
+// receive records msg in the consumption stats and resets the idle timeout.
+// It is called once msg has been emitted so that checkpoints never include
+// messages that weren't printed yet.
+func (cmd *consumeCmd) receive(msg *sarama.ConsumerMessage) {
+	cmd.received.record(msg)
+	cmd.notifyActivity()
+}
+
+func (cmd *consumeCmd) notifyActivity() {
+	select {
+	case cmd.activity <- struct{}{}:
+	default:
+	}
+}
+
+// watchIdle stops consumption once no message was received for the given
+// duration, as measured by after e.g. time.After.
+func (cmd *consumeCmd) watchIdle(d time.Duration, after func(time.Duration) <-chan time.Time) {
+	for {
+		select {
+		case <-cmd.activity:
+		case <-after(d):
+			if cmd.pause.paused() {
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "no messages received for %s, stopping\n", d)
+			cmd.stop()
+			return
+		case <-cmd.quit:
+			return
+		}
+	}
+}
+
+// stop signals all partition consumers to shut down.
+func (cmd *consumeCmd) stop() {
+	cmd.stopOnce.Do(func() { close(cmd.quit) })
+}
+
+// sampled reports whether the next matching message should be printed
+// according to cmd.sample.
+func (cmd *consumeCmd) sampled() bool {
+	switch {
+	case cmd.sample <= 0 || cmd.sample == 1:
+		return true
+	case cmd.sample < 1:
+		return rand.Float64() < cmd.sample
+	default:
+		return (atomic.AddInt64(&cmd.seen, 1)-1)%int64(cmd.sample) == 0
+	}
+}
+
+// headerFilter matches messages with a header key and, if set, a value
+// matching value.
+type headerFilter struct {
+	key   string
+	value *regexp.Regexp
+}
+
+func (f headerFilter) matches(headers []*sarama.RecordHeader) bool {
+	for _, h := range headers {
+		if string(h.Key) == f.key && (f.value == nil || f.value.Match(h.Value)) {
+			return true
+		}
+	}
+	return false
+}
+
+// stringsFlag collects the values of a flag that can be repeated.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string     { return strings.Join(*f, ",") }
+func (f *stringsFlag) Set(v string) error { *f = append(*f, v); return nil }
+
+func (cmd *consumeCmd) matches(msg *sarama.ConsumerMessage) bool {
+	if cmd.filterKey != nil && !cmd.filterKey.Match(msg.Key) {
+		return false
+	}
+
+	if cmd.filterValue != nil && !cmd.filterValue.Match(msg.Value) {
+		return false
+	}
+
+	for _, f := range cmd.filterHeaders {
+		if !f.matches(msg.Headers) {
+			return false
+		}
+	}
+
+	size := len(msg.Key) + len(msg.Value)
+	if size < cmd.minSize || (cmd.maxSize > 0 && size > cmd.maxSize) {
+		return false
+	}
+
+	return true
+}
+
+// newConsumedMessage returns the presentation of m, or an error if its key or
+// value cannot be decoded.
+func (cmd *consumeCmd) newConsumedMessage(m *sarama.ConsumerMessage) (consumedMessage, error) {
+	result := consumedMessage{
+		Topic:     m.Topic,
+		Partition: m.Partition,
+		Offset:    m.Offset,
+	}
+	result.Key, result.KeyEncoding = encodeBytesSafely(m.Key, cmd.encodeKey)
+	if cmd.decodeKey != nil && m.Key != nil {
+		v, err := cmd.decodeKey(m.Key)
+		if err != nil && err != errNotRegistryEncoded {
+			return result, fmt.Errorf("failed to decode key of message on topic %v partition %v offset %v err=%v", m.Topic, m.Partition, m.Offset, err)
+		}
+		if err == nil {
+			result.Key, result.KeyEncoding = jsonValue(v), ""
+			if cmd.schemaInfo {
+				result.KeySchema = cmd.lookupSchemaInfo(m.Key, m.Topic+"-key")
+			}
+		}
+	}
+
+	value := m.Value
+	if cmd.decryptValue != nil && value != nil {
+		var err error
+		if value, err = cmd.decryptValue(value); err != nil {
+			return result, fmt.Errorf("failed to decrypt value of message on topic %v partition %v offset %v err=%v", m.Topic, m.Partition, m.Offset, err)
+		}
+	}
+
+	if cmd.exec != "" && value != nil {
+		var err error
+		if value, err = execValue(cmd.exec, value); err != nil {
+			return result, fmt.Errorf("failed to exec %#v for message on topic %v partition %v offset %v err=%v", cmd.exec, m.Topic, m.Partition, m.Offset, err)
+		}
+	}
+
+	if cmd.valueCharset != nil && value != nil {
+		var err error
+		if value, err = cmd.valueCharset.NewDecoder().Bytes(value); err != nil {
+			return result, fmt.Errorf("failed to convert value of message on topic %v partition %v offset %v to UTF-8 err=%v", m.Topic, m.Partition, m.Offset, err)
+		}
+	}
+
+	result.Value, result.ValueEncoding = encodeBytesSafely(value, cmd.encodeValue)
+	if cmd.decodeValue != nil && value != nil {
+		v, err := cmd.decodeValue(value)
+		if err != nil && err != errNotRegistryEncoded {
+			return result, fmt.Errorf("failed to decode value of message on topic %v partition %v offset %v err=%v", m.Topic, m.Partition, m.Offset, err)
+		}
+		if err == nil {
+			result.Value, result.ValueEncoding = jsonValue(v), ""
+			if cmd.schemaInfo {
+				result.ValueSchema = cmd.lookupSchemaInfo(value, m.Topic+"-value")
+			}
+		}
+	}
+
+	if !m.Timestamp.IsZero() {
+		result.Timestamp = &messageTimestamp{Time: m.Timestamp, epochMillis: cmd.epochMillis}
+		result.TimestampType = cmd.timestampTypes[m.Topic]
+	}
+
+	if len(m.Headers) > 0 {
+		result.Headers = map[string]string{}
+		for _, h := range m.Headers {
+			result.Headers[string(h.Key)] = string(h.Value)
+		}
 	}
 
-	cmd.partitionLoop(out, pcon, partition, end)
+	return result, nil
 }
 
-type consumedMessage struct {
-	Partition int32      `json:"partition"`
-	Offset    int64      `json:"offset"`
-	Key       *string    `json:"key"`
-	Value     *string    `json:"value"`
-	Timestamp *time.Time `json:"timestamp,omitempty"`
+// lookupSchemaInfo returns the schema that data was decoded with. Failures to
+// look up its subject are only reported in verbose mode, as the schema id is
+// still known.
+func (cmd *consumeCmd) lookupSchemaInfo(data []byte, subject string) *schemaInfo {
+	info, err := cmd.registry.info(data, subject)
+	if err != nil && cmd.verbose {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return info
 }
 
-func newConsumedMessage(m *sarama.ConsumerMessage, encodeKey, encodeValue string) consumedMessage {
-	result := consumedMessage{
-		Partition: m.Partition,
-		Offset:    m.Offset,
-		Key:       encodeBytes(m.Key, encodeKey),
-		Value:     encodeBytes(m.Value, encodeValue),
+// execValue runs command via sh and returns its output for value on stdin,
+// without a trailing newline.
+func execValue(command string, value []byte) ([]byte, error) {
+	var stderr bytes.Buffer
+	c := exec.Command("sh", "-c", command)
+	c.Stdin = bytes.NewReader(value)
+	c.Stderr = &stderr
+
+	out, err := c.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%v %s", err, bytes.TrimSpace(stderr.Bytes()))
 	}
 
-	if !m.Timestamp.IsZero() {
-		result.Timestamp = &m.Timestamp
+	return bytes.TrimSuffix(out, []byte("\n")), nil
+}
+
+// messageTimestamp is presented either as RFC3339 timestamp or as
+// milliseconds since the epoch.
+type messageTimestamp struct {
+	time.Time
+	epochMillis bool
+}
+
+func (t messageTimestamp) String() string {
+	if t.epochMillis {
+		return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
 	}
+	return t.Format(time.RFC3339Nano)
+}
 
-	return result
+func (t messageTimestamp) MarshalJSON() ([]byte, error) {
+	if t.epochMillis {
+		return []byte(t.String()), nil
+	}
+	return t.Time.MarshalJSON()
+}
+
+// UnmarshalJSON accepts both the RFC3339 and the epoch-millis presentation,
+// so that consumed messages can be produced again.
+func (t *messageTimestamp) UnmarshalJSON(data []byte) error {
+	var millis int64
+	if err := json.Unmarshal(data, &millis); err == nil {
+		t.Time, t.epochMillis = time.Unix(0, millis*int64(time.Millisecond)), true
+		return nil
+	}
+
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return fmt.Errorf("timestamp has to be milliseconds since the epoch or an RFC3339 string")
+	}
+	ts, err := time.Parse(time.RFC3339Nano, str)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %#v err=%v", str, err)
+	}
+	t.Time, t.epochMillis = ts, false
+	return nil
+}
+
+// encodeBytesSafely encodes data like encodeBytes, but falls back to base64
+// for data that is not valid UTF-8 when it should be presented as string.
+// The encoding is returned unless data is nil or presented as string, so
+// that produce can decode it again.
+func encodeBytesSafely(data []byte, encoding string) (*string, string) {
+	switch {
+	case data == nil:
+		return nil, ""
+	case encoding == "hex" || encoding == "base64":
+		return encodeBytes(data, encoding), encoding
+	case !utf8.Valid(data):
+		return encodeBytes(data, "base64"), "base64"
+	}
+	return encodeBytes(data, encoding), ""
 }
 
 func encodeBytes(data []byte, encoding string) *string {
@@ -385,13 +2205,33 @@ func encodeBytes(data []byte, encoding string) *string {
 	return &str
 }
 
-func (cmd *consumeCmd) partitionLoop(out chan printContext, pc sarama.PartitionConsumer, p int32, end int64) {
-	defer logClose(fmt.Sprintf("partition consumer %v", p), pc)
+// partitionLoop emits the messages received via pc until end is reached or
+// consumption is stopped. It returns the offset following the last received
+// message and the error that interrupted consumption, if any. When connected
+// is not nil, it is called once pc received its first message or fetch
+// response.
+func (cmd *consumeCmd) partitionLoop(out chan printContext, pc sarama.PartitionConsumer, t string, p int32, next, end int64, connected func()) (int64, error) {
+	defer logClose(fmt.Sprintf("partition consumer %v/%v", t, p), pc)
 	var (
 		timer   *time.Timer
 		timeout = make(<-chan time.Time)
+		probe   <-chan time.Time
 	)
 
+	// sarama doesn't expose fetch responses, but it updates the high water
+	// mark with each of them.
+	if connected != nil {
+		ticker := time.NewTicker(connectedPollInterval)
+		defer ticker.Stop()
+		probe = ticker.C
+	}
+	fetched := func() {
+		if connected != nil {
+			connected()
+			connected, probe = nil, nil
+		}
+	}
+
 	for {
 		if cmd.timeout > 0 {
 			if timer != nil {
@@ -402,46 +2242,177 @@ func (cmd *consumeCmd) partitionLoop(out chan printContext, pc sarama.PartitionC
 		}
 
 		select {
+		case <-cmd.quit:
+			return next, nil
 		case <-timeout:
-			fmt.Fprintf(os.Stderr, "consuming from partition %v timed out after %s\n", p, cmd.timeout)
-			return
+			if cmd.pause.paused() {
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "consuming from topic %v partition %v timed out after %s\n", t, p, cmd.timeout)
+			return next, nil
+		case <-probe:
+			if pc.HighWaterMarkOffset() > 0 {
+				fetched()
+			}
 		case err := <-pc.Errors():
-			fmt.Fprintf(os.Stderr, "partition %v consumer encountered err %s", p, err)
-			return
+			if isRetriable(err) {
+				return next, err
+			}
+			// sarama keeps fetching after errors it cannot recover from by
+			// retrying, so report them and carry on as before.
+			fmt.Fprintf(os.Stderr, "consuming from topic %v partition %v failed err=%v\n", t, p, err)
 		case msg, ok := <-pc.Messages():
 			if !ok {
-				fmt.Fprintf(os.Stderr, "unexpected closed messages chan")
-				return
+				return next, errMessagesClosed
 			}
+			fetched()
 
-			m := newConsumedMessage(msg, cmd.encodeKey, cmd.encodeValue)
-			ctx := printContext{output: m, done: make(chan struct{})}
-			out <- ctx
-			<-ctx.done
+			// offsets can be skipped e.g. due to compaction, so the first
+			// message after the end offset may be the next one received.
+			if end >= 0 && msg.Offset > end {
+				return next, nil
+			}
 
-			if end > 0 && msg.Offset >= end {
-				return
+			cmd.reportGap(msg, next)
+			if !cmd.emit(out, msg, pc.HighWaterMarkOffset()) {
+				return next, nil
+			}
+			cmd.receive(msg)
+			next = msg.Offset + 1
+
+			if end >= 0 && msg.Offset >= end {
+				return next, nil
+			}
+		}
+	}
+}
+
+// reportGap prints the offsets before msg without messages in verbose mode,
+// given next was the expected offset of msg.
+func (cmd *consumeCmd) reportGap(msg *sarama.ConsumerMessage, next int64) {
+	if cmd.verbose {
+		if gap := offsetGap(msg.Topic, msg.Partition, next, msg.Offset); gap != "" {
+			fmt.Fprintln(os.Stderr, gap)
+		}
+	}
+}
+
+// offsetGap describes the offsets from next up to offset, which were
+// skipped as the consumer doesn't expose transaction control records,
+// messages of aborted transactions (with read_committed) or messages that
+// were removed by compaction. An empty string is returned if there's no gap
+// or next is unknown.
+func offsetGap(topic string, partition int32, next, offset int64) string {
+	switch {
+	case next < 0 || offset <= next:
+		return ""
+	case offset == next+1:
+		return fmt.Sprintf("topic %v partition %v has no message at offset %v, e.g. a transaction marker, an aborted transactional or a compacted message", topic, partition, next)
+	default:
+		return fmt.Sprintf("topic %v partition %v has no messages at offsets %v to %v, e.g. transaction markers, aborted transactional or compacted messages", topic, partition, next, offset-1)
+	}
+}
+
+// topicNameRegexp matches the characters Kafka allows for topic names.
+var topicNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
+// compileTopics returns a regex that matches the whole name of any topic in
+// the comma separated list of topic names and regexes. Entries that are valid
+// topic names are matched literally, e.g. the dot in orders.v1 only matches a
+// dot, all others are interpreted as regexes.
+func compileTopics(topics string) (*regexp.Regexp, error) {
+	parts := strings.Split(topics, ",")
+	for i, p := range parts {
+		p = strings.TrimSpace(p)
+		if topicNameRegexp.MatchString(p) {
+			p = regexp.QuoteMeta(p)
+		}
+		parts[i] = "(?:" + p + ")"
+	}
+	return regexp.Compile("^(?:" + strings.Join(parts, "|") + ")$")
+}
+
+func (cmd *consumeCmd) findTopics() []string {
+	var (
+		all []string
+		res []string
+		err error
+	)
+	if all, err = cmd.consumer.Topics(); err != nil {
+		failf("failed to read topics err=%v", err)
+	}
+
+	for _, t := range all {
+		if cmd.skipInternal && strings.HasPrefix(t, "__") {
+			continue
+		}
+		if cmd.topicRegexp.MatchString(t) {
+			res = append(res, t)
+		}
+	}
+
+	return res
+}
+
+// findTimestampTypes looks up whether the given topics use CreateTime or
+// LogAppendTime for message timestamps. Failures are only reported in verbose
+// mode as the timestamp type is merely informational.
+func (cmd *consumeCmd) findTimestampTypes(topics []string) {
+	if !cmd.config.Version.IsAtLeast(sarama.V0_11_0_0) {
+		return
+	}
+
+	broker, err := cmd.client.Controller()
+	if err != nil {
+		if cmd.verbose {
+			fmt.Fprintf(os.Stderr, "failed to find controller to look up timestamp types err=%v\n", err)
+		}
+		return
+	}
+
+	req := &sarama.DescribeConfigsRequest{}
+	for _, t := range topics {
+		req.Resources = append(req.Resources, &sarama.ConfigResource{
+			Type:        sarama.TopicResource,
+			Name:        t,
+			ConfigNames: []string{"message.timestamp.type"},
+		})
+	}
+
+	res, err := broker.DescribeConfigs(req)
+	if err != nil {
+		if cmd.verbose {
+			fmt.Fprintf(os.Stderr, "failed to look up timestamp types err=%v\n", err)
+		}
+		return
+	}
+
+	cmd.timestampTypes = map[string]string{}
+	for _, r := range res.Resources {
+		for _, c := range r.Configs {
+			if c.Name == "message.timestamp.type" {
+				cmd.timestampTypes[r.Name] = c.Value
 			}
 		}
 	}
 }
 
-func (cmd *consumeCmd) findPartitions() []int32 {
+func (cmd *consumeCmd) findPartitions(topic string) []int32 {
 	var (
 		all []int32
 		res []int32
 		err error
 	)
-	if all, err = cmd.consumer.Partitions(cmd.topic); err != nil {
-		failf("failed to read partitions for topic %v err=%v", cmd.topic, err)
-	}
-
-	if _, hasDefault := cmd.offsets[-1]; hasDefault {
-		return all
+	if all, err = cmd.consumer.Partitions(topic); err != nil {
+		failf("failed to read partitions for topic %v err=%v", topic, err)
 	}
 
+	_, hasDefault := cmd.offsets[-1]
 	for _, p := range all {
-		if _, ok := cmd.offsets[p]; ok {
+		if cmd.exclude[p] {
+			continue
+		}
+		if _, ok := cmd.offsets[p]; ok || hasDefault {
 			res = append(res, p)
 		}
 	}
@@ -453,6 +2424,30 @@ var consumeDocString = `
 The values for -topic and -brokers can also be set via environment variables KT_TOPIC and KT_BROKERS respectively.
 The values supplied on the command line win over environment variable values.
 
+Unless it is a valid topic name, i.e. consists only of letters, digits, ".",
+"_" and "-", the topic is interpreted as a regular expression that has to
+match the whole topic name. All matching topics are consumed and each message
+includes the name of the topic it was read from. For example, to consume all
+topics starting with "events-":
+
+  -topic 'events-.*'
+
+Topic names are matched literally, so -topic orders.v1 doesn't consume
+orders_v1. To consume both, use a regex like -topic 'orders[._]v1'.
+
+Multiple topics (or regexes) can be given as a comma separated list to consume
+them as a single stream:
+
+  -topic orders,payments,shipments
+
+To make sure a regex never matches internal topics like __consumer_offsets or
+__transaction_state, add -skip-internal to ignore all topics starting with __:
+
+  -topic '.*' -skip-internal
+
+Unless -version is given, kt asks the brokers which protocol version to use.
+This allows kt to read messages in newer formats, e.g. compressed via zstd.
+
 Offsets can be specified as a comma-separated list of intervals:
 
   [[partition=start:end],...]
@@ -468,7 +2463,7 @@ The default is to consume from the oldest offset on every partition for the give
 
 The following syntax is supported for each offset:
 
-  (oldest|newest)?(+|-)?(\d+)?
+  (oldest|newest)?(+|-)?(\d+)?(%)?
 
  - "oldest" and "newest" refer to the oldest and newest offsets known for a
    given partition.
@@ -484,8 +2479,33 @@ The following syntax is supported for each offset:
  - Relative offsets are based on numeric values and will not take skipped
    offsets (e.g. due to compaction) into account.
 
+ - You can use "%" after a relative numeric value to refer to a percentage of
+   the messages that are currently available on a partition. For example,
+   "newest-10%" refers to the last 10 percent of each partition.
+
  - Given only a numeric value, it is interpreted as an absolute offset value.
 
+Instead of on the command line, the offsets can also be given via a file
+that contains a JSON object with partitions as keys and start and end
+offsets in the syntax above. Values starting with @ or containing a dot or
+path separator are read as file, e.g. -offsets offsets.json or -offsets @offs,
+and kt fails if the file cannot be read. For example:
+
+  {"all": {"start": "oldest"}, "0": {"start": 10, "end": 20}, "2": {"start": "newest-5"}}
+
+Use -exclude-partitions to skip partitions regardless of the offsets, for
+example to read all partitions but 3 and 7:
+
+  -exclude-partitions 3,7
+
+To keep track of the consumed offsets in a local file and continue where a
+previous run stopped:
+
+  -checkpoint offsets.json -resume
+
+The file is updated every second and when kt stops. Partitions without an
+offset in the file start at the offsets specified otherwise.
+
 More examples:
 
 To consume messages from partition 0 between offsets 10 and 20 (inclusive).
@@ -536,4 +2556,399 @@ and
 
 Will achieve the same as the two examples above.
 
+To extract exactly the messages at offsets 100 to 200 of partition 0 and exit,
+e.g. to attach them to a bug report:
+
+  0=100:200
+
+Consumption of a partition stops once its end offset is reached, or the first
+offset after it in case the end offset itself is skipped e.g. due to
+compaction. Partitions whose end offset is before their start offset are not
+consumed.
+
+To consume the last 10 percent of every partition:
+
+  newest-10%:
+
+To print the last 5 messages of every partition and keep following them:
+
+  -tail 5
+
+Unlike "newest-5", -tail never starts before the oldest offset of a partition.
+
+To print the first 10 messages of a topic and exit:
+
+  -count 10
+
+To get a quick look at a high volume topic, print only every 100th message:
+
+  -sample 100
+
+or each message with a probability of 1%:
+
+  -sample 0.01
+
+To replay the messages of the last hour with the time between their
+timestamps, but 10 times faster:
+
+  -since 1h -pace 10
+
+The first message is printed right away, each following message once the time
+between its timestamp and the first message's timestamp, divided by -pace, has
+passed. Messages that are already due, e.g. because of out of order timestamps,
+are printed right away. Combine it with -merge-by-time to replay multiple
+partitions in timestamp order.
+
+To print all messages that are currently in a topic and exit:
+
+  -no-follow
+
+-until-end is an alias of -no-follow. The newest offsets of all partitions are
+read once at startup, before any partition is consumed.
+
+To print the messages of all partitions ordered by their timestamps:
+
+  -merge-by-time
+
+When following partitions, messages are buffered for the duration given via
+-merge-window (default 1s) so that messages of other partitions can be merged.
+The order is therefore only guaranteed for messages that are received within
+that window. With -no-follow, all messages are printed in order once
+consumption finished.
+
+To print the compacted state of a topic, i.e. only the latest message per key
+without keys whose latest message is a tombstone:
+
+  -latest-by-key
+
+This consumes all messages that are currently in the topic (and within any
+given offsets) and prints the remaining messages ordered by partition and offset
+once done. Messages without key are dropped.
+
+When consumption is interrupted, e.g. via Ctrl-C, a summary with the number of
+messages and bytes read, the first and last offset per partition and the
+duration of the session is printed to stderr.
+
+To consume until no message was received on any partition for 30 seconds:
+
+  -idle-timeout 30s
+
+In contrast, -timeout stops consuming each partition individually.
+
+To print the number of messages and bytes consumed per second as well as the
+latest offset per partition to stderr every 10 seconds:
+
+  -stats 10s
+
+To only print messages with a key starting with "user-" and a value
+containing "error":
+
+  -filter-key '^user-' -filter-value error
+
+The filters are applied to the raw key and value before they are encoded or
+decoded for presentation.
+
+To only print messages with an "event-type" header starting with "order" and
+any "trace-id" header:
+
+  -filter-header 'event-type=^order' -filter-header trace-id
+
+To find messages whose key and value are larger than 1MB combined:
+
+  -min-size 1048576
+
+Similarly, -max-size only prints messages up to the given number of bytes.
+
+To present binary keys and values so that they survive the JSON output:
+
+  -key-encoding hex -value-encoding base64
+
+To format each message via a Go text/template rather than printing JSON:
+
+  -template '{{.Partition}} {{.Offset}} {{.Timestamp}} {{index .Headers "trace-id"}} {{.Value}}'
+
+The template has access to the fields Topic, Partition, Offset, Key, Value,
+Timestamp, Headers, Lag and Watermarks (when -lag or -watermarks are set).
+Unless they are decoded to JSON, Key and Value are pointers to strings that are
+nil for null keys and values.
+
+Keys and values that should be presented as strings but are not valid UTF-8
+are presented base64 encoded instead, which is marked via "keyEncoding" or
+"valueEncoding" respectively, for example:
+
+  {"partition":0,"offset":1,"key":"k","value":"/w==","valueEncoding":"base64"}
+
+Keys and values encoded via -encodekey or -encodevalue hex or base64 are
+marked the same way, so that produce decodes them without further flags.
+
+To print only the key or only the value of each message, one per line:
+
+  -print key
+  -print value
+
+Null keys and values result in empty lines. The key and value are presented
+according to -encodekey and -encodevalue, e.g. to print one base64 encoded
+value per line:
+
+  -print value -encodevalue base64
+
+To print messages as CSV, e.g. for spreadsheets or SQL imports:
+
+  -output csv -columns offset,timestamp,key,value
+
+The first line is a header with the column names. Supported columns are topic,
+partition, offset, timestamp, key and value. Null keys and values result in
+empty fields.
+
+To print messages like the Confluent REST Proxy returns consumed records in
+the binary format, e.g. to feed them to tooling built around the REST Proxy:
+
+  -output rest-proxy
+
+Each message is printed on its own line with base64 encoded key and value:
+
+  {"topic":"orders","key":"a2V5","value":"dmFsdWU=","partition":1,"offset":100}
+
+To see whether consumption is keeping up with producers, include the lag, i.e.
+the number of messages in the partition that follow the message at the time it
+is received:
+
+  -lag
+
+To include the oldest and newest offset of the partition with each message,
+e.g. to compute the progress of consumption:
+
+  -watermarks
+
+The newest offset is the offset that the next message produced to the
+partition will have. The oldest offset is refreshed every 10 seconds.
+
+To decrypt values that were encrypted with AES-GCM by the producing
+application, where each value consists of the 12 byte nonce followed by the
+sealed data:
+
+  -decrypt aes-gcm -key-file k.bin
+
+The key file contains the raw 16, 24 or 32 byte key. Decrypted values are then
+subject to -exec, -encodevalue and -value-codec. Other schemes can be
+decrypted via -exec.
+
+To decode values with an external program, e.g. for proprietary formats:
+
+  -exec 'my-decoder --json'
+
+The command is run via sh for each message with the value on stdin, and its
+output (without a trailing newline) is presented as the value. The output is
+subject to -encodevalue and -value-codec.
+
+To archive each partition in its own file rather than interleaving all
+messages on stdout:
+
+  -out-prefix archive/orders
+
+This writes the messages of partition 0 to archive/orders.0.jsonl, of
+partition 1 to archive/orders.1.jsonl and so on, appending to existing files.
+When the topic regex matches multiple topics, the topic name is included, e.g.
+archive/orders.orders-eu.0.jsonl.
+
+To compress the archived messages, add:
+
+  -out-compress gzip
+
+This writes to archive/orders.0.jsonl.gz etc. instead. Appending to an existing
+file adds a new gzip member, which gunzip and zcat read as one stream. The files
+are completed when consumption ends, including via Ctrl-C and errors. The
+compressed data is flushed every second and before writing a -checkpoint, so
+that a killed kt loses at most the last second of messages, which the
+checkpoint doesn't include yet.
+
+To extract binary message values intact, write each value to its own file
+named after topic, partition and offset (e.g. images-0-23) in a directory
+rather than printing it:
+
+  -raw-out values/
+
+To present protobuf encoded values as JSON, pass a FileDescriptorSet that
+includes the message type (e.g. created via protoc --include_imports
+--descriptor_set_out) and the fully qualified name of the type:
+
+  -value-codec proto -proto-descriptor file.desc -proto-type my.pkg.Message
+
+To present keys and values that were serialized via a Schema Registry as JSON:
+
+  -registry http://localhost:8081
+
+Keys and values that start with the magic byte and schema id of the registry's
+wire format are decoded with the referenced Avro, Protobuf or JSON schema.
+Others, including those with a schema id the registry doesn't know, are
+presented as usual. Schemas are requested once per schema id. To decode only
+keys or only values via the registry, e.g. to decode values via -value-codec:
+
+  -registry http://localhost:8081 -registry-decode key
+
+To spot schema changes across a topic, add -schema-info to include the schema
+of decoded keys and values, e.g.:
+
+  "valueSchema": {"id": 7, "subject": "orders-value", "version": 3}
+
+If a schema is registered under multiple subjects, the topic's subject
+(e.g. orders-value) is preferred. Looking up subjects requires Schema Registry
+v5.5.0 or later, otherwise only the id is included.
+
+By default kt exits when a key or value cannot be decoded or decrypted. To skip
+such messages instead, and report their number to stderr when done:
+
+  -skip-undecodable
+
+With -verbose, the reason for skipping each message is reported as well.
+
+To present values that are encoded in a legacy charset rather than UTF-8:
+
+  -value-charset latin1
+  -value-charset shift_jis
+
+IANA charset names and aliases (e.g. iso-8859-15, windows-1252, euc-kr, koi8-r)
+as well as the names supported by browsers are accepted. Values are converted
+after -decrypt and -exec and before -encodevalue and -value-codec.
+
+To present MessagePack or CBOR encoded values as JSON:
+
+  -value-codec msgpack
+  -value-codec cbor
+
+To consume only messages that were produced in the last hour:
+
+  -since 1h
+
+To consume messages produced within a specific time window:
+
+  -since 2017-06-01T10:00:00Z -until 2017-06-01T11:00:00Z
+
+Both -since and -until accept RFC3339 timestamps, durations relative to now
+and epoch milliseconds. They require Kafka v0.10.1.0 or later and override
+the start and end offsets respectively.
+
+Message timestamps are presented as RFC3339 timestamps, along with the
+timestamp type of the topic (CreateTime or LogAppendTime) for Kafka v0.11.0.0
+or later. To present timestamps as milliseconds since the epoch instead:
+
+  -timestamp-format epoch-millis
+
+When consuming a partition fails temporarily, e.g. because its leader changes
+during a rolling restart of the brokers or the brokers are unavailable,
+consumption is retried after the last consumed message. The backoff starts at
+-retry-backoff (default 1s) and is doubled for each retry up to 30s, with a
+random jitter of up to half the backoff. Partitions that are followed without
+end offset are retried until kt is stopped. Otherwise the partition is given up
+on after -retries (default 10) retries without receiving a message. Errors that
+cannot be retried, e.g. a missing authorization, are reported on stderr while
+the partition keeps being consumed. When kt gives up on a partition it exits
+with status 1 once the remaining partitions are done.
+
+Each failure and recovery is reported on stderr as JSON. A partition counts as
+recovered once it receives a message or fetch response again, e.g.:
+
+  {"event":"disconnected","topic":"orders","partition":3,"offset":1200,"attempt":1,"retryIn":"742ms","error":"kafka: client has run out of available brokers to talk to"}
+  {"event":"reconnected","topic":"orders","partition":3,"offset":1200,"attempt":4,"downtime":"9.3s"}
+
+To fetch from replicas in the same rack or availability zone rather than the
+partition leaders, e.g. to avoid cross-zone traffic:
+
+  -client-rack eu-west-1a
+
+This requires Kafka v2.4.0 or later with broker.rack and replica.selector.class
+(e.g. RackAwareReplicaSelector) configured on the brokers.
+
+To tail a topic with low latency, have the broker answer fetch requests as
+soon as any message is available and wait at most 10ms otherwise:
+
+  -fetch-min-bytes 1 -max-wait 10ms
+
+For high-throughput backfills, fewer and larger fetches help instead:
+
+  -fetch-min-bytes 1048576 -fetch-max-bytes 52428800 -max-wait 1s
+
+-fetch-max-bytes limits how many bytes are fetched per partition in a single
+request, by default the fetch size grows as needed for large messages.
+
+Messages are printed one at a time, and consumption of a partition pauses while
+-buffer-size (default 256) messages of it are waiting to be printed. When
+printing to a slow terminal or pipe, memory usage is therefore bounded by
+roughly the number of partitions times -buffer-size messages plus one fetch
+response per broker. To consume a topic with many partitions or large messages
+with less memory:
+
+  -buffer-size 16 -fetch-max-bytes 1048576
+
+To consume at most 20 partitions at the same time, e.g. to dump a topic with
+hundreds of partitions without fetching from all of them at once:
+
+  -no-follow -concurrency 20
+
+The next partition is consumed once one of the current ones is done, so
+-concurrency requires -no-follow, -until or end offsets for all partitions.
+
+To skip messages of aborted transactions and wait for open transactions to be
+committed before printing their messages:
+
+  -isolation read_committed
+
+This requires Kafka v0.11.0.0 or later.
+
+To freeze the output while reading it, send SIGUSR1 to pause and SIGUSR2 to
+resume consumption, e.g.:
+
+  kill -USR1 $(pgrep kt)
+
+While paused no messages are fetched or printed, -timeout and -idle-timeout
+don't apply, and consumption resumes after the last printed message.
+
+Offsets are not necessarily contiguous: transaction commit and abort markers
+take up an offset each but are not messages, messages of aborted transactions
+are skipped with read_committed isolation, and compaction removes messages.
+With -verbose, such gaps in the consumed offsets are reported on stderr.
+
+To consume as a member of the consumer group "specials":
+
+  -group specials
+
+Partitions are then assigned by the group and consumption resumes at the
+offsets committed by the group, starting with the oldest offset for
+partitions without a committed offset. Multiple instances of kt using the same
+group share the partitions of the consumed topics. The -timeout applies to all
+claimed partitions combined. Consuming with a group requires Kafka v0.10.2.0
+or later and cannot be combined with -offsets, -since or -until.
+
+Consumed offsets are committed every second and when leaving the group. To
+commit every 5 seconds, or only when leaving the group:
+
+  -group specials -commit-interval 5s
+  -group specials -commit-interval 0
+
+To not commit at all, add -commit-on-exit=false as well, which requires
+-commit-interval 0. With -commit-interval 0, offsets aren't committed on
+rebalances either, only when kt exits. To start partitions without committed
+offset at the newest rather than the oldest offset:
+
+  -group specials -offset-reset newest
+
+To use static group membership (KIP-345), so that restarting kt within the
+session timeout (10s) doesn't cause the group to rebalance:
+
+  -group specials -instance-id kt-debug
+
+The partitions assigned to the instance id are kept while kt isn't running
+until the session times out. Each member of the group needs its own instance
+id. Static membership requires Kafka v2.3.0.0 or later.
+
+To assign partitions the same way as the other members of the group, e.g.
+consumers using the sticky assignor:
+
+  -group specials -rebalance-strategy sticky,range
+
+The group uses the first strategy that all of its members support.
+Cooperative rebalancing (cooperative-sticky) is not supported, but kt can join
+groups whose members also offer range, roundrobin or sticky, e.g. while they
+migrate to cooperative-sticky.
+
 `
@@ -1,13 +1,23 @@
 package main
 
 import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
 	"reflect"
+	"regexp"
 	"sort"
 	"testing"
+	"text/template"
 	"time"
 
 	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/require"
 )
 
 func TestParseOffsets(t *testing.T) {
@@ -217,6 +227,16 @@ func TestParseOffsets(t *testing.T) {
 			},
 			expectedErr: nil,
 		},
+		{
+			input: "0=newest-10%:oldest+50%",
+			expected: map[int32]interval{
+				0: interval{
+					start: offset{relative: true, start: sarama.OffsetNewest, diff: -10, percent: true},
+					end:   offset{relative: true, start: sarama.OffsetOldest, diff: 50, percent: true},
+				},
+			},
+			expectedErr: nil,
+		},
 		{
 			input: "10",
 			expected: map[int32]interval{
@@ -319,7 +339,7 @@ func TestFindPartitionsToConsume(t *testing.T) {
 		{
 			topic: "a",
 			offsets: map[int32]interval{
-				10: {offset{false, 2, 0}, offset{false, 4, 0}},
+				10: {offset{false, 2, 0, false}, offset{false, 4, 0, false}},
 			},
 			consumer: tConsumer{
 				topics:              []string{"a"},
@@ -335,7 +355,7 @@ func TestFindPartitionsToConsume(t *testing.T) {
 		{
 			topic: "a",
 			offsets: map[int32]interval{
-				-1: {offset{false, 3, 0}, offset{false, 41, 0}},
+				-1: {offset{false, 3, 0, false}, offset{false, 41, 0, false}},
 			},
 			consumer: tConsumer{
 				topics:              []string{"a"},
@@ -356,7 +376,7 @@ func TestFindPartitionsToConsume(t *testing.T) {
 			topic:    d.topic,
 			offsets:  d.offsets,
 		}
-		actual := target.findPartitions()
+		actual := target.findPartitions(d.topic)
 
 		if !reflect.DeepEqual(actual, d.expected) {
 			t.Errorf(
@@ -375,6 +395,155 @@ Input:    topic=%#v offsets=%#v
 	}
 }
 
+func TestFindPartitionsExcluded(t *testing.T) {
+	target := &consumeCmd{
+		consumer: tConsumer{
+			partitions:    map[string][]int32{"a": []int32{0, 1, 2, 3}},
+			partitionsErr: map[string]error{"a": nil},
+		},
+		offsets: map[int32]interval{-1: {offset{false, 3, 0, false}, offset{false, 41, 0, false}}},
+	}
+
+	var err error
+	target.exclude, err = parsePartitionList("1, 3")
+	require.NoError(t, err)
+	require.Equal(t, []int32{0, 2}, target.findPartitions("a"))
+
+	_, err = parsePartitionList("1,x")
+	require.Error(t, err)
+}
+
+func TestConsumeConcurrency(t *testing.T) {
+	calls := make(chan tConsumePartition, 3)
+	messages := map[int32]chan *sarama.ConsumerMessage{}
+	pcs := map[tConsumePartition]tPartitionConsumer{}
+	for _, p := range []int32{0, 1, 2} {
+		messages[p] = make(chan *sarama.ConsumerMessage, 1)
+		pcs[tConsumePartition{"hans", p, 1}] = tPartitionConsumer{messages: messages[p]}
+	}
+	target := &consumeCmd{
+		consumer:     tConsumer{consumePartition: pcs, calls: calls},
+		concurrency:  1,
+		quit:         make(chan struct{}),
+		activity:     make(chan struct{}, 1),
+		retryBackoff: time.Millisecond,
+		offsets:      map[int32]interval{-1: {start: offset{false, 1, 0, false}, end: offset{false, 1, 0, false}}},
+		encodeKey:    "string",
+		encodeValue:  "string",
+	}
+
+	done := make(chan struct{})
+	go func() { target.consume(map[string][]int32{"hans": {0, 1, 2}}); close(done) }()
+
+	for i := 0; i < 3; i++ {
+		var call tConsumePartition
+		select {
+		case call = <-calls:
+		case <-time.After(time.Second):
+			t.Fatalf("partition %v was not consumed", i)
+		}
+		select {
+		case c := <-calls:
+			t.Fatalf("partition %v consumed concurrently with %v", c.partition, call.partition)
+		case <-time.After(20 * time.Millisecond):
+		}
+		messages[call.partition] <- &sarama.ConsumerMessage{Topic: "hans", Partition: call.partition, Offset: 1}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("consume did not finish")
+	}
+}
+
+func TestFindTopicsToConsume(t *testing.T) {
+	data := []struct {
+		topic        string
+		topics       []string
+		skipInternal bool
+		expected     []string
+	}{
+		{
+			topic:    "a",
+			topics:   []string{"a", "ab", "ba"},
+			expected: []string{"a"},
+		},
+		{
+			topic:    "a.*",
+			topics:   []string{"a", "ab", "ba"},
+			expected: []string{"a", "ab"},
+		},
+		{
+			topic:    "c",
+			topics:   []string{"a", "ab", "ba"},
+			expected: nil,
+		},
+		{
+			topic:    "orders.v1",
+			topics:   []string{"orders.v1", "orders_v1"},
+			expected: []string{"orders.v1"},
+		},
+		{
+			topic:    "orders.v1",
+			topics:   []string{"orders_v1"},
+			expected: nil,
+		},
+		{
+			topic:    "orders.v[0-9]",
+			topics:   []string{"orders.v1", "orders_v2"},
+			expected: []string{"orders.v1", "orders_v2"},
+		},
+		{
+			topic:    "a, ba",
+			topics:   []string{"a", "ab", "ba"},
+			expected: []string{"a", "ba"},
+		},
+		{
+			topic:    "b.*,a",
+			topics:   []string{"a", "ab", "ba"},
+			expected: []string{"a", "ba"},
+		},
+		{
+			topic:    ".*",
+			topics:   []string{"__consumer_offsets", "a", "_schemas"},
+			expected: []string{"__consumer_offsets", "a", "_schemas"},
+		},
+		{
+			topic:        ".*",
+			topics:       []string{"__consumer_offsets", "a", "__transaction_state", "_schemas"},
+			skipInternal: true,
+			expected:     []string{"a", "_schemas"},
+		},
+	}
+
+	for _, d := range data {
+		re, err := compileTopics(d.topic)
+		require.NoError(t, err)
+		target := &consumeCmd{
+			consumer:     tConsumer{topics: d.topics},
+			topic:        d.topic,
+			topicRegexp:  re,
+			skipInternal: d.skipInternal,
+		}
+		actual := target.findTopics()
+
+		if !reflect.DeepEqual(actual, d.expected) {
+			t.Errorf(
+				`
+Expected: %#v
+Actual:   %#v
+Input:    topic=%#v topics=%#v
+	`,
+				d.expected,
+				actual,
+				d.topic,
+				d.topics,
+			)
+		}
+	}
+}
+
 func TestConsume(t *testing.T) {
 	closer := make(chan struct{})
 	messageChan := make(<-chan *sarama.ConsumerMessage)
@@ -391,10 +560,10 @@ func TestConsume(t *testing.T) {
 	target.topic = "hans"
 	target.brokers = []string{"localhost:9092"}
 	target.offsets = map[int32]interval{
-		-1: interval{start: offset{false, 1, 0}, end: offset{false, 5, 0}},
+		-1: interval{start: offset{false, 1, 0, false}, end: offset{false, 5, 0, false}},
 	}
 
-	go target.consume(partitions)
+	go target.consume(map[string][]int32{"hans": partitions})
 	defer close(closer)
 
 	end := make(chan struct{})
@@ -439,6 +608,185 @@ Actual:   %#v
 	}
 }
 
+func TestPartitionLoopEndOffset(t *testing.T) {
+	messages := make(chan *sarama.ConsumerMessage, 3)
+	messages <- &sarama.ConsumerMessage{Topic: "hans", Offset: 100}
+	messages <- &sarama.ConsumerMessage{Topic: "hans", Offset: 150}
+	messages <- &sarama.ConsumerMessage{Topic: "hans", Offset: 201}
+
+	target := &consumeCmd{quit: make(chan struct{}), activity: make(chan struct{}, 1)}
+	out := make(chan printContext)
+	printed := make(chan int64, 3)
+	go func() {
+		for ctx := range out {
+			printed <- ctx.output.(consumedMessage).Offset
+			close(ctx.done)
+		}
+	}()
+	defer close(out)
+
+	next, err := target.partitionLoop(out, tPartitionConsumer{messages: messages}, "hans", 0, 100, 200, nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(151), next)
+	require.Len(t, printed, 2)
+	require.Equal(t, int64(100), <-printed)
+	require.Equal(t, int64(150), <-printed)
+}
+
+func TestPartitionLoopErrors(t *testing.T) {
+	messages := make(chan *sarama.ConsumerMessage)
+	errs := make(chan *sarama.ConsumerError)
+	go func() {
+		errs <- &sarama.ConsumerError{Topic: "hans", Err: sarama.ErrTopicAuthorizationFailed}
+		messages <- &sarama.ConsumerMessage{Topic: "hans", Offset: 100}
+	}()
+
+	target := &consumeCmd{quit: make(chan struct{}), activity: make(chan struct{}, 1)}
+	out := make(chan printContext)
+	go func() {
+		for ctx := range out {
+			close(ctx.done)
+		}
+	}()
+	defer close(out)
+
+	// non-retriable errors are reported while consumption continues.
+	next, err := target.partitionLoop(out, tPartitionConsumer{messages: messages, errors: errs}, "hans", 0, 100, 100, nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(101), next)
+
+	go func() { errs <- &sarama.ConsumerError{Topic: "hans", Err: sarama.ErrNotLeaderForPartition} }()
+	next, err = target.partitionLoop(out, tPartitionConsumer{messages: make(chan *sarama.ConsumerMessage), errors: errs}, "hans", 0, 101, 200, nil)
+	require.ErrorIs(t, err, sarama.ErrNotLeaderForPartition)
+	require.Equal(t, int64(101), next)
+}
+
+func TestConsumeFromGivesUp(t *testing.T) {
+	calls := make(chan tConsumePartition, 1)
+	target := &consumeCmd{
+		consumer: tConsumer{
+			consumePartitionErr: map[tConsumePartition]error{{"hans", 0, 1}: sarama.ErrOffsetOutOfRange},
+			calls:               calls,
+		},
+		retries:      1,
+		retryBackoff: time.Millisecond,
+		quit:         make(chan struct{}),
+		activity:     make(chan struct{}, 1),
+	}
+
+	target.consumeFrom(nil, "hans", 0, 1, 2)
+	require.Equal(t, tConsumePartition{"hans", 0, 1}, <-calls)
+	require.Equal(t, int64(1), target.abandoned)
+}
+
+func TestPartitionLoopConnected(t *testing.T) {
+	target := &consumeCmd{quit: make(chan struct{}), activity: make(chan struct{}, 1)}
+	out := make(chan printContext)
+	go func() {
+		for ctx := range out {
+			close(ctx.done)
+		}
+	}()
+	defer close(out)
+
+	// the first message counts as connected.
+	var calls int
+	messages := make(chan *sarama.ConsumerMessage, 2)
+	messages <- &sarama.ConsumerMessage{Topic: "hans", Offset: 100}
+	messages <- &sarama.ConsumerMessage{Topic: "hans", Offset: 101}
+	_, err := target.partitionLoop(out, tPartitionConsumer{messages: messages}, "hans", 0, 100, 101, func() { calls++ })
+	require.NoError(t, err)
+	require.Equal(t, 1, calls)
+
+	// without messages a fetch response, i.e. a known high water mark, does.
+	connected := make(chan struct{})
+	go func() { <-connected; target.stop() }()
+	_, err = target.partitionLoop(out, tPartitionConsumer{highWaterMarkOffset: 100}, "hans", 0, 100, 200, func() { close(connected) })
+	require.NoError(t, err)
+}
+
+func TestConsumeFromRetries(t *testing.T) {
+	first := make(chan *sarama.ConsumerMessage, 1)
+	first <- &sarama.ConsumerMessage{Topic: "hans", Offset: 1}
+	close(first)
+	second := make(chan *sarama.ConsumerMessage, 1)
+	second <- &sarama.ConsumerMessage{Topic: "hans", Offset: 2}
+
+	calls := make(chan tConsumePartition, 3)
+	target := &consumeCmd{
+		consumer: tConsumer{
+			consumePartition: map[tConsumePartition]tPartitionConsumer{
+				{"hans", 0, 1}: {messages: first},
+				{"hans", 0, 2}: {messages: second},
+			},
+			calls: calls,
+		},
+		retries:      1,
+		retryBackoff: time.Millisecond,
+		quit:         make(chan struct{}),
+		activity:     make(chan struct{}, 1),
+	}
+	out := make(chan printContext)
+	go func() {
+		for ctx := range out {
+			close(ctx.done)
+		}
+	}()
+	defer close(out)
+
+	target.consumeFrom(out, "hans", 0, 1, 2)
+	require.Equal(t, tConsumePartition{"hans", 0, 1}, <-calls)
+	require.Equal(t, tConsumePartition{"hans", 0, 2}, <-calls)
+	require.Equal(t, int64(2), target.received.snapshot().Messages)
+}
+
+func TestConsumeFromFollowingRetriesUntilStopped(t *testing.T) {
+	closed := make(chan *sarama.ConsumerMessage)
+	close(closed)
+
+	calls := make(chan tConsumePartition, 10)
+	target := &consumeCmd{
+		consumer: tConsumer{
+			consumePartition: map[tConsumePartition]tPartitionConsumer{{"hans", 0, 1}: {messages: closed}},
+			calls:            calls,
+		},
+		retries:      0,
+		retryBackoff: time.Millisecond,
+		quit:         make(chan struct{}),
+		activity:     make(chan struct{}, 1),
+	}
+
+	done := make(chan struct{})
+	go func() { target.consumeFrom(nil, "hans", 0, 1, 1<<63-1); close(done) }()
+	for i := 0; i < 3; i++ {
+		require.Equal(t, tConsumePartition{"hans", 0, 1}, <-calls)
+	}
+	target.stop()
+	<-done
+}
+
+func TestRetryBackoff(t *testing.T) {
+	require.Equal(t, time.Second, retryBackoff(time.Second, 0))
+	require.Equal(t, 8*time.Second, retryBackoff(time.Second, 3))
+	require.Equal(t, maxRetryBackoff, retryBackoff(time.Second, 5))
+	require.Equal(t, maxRetryBackoff, retryBackoff(time.Second, 64))
+
+	for i := 0; i < 100; i++ {
+		actual := jitter(time.Second)
+		require.True(t, actual >= 500*time.Millisecond && actual <= time.Second, "%v", actual)
+	}
+	require.Equal(t, time.Duration(0), jitter(0))
+}
+
+func TestIsRetriable(t *testing.T) {
+	require.True(t, isRetriable(&sarama.ConsumerError{Err: sarama.ErrNotLeaderForPartition}))
+	require.True(t, isRetriable(sarama.ErrLeaderNotAvailable))
+	require.True(t, isRetriable(errMessagesClosed))
+	require.True(t, isRetriable(&net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}))
+	require.False(t, isRetriable(&sarama.ConsumerError{Err: sarama.ErrOffsetOutOfRange}))
+	require.False(t, isRetriable(sarama.ErrUnknownTopicOrPartition))
+}
+
 type tConsumePartition struct {
 	topic     string
 	partition int32
@@ -477,6 +825,9 @@ func (pc tPartitionConsumer) Messages() <-chan *sarama.ConsumerMessage {
 func (pc tPartitionConsumer) Errors() <-chan *sarama.ConsumerError {
 	return pc.errors
 }
+func (pc tPartitionConsumer) Pause()         {}
+func (pc tPartitionConsumer) Resume()        {}
+func (pc tPartitionConsumer) IsPaused() bool { return false }
 
 type tConsumer struct {
 	topics              []string
@@ -511,6 +862,11 @@ func (c tConsumer) HighWaterMarks() map[string]map[int32]int64 {
 	return nil
 }
 
+func (c tConsumer) Pause(map[string][]int32)  {}
+func (c tConsumer) Resume(map[string][]int32) {}
+func (c tConsumer) PauseAll()                 {}
+func (c tConsumer) ResumeAll()                {}
+
 func TestConsumeParseArgs(t *testing.T) {
 	topic := "test-topic"
 	givenBroker := "hans:9092"
@@ -551,3 +907,893 @@ func TestConsumeParseArgs(t *testing.T) {
 		return
 	}
 }
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	data := []struct {
+		input       string
+		expected    time.Time
+		expectedErr bool
+	}{
+		{
+			input:    "",
+			expected: time.Time{},
+		},
+		{
+			input:    "2017-06-01T10:30:00Z",
+			expected: time.Date(2017, 6, 1, 10, 30, 0, 0, time.UTC),
+		},
+		{
+			input:    "90m",
+			expected: time.Date(2017, 6, 1, 10, 30, 0, 0, time.UTC),
+		},
+		{
+			input:    "1496313000000",
+			expected: time.Date(2017, 6, 1, 10, 30, 0, 0, time.UTC),
+		},
+		{
+			input:       "yesterday",
+			expectedErr: true,
+		},
+	}
+
+	for _, d := range data {
+		actual, err := parseTime(d.input, now)
+		if d.expectedErr != (err != nil) || !actual.Equal(d.expected) {
+			t.Errorf(
+				`
+Expected: %v, err=%v
+Actual:   %v, err=%v
+Input:    %v
+`,
+				d.expected,
+				d.expectedErr,
+				actual,
+				err,
+				d.input,
+			)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	data := []struct {
+		filterKey   string
+		filterValue string
+		minSize     int
+		maxSize     int
+		key         []byte
+		value       []byte
+		expected    bool
+	}{
+		{
+			key:      []byte("a"),
+			value:    []byte("b"),
+			expected: true,
+		},
+		{
+			filterKey: "^user-",
+			key:       []byte("user-23"),
+			value:     []byte("b"),
+			expected:  true,
+		},
+		{
+			filterKey: "^user-",
+			key:       []byte("admin-23"),
+			value:     []byte("b"),
+			expected:  false,
+		},
+		{
+			filterKey: "^user-",
+			key:       nil,
+			value:     []byte("b"),
+			expected:  false,
+		},
+		{
+			filterKey:   "^user-",
+			filterValue: "error",
+			key:         []byte("user-23"),
+			value:       []byte("an error occurred"),
+			expected:    true,
+		},
+		{
+			filterKey:   "^user-",
+			filterValue: "error",
+			key:         []byte("user-23"),
+			value:       []byte("all good"),
+			expected:    false,
+		},
+		{
+			minSize:  3,
+			key:      []byte("a"),
+			value:    []byte("bc"),
+			expected: true,
+		},
+		{
+			minSize:  4,
+			key:      []byte("a"),
+			value:    []byte("bc"),
+			expected: false,
+		},
+		{
+			maxSize:  2,
+			key:      []byte("a"),
+			value:    []byte("bc"),
+			expected: false,
+		},
+		{
+			maxSize:  3,
+			value:    []byte("abc"),
+			expected: true,
+		},
+	}
+
+	for _, d := range data {
+		target := &consumeCmd{minSize: d.minSize, maxSize: d.maxSize}
+		if d.filterKey != "" {
+			target.filterKey = regexp.MustCompile(d.filterKey)
+		}
+		if d.filterValue != "" {
+			target.filterValue = regexp.MustCompile(d.filterValue)
+		}
+
+		actual := target.matches(&sarama.ConsumerMessage{Key: d.key, Value: d.value})
+		if actual != d.expected {
+			t.Errorf("expected %v but found %v for filters %#v %#v and key %#v value %#v", d.expected, actual, d.filterKey, d.filterValue, string(d.key), string(d.value))
+		}
+	}
+}
+
+func TestConsumeParseArgsFetch(t *testing.T) {
+	os.Setenv("KT_BROKERS", "")
+	target := &consumeCmd{}
+	target.parseArgs([]string{"-topic", "hans"})
+	require.Equal(t, int32(1), target.config.Consumer.Fetch.Min)
+	require.Equal(t, int32(0), target.config.Consumer.Fetch.Max)
+	require.Equal(t, int32(1024*1024), target.config.Consumer.Fetch.Default)
+	require.Equal(t, 500*time.Millisecond, target.config.Consumer.MaxWaitTime)
+
+	target = &consumeCmd{}
+	target.parseArgs([]string{"-topic", "hans", "-fetch-min-bytes", "1024", "-fetch-max-bytes", "4096", "-max-wait", "10ms"})
+	require.Equal(t, int32(1024), target.config.Consumer.Fetch.Min)
+	require.Equal(t, int32(4096), target.config.Consumer.Fetch.Max)
+	require.Equal(t, int32(4096), target.config.Consumer.Fetch.Default)
+	require.Equal(t, 10*time.Millisecond, target.config.Consumer.MaxWaitTime)
+	require.NoError(t, target.config.Validate())
+}
+
+func TestFiniteOffsets(t *testing.T) {
+	following, err := parseOffsets("")
+	require.NoError(t, err)
+	require.False(t, finiteOffsets(following))
+
+	data := map[string]bool{
+		"all=oldest:newest": true,
+		"0=1:5,1=2:":        false,
+		"0=1:5,1=newest-1:": false,
+		"0=1:5,1=oldest:+3": true,
+	}
+	for str, expected := range data {
+		offsets, err := parseOffsets(str)
+		require.NoError(t, err)
+		require.Equal(t, expected, finiteOffsets(offsets), str)
+	}
+
+	os.Setenv("KT_BROKERS", "")
+	target := &consumeCmd{}
+	target.parseArgs([]string{"-topic", "hans", "-no-follow", "-concurrency", "2"})
+	require.Equal(t, 2, target.concurrency)
+}
+
+func TestConsumeParseArgsRegistryDecode(t *testing.T) {
+	os.Setenv("KT_BROKERS", "")
+	target := &consumeCmd{}
+	target.parseArgs([]string{"-topic", "hans", "-registry", "http://localhost:8081"})
+	require.NotNil(t, target.decodeKey)
+	require.NotNil(t, target.decodeValue)
+
+	target = &consumeCmd{}
+	target.parseArgs([]string{"-topic", "hans", "-registry", "http://localhost:8081", "-registry-decode", "key", "-value-codec", "msgpack"})
+	require.NotNil(t, target.decodeKey)
+	require.NotNil(t, target.decodeValue)
+
+	target = &consumeCmd{}
+	target.parseArgs([]string{"-topic", "hans", "-registry", "http://localhost:8081", "-registry-decode", "value"})
+	require.Nil(t, target.decodeKey)
+	require.NotNil(t, target.decodeValue)
+}
+
+func TestConsumeParseArgsBufferSize(t *testing.T) {
+	os.Setenv("KT_BROKERS", "")
+	target := &consumeCmd{}
+	target.parseArgs([]string{"-topic", "hans"})
+	require.Equal(t, 256, target.config.ChannelBufferSize)
+
+	target = &consumeCmd{}
+	target.parseArgs([]string{"-topic", "hans", "-buffer-size", "16"})
+	require.Equal(t, 16, target.config.ChannelBufferSize)
+}
+
+func TestMatchesHeaders(t *testing.T) {
+	os.Setenv("KT_BROKERS", "")
+	target := &consumeCmd{}
+	target.parseArgs([]string{"-topic", "hans", "-filter-header", "event-type=^order", "-filter-header", "trace-id"})
+	require.Len(t, target.filterHeaders, 2)
+
+	header := func(k, v string) *sarama.RecordHeader { return &sarama.RecordHeader{Key: []byte(k), Value: []byte(v)} }
+	data := []struct {
+		headers  []*sarama.RecordHeader
+		expected bool
+	}{
+		{headers: []*sarama.RecordHeader{header("event-type", "order-created"), header("trace-id", "")}, expected: true},
+		{headers: []*sarama.RecordHeader{header("event-type", "order-created")}, expected: false},
+		{headers: []*sarama.RecordHeader{header("event-type", "payment"), header("trace-id", "1")}, expected: false},
+		{headers: nil, expected: false},
+	}
+
+	for _, d := range data {
+		require.Equal(t, d.expected, target.matches(&sarama.ConsumerMessage{Headers: d.headers}), "headers %v", d.headers)
+	}
+}
+
+func TestEmitCount(t *testing.T) {
+	target := &consumeCmd{count: 2, quit: make(chan struct{})}
+	out := make(chan printContext)
+	printed := make(chan consumedMessage, 3)
+	go func() {
+		for ctx := range out {
+			printed <- ctx.output.(consumedMessage)
+			close(ctx.done)
+		}
+	}()
+	defer close(out)
+
+	for i := int64(0); i < 3; i++ {
+		require.Equal(t, i < 2, target.emit(out, &sarama.ConsumerMessage{Topic: "hans", Offset: i}, 3), "offset %v", i)
+	}
+
+	select {
+	case <-target.quit:
+	default:
+		t.Errorf("expected consumption to be stopped after %v messages", target.count)
+	}
+
+	require.Len(t, printed, 2)
+	require.Equal(t, int64(0), (<-printed).Offset)
+	require.Equal(t, int64(1), (<-printed).Offset)
+}
+
+func TestSampled(t *testing.T) {
+	target := &consumeCmd{sample: 3}
+	actual := []bool{}
+	for i := 0; i < 7; i++ {
+		actual = append(actual, target.sampled())
+	}
+	require.Equal(t, []bool{true, false, false, true, false, false, true}, actual)
+
+	target = &consumeCmd{}
+	require.True(t, target.sampled())
+
+	target = &consumeCmd{sample: 0.5}
+	n := 0
+	for i := 0; i < 1000; i++ {
+		if target.sampled() {
+			n++
+		}
+	}
+	require.InDelta(t, 500, n, 100)
+}
+
+func TestEmitLag(t *testing.T) {
+	target := &consumeCmd{lag: true, quit: make(chan struct{})}
+	out := make(chan printContext)
+	printed := make(chan consumedMessage, 1)
+	go func() {
+		ctx := <-out
+		printed <- ctx.output.(consumedMessage)
+		close(ctx.done)
+	}()
+
+	target.emit(out, &sarama.ConsumerMessage{Topic: "hans", Offset: 23}, 30)
+	actual := <-printed
+	require.NotNil(t, actual.Lag)
+	require.Equal(t, int64(6), *actual.Lag)
+}
+
+type tOffsetClient struct {
+	sarama.Client
+	calls  int
+	oldest int64
+}
+
+func (c *tOffsetClient) GetOffset(topic string, partition int32, time int64) (int64, error) {
+	c.calls++
+	return c.oldest, nil
+}
+
+type tNewestClient struct {
+	sarama.Client
+}
+
+func (c tNewestClient) GetOffset(topic string, partition int32, time int64) (int64, error) {
+	if partition == 2 {
+		return 0, fmt.Errorf("unavailable")
+	}
+	return 10 + int64(partition), nil
+}
+
+type tTailClient struct {
+	sarama.Client
+	oldest, newest int64
+	err            error
+}
+
+func (c tTailClient) GetOffset(topic string, partition int32, time int64) (int64, error) {
+	if time == sarama.OffsetOldest {
+		return c.oldest, c.err
+	}
+	return c.newest, c.err
+}
+
+func TestResolveTail(t *testing.T) {
+	data := []struct {
+		testName string
+		client   tTailClient
+		tail     int64
+		expected int64
+		err      error
+	}{
+		{
+			testName: "within-partition",
+			client:   tTailClient{oldest: 10, newest: 100},
+			tail:     5,
+			expected: 95,
+		},
+		{
+			testName: "whole-partition",
+			client:   tTailClient{oldest: 10, newest: 100},
+			tail:     90,
+			expected: 10,
+		},
+		{
+			testName: "negative-start-past-oldest",
+			client:   tTailClient{oldest: 0, newest: 3},
+			tail:     5,
+			expected: 0,
+		},
+		{
+			testName: "start-before-oldest",
+			client:   tTailClient{oldest: 50, newest: 60},
+			tail:     20,
+			expected: 50,
+		},
+		{
+			testName: "empty-partition",
+			client:   tTailClient{oldest: 42, newest: 42},
+			tail:     5,
+			expected: 42,
+		},
+		{
+			testName: "tail-larger-than-partition",
+			client:   tTailClient{oldest: 0, newest: 10},
+			tail:     1 << 40,
+			expected: 0,
+		},
+		{
+			testName: "offset-error",
+			client:   tTailClient{err: fmt.Errorf("unavailable")},
+			tail:     5,
+			err:      fmt.Errorf("unavailable"),
+		},
+	}
+
+	for _, d := range data {
+		t.Run(d.testName, func(t *testing.T) {
+			target := &consumeCmd{client: d.client, tail: d.tail}
+			actual, err := target.resolveTail("hans", 0)
+			if d.err != nil {
+				require.EqualError(t, err, d.err.Error())
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, d.expected, actual)
+		})
+	}
+}
+
+func TestNewestOffsets(t *testing.T) {
+	target := &consumeCmd{client: tNewestClient{}}
+	actual := target.newestOffsets(map[string][]int32{"hans": {0, 1, 2}, "gretel": {0}})
+	require.Equal(t, map[string]map[int32]int64{"hans": {0: 10, 1: 11}, "gretel": {0: 10}}, actual)
+
+	os.Setenv("KT_BROKERS", "")
+	target = &consumeCmd{}
+	target.parseArgs([]string{"-topic", "hans", "-until-end"})
+	require.True(t, target.noFollow)
+}
+
+func TestEmitWatermarks(t *testing.T) {
+	client := &tOffsetClient{oldest: 5}
+	target := &consumeCmd{watermarks: true, client: client, quit: make(chan struct{})}
+	out := make(chan printContext)
+	printed := make(chan consumedMessage, 2)
+	go func() {
+		for ctx := range out {
+			printed <- ctx.output.(consumedMessage)
+			close(ctx.done)
+		}
+	}()
+	defer close(out)
+
+	target.emit(out, &sarama.ConsumerMessage{Topic: "hans", Offset: 23}, 30)
+	client.oldest = 7
+	target.emit(out, &sarama.ConsumerMessage{Topic: "hans", Offset: 24}, 31)
+
+	require.Equal(t, &watermarks{Oldest: 5, Newest: 30}, (<-printed).Watermarks)
+	require.Equal(t, &watermarks{Oldest: 5, Newest: 31}, (<-printed).Watermarks)
+	require.Equal(t, 1, client.calls)
+}
+
+func TestWatchIdle(t *testing.T) {
+	target := &consumeCmd{quit: make(chan struct{}), activity: make(chan struct{}, 1)}
+	timers := make(chan chan time.Time)
+	after := func(d time.Duration) <-chan time.Time {
+		require.Equal(t, 50*time.Millisecond, d)
+		c := make(chan time.Time, 1)
+		timers <- c
+		return c
+	}
+	done := make(chan struct{})
+	go func() { target.watchIdle(50*time.Millisecond, after); close(done) }()
+
+	// every activity starts a new timer before the previous one expired.
+	for i := 0; i < 4; i++ {
+		<-timers
+		target.notifyActivity()
+	}
+	select {
+	case <-target.quit:
+		t.Fatalf("stopped consuming despite activity")
+	default:
+	}
+
+	(<-timers) <- time.Now()
+	<-done
+	select {
+	case <-target.quit:
+	default:
+		t.Errorf("did not stop consuming after being idle")
+	}
+}
+
+func TestWriteRaw(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kt-raw-out")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	target := &consumeCmd{rawOut: dir}
+	value := []byte{0x00, 0xff, 0x0a, 0x42}
+	target.writeRaw(&sarama.ConsumerMessage{Topic: "hans", Partition: 1, Offset: 23, Value: value})
+
+	actual, err := ioutil.ReadFile(filepath.Join(dir, "hans-1-23"))
+	require.NoError(t, err)
+	require.Equal(t, value, actual)
+}
+
+func consumedMessageOf(t *testing.T, cmd *consumeCmd, msg *sarama.ConsumerMessage) consumedMessage {
+	m, err := cmd.newConsumedMessage(msg)
+	require.NoError(t, err)
+	return m
+}
+
+func TestSkipUndecodable(t *testing.T) {
+	target := &consumeCmd{
+		skipUndecodable: true,
+		encodeKey:       "string",
+		encodeValue:     "string",
+		decodeValue: func(data []byte) (json.RawMessage, error) {
+			if string(data) == "bad" {
+				return nil, fmt.Errorf("invalid")
+			}
+			return json.RawMessage(data), nil
+		},
+	}
+	out := make(chan printContext)
+	printed := make(chan consumedMessage, 3)
+	go func() {
+		for ctx := range out {
+			printed <- ctx.output.(consumedMessage)
+			close(ctx.done)
+		}
+	}()
+	defer close(out)
+
+	for i, v := range []string{"1", "bad", "2"} {
+		target.emit(out, &sarama.ConsumerMessage{Offset: int64(i), Value: []byte(v)}, 0)
+	}
+
+	require.Equal(t, int64(1), target.undecodable)
+	require.Len(t, printed, 2)
+	require.Equal(t, int64(0), (<-printed).Offset)
+	require.Equal(t, int64(2), (<-printed).Offset)
+}
+
+func TestConsumeOutputTemplate(t *testing.T) {
+	tmpl, err := template.New("test").Parse(`{{.Partition}} {{.Offset}} {{.Key}} {{.Value}} {{index .Headers "h"}} {{.Timestamp.Unix}}`)
+	require.NoError(t, err)
+
+	target := &consumeCmd{template: tmpl, encodeKey: "string", encodeValue: "string"}
+	msg := &sarama.ConsumerMessage{
+		Topic:     "hans",
+		Partition: 1,
+		Offset:    23,
+		Key:       []byte("k"),
+		Value:     []byte("v"),
+		Timestamp: time.Unix(1500000000, 0),
+		Headers:   []*sarama.RecordHeader{{Key: []byte("h"), Value: []byte("x")}},
+	}
+	require.Equal(t, rawOutput("1 23 k v x 1500000000"), target.output(consumedMessageOf(t, target, msg)))
+
+	target.decodeValue = func(data []byte) (json.RawMessage, error) { return json.RawMessage(`{"a":1}`), nil }
+	tmpl, err = template.New("test").Parse(`{{.Value}}`)
+	require.NoError(t, err)
+	target.template = tmpl
+	require.Equal(t, rawOutput(`{"a":1}`), target.output(consumedMessageOf(t, target, msg)))
+}
+
+func TestConsumeOutputCSV(t *testing.T) {
+	target := &consumeCmd{csvColumns: []string{"topic", "partition", "offset", "timestamp", "key", "value"}, encodeKey: "string", encodeValue: "string"}
+	msg := &sarama.ConsumerMessage{
+		Topic:     "hans",
+		Partition: 1,
+		Offset:    23,
+		Value:     []byte("a,\"b\""),
+		Timestamp: time.Unix(1500000000, 0).UTC(),
+	}
+	require.Equal(t, rawOutput(`hans,1,23,2017-07-14T02:40:00Z,,"a,""b"""`), target.output(consumedMessageOf(t, target, msg)))
+
+	target.csvColumns = []string{"value", "key"}
+	msg = &sarama.ConsumerMessage{Key: []byte("k")}
+	require.Equal(t, rawOutput(`,k`), target.output(consumedMessageOf(t, target, msg)))
+}
+
+func TestConsumeOutputRestProxy(t *testing.T) {
+	os.Setenv("KT_BROKERS", "")
+	target := &consumeCmd{}
+	target.parseArgs([]string{"-topic", "hans", "-output", "rest-proxy"})
+	require.True(t, target.restProxy)
+
+	msg := &sarama.ConsumerMessage{Topic: "hans", Partition: 1, Offset: 100, Key: []byte("key"), Value: []byte("value"), Timestamp: time.Unix(1500000000, 0)}
+	buf, err := json.Marshal(target.output(consumedMessageOf(t, target, msg)))
+	require.NoError(t, err)
+	require.Equal(t, `{"topic":"hans","key":"a2V5","value":"dmFsdWU=","partition":1,"offset":100}`, string(buf))
+
+	buf, err = json.Marshal(target.output(consumedMessageOf(t, target, &sarama.ConsumerMessage{Topic: "hans"})))
+	require.NoError(t, err)
+	require.Equal(t, `{"topic":"hans","key":null,"value":null,"partition":0,"offset":0}`, string(buf))
+}
+
+func TestWriteOut(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kt-out-prefix")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	target := &consumeCmd{outPrefix: filepath.Join(dir, "hans"), encodeKey: "string", encodeValue: "string"}
+	target.writeOut(consumedMessageOf(t, target, &sarama.ConsumerMessage{Topic: "hans", Partition: 0, Offset: 1, Value: []byte("a")}))
+	target.writeOut(consumedMessageOf(t, target, &sarama.ConsumerMessage{Topic: "hans", Partition: 1, Offset: 1, Value: []byte("b")}))
+	target.writeOut(consumedMessageOf(t, target, &sarama.ConsumerMessage{Topic: "hans", Partition: 0, Offset: 2, Value: []byte("c")}))
+	target.closeOutFiles()
+
+	actual, err := ioutil.ReadFile(filepath.Join(dir, "hans.0.jsonl"))
+	require.NoError(t, err)
+	require.Equal(t, `{"topic":"hans","partition":0,"offset":1,"key":null,"value":"a"}
+{"topic":"hans","partition":0,"offset":2,"key":null,"value":"c"}
+`, string(actual))
+
+	actual, err = ioutil.ReadFile(filepath.Join(dir, "hans.1.jsonl"))
+	require.NoError(t, err)
+	require.Equal(t, `{"topic":"hans","partition":1,"offset":1,"key":null,"value":"b"}
+`, string(actual))
+
+	target.multiTopic = true
+	require.Equal(t, filepath.Join(dir, "hans.hans.1.jsonl"), target.outFileName("hans", 1))
+}
+
+func TestWriteOutGzip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kt-out-compress")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, v := range []string{"a", "b"} {
+		target := &consumeCmd{outPrefix: filepath.Join(dir, "hans"), outGzip: true, encodeKey: "string", encodeValue: "string"}
+		target.writeOut(consumedMessageOf(t, target, &sarama.ConsumerMessage{Topic: "hans", Value: []byte(v)}))
+		target.closeOutFiles()
+	}
+
+	f, err := os.Open(filepath.Join(dir, "hans.0.jsonl.gz"))
+	require.NoError(t, err)
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	actual, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, `{"topic":"hans","partition":0,"offset":0,"key":null,"value":"a"}
+{"topic":"hans","partition":0,"offset":0,"key":null,"value":"b"}
+`, string(actual))
+}
+
+func TestSaveCheckpointFlushesOutFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kt-out-flush")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	target := &consumeCmd{outPrefix: filepath.Join(dir, "hans"), outGzip: true, checkpoint: filepath.Join(dir, "cp.json"), encodeKey: "string", encodeValue: "string"}
+	msg := &sarama.ConsumerMessage{Topic: "hans", Value: []byte("a")}
+	target.writeOut(consumedMessageOf(t, target, msg))
+	target.received.record(msg)
+	target.saveCheckpoint()
+	defer target.closeOutFiles()
+
+	f, err := os.Open(filepath.Join(dir, "hans.0.jsonl.gz"))
+	require.NoError(t, err)
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	line, err := bufio.NewReader(r).ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, `{"topic":"hans","partition":0,"offset":0,"key":null,"value":"a"}`+"\n", line)
+}
+
+func TestConsumeValueCharset(t *testing.T) {
+	enc, err := findCharset("latin1")
+	require.NoError(t, err)
+	target := &consumeCmd{valueCharset: enc, encodeKey: "string", encodeValue: "string"}
+	actual := consumedMessageOf(t, target, &sarama.ConsumerMessage{Value: []byte{'c', 0xe9}})
+	require.Equal(t, "c\u00e9", *actual.Value.(*string))
+	require.Equal(t, "", actual.ValueEncoding)
+}
+
+func TestConsumeExec(t *testing.T) {
+	target := &consumeCmd{exec: "tr a-z A-Z", encodeKey: "string", encodeValue: "string"}
+	actual := consumedMessageOf(t, target, &sarama.ConsumerMessage{Value: []byte("hans\n")})
+	require.Equal(t, "HANS", *actual.Value.(*string))
+
+	actual = consumedMessageOf(t, target, &sarama.ConsumerMessage{})
+	require.Nil(t, actual.Value)
+
+	_, err := execValue("echo oops >&2; exit 3", []byte("hans"))
+	require.EqualError(t, err, "exit status 3 oops")
+}
+
+func TestConsumeParseArgsGroupCommits(t *testing.T) {
+	os.Setenv("KT_BROKERS", "")
+	target := &consumeCmd{}
+	target.parseArgs([]string{"-topic", "hans", "-group", "specials"})
+	require.True(t, target.config.Consumer.Offsets.AutoCommit.Enable)
+	require.Equal(t, time.Second, target.config.Consumer.Offsets.AutoCommit.Interval)
+	require.Equal(t, sarama.OffsetOldest, target.config.Consumer.Offsets.Initial)
+	require.True(t, target.commitOnExit)
+
+	target = &consumeCmd{}
+	target.parseArgs([]string{"-topic", "hans", "-group", "specials", "-commit-interval", "0", "-commit-on-exit=false", "-offset-reset", "newest"})
+	require.False(t, target.config.Consumer.Offsets.AutoCommit.Enable)
+	require.Equal(t, sarama.OffsetNewest, target.config.Consumer.Offsets.Initial)
+	require.False(t, target.commitOnExit)
+}
+
+type tGroupSession struct {
+	sarama.ConsumerGroupSession
+	commits int
+}
+
+func (s *tGroupSession) Commit() { s.commits++ }
+
+func TestGroupHandlerCleanup(t *testing.T) {
+	session := &tGroupSession{}
+	handler := &groupHandler{cmd: &consumeCmd{commitOnExit: true, quit: make(chan struct{})}}
+	require.NoError(t, handler.Cleanup(session))
+	require.Zero(t, session.commits, "commits on rebalance")
+
+	handler.cmd.stop()
+	require.NoError(t, handler.Cleanup(session))
+	require.Equal(t, 1, session.commits)
+
+	handler.cmd.commitOnExit = false
+	require.NoError(t, handler.Cleanup(session))
+	require.Equal(t, 1, session.commits)
+}
+
+func TestConsumeParseArgsInstanceID(t *testing.T) {
+	os.Setenv("KT_BROKERS", "")
+	target := &consumeCmd{}
+	target.parseArgs([]string{"-topic", "hans", "-group", "specials", "-instance-id", "kt-debug", "-version", "v2.3.0"})
+	require.Equal(t, "kt-debug", target.config.Consumer.Group.InstanceId)
+	target.checkVersion()
+	require.NoError(t, target.config.Validate())
+}
+
+func TestParseBalanceStrategies(t *testing.T) {
+	data := []struct {
+		str      string
+		expected []string
+		err      string
+	}{
+		{str: "range", expected: []string{"range"}},
+		{str: "sticky, roundrobin,range", expected: []string{"sticky", "roundrobin", "range"}},
+		{str: "cooperative-sticky", err: "rebalance-strategy cooperative-sticky is not supported, only eager rebalancing with range, roundrobin and sticky is."},
+		{str: "hans", err: `unsupported rebalance-strategy "hans", only range, roundrobin and sticky are supported.`},
+	}
+
+	for _, d := range data {
+		actual, err := parseBalanceStrategies(d.str)
+		if d.err != "" {
+			require.EqualError(t, err, d.err, d.str)
+			continue
+		}
+		require.NoError(t, err, d.str)
+		var names []string
+		for _, s := range actual {
+			names = append(names, s.Name())
+		}
+		require.Equal(t, d.expected, names, d.str)
+	}
+}
+
+func TestOffsetGap(t *testing.T) {
+	data := []struct {
+		next     int64
+		offset   int64
+		expected string
+	}{
+		{next: 3, offset: 3, expected: ""},
+		{next: sarama.OffsetOldest, offset: 3, expected: ""},
+		{next: 3, offset: 4, expected: "topic hans partition 1 has no message at offset 3, e.g. a transaction marker, an aborted transactional or a compacted message"},
+		{next: 3, offset: 7, expected: "topic hans partition 1 has no messages at offsets 3 to 6, e.g. transaction markers, aborted transactional or compacted messages"},
+	}
+
+	for _, d := range data {
+		require.Equal(t, d.expected, offsetGap("hans", 1, d.next, d.offset), "next %v offset %v", d.next, d.offset)
+	}
+}
+
+func TestConsumeParseArgsIsolation(t *testing.T) {
+	os.Setenv("KT_BROKERS", "")
+	target := &consumeCmd{}
+	target.parseArgs([]string{"-topic", "hans"})
+	require.Equal(t, sarama.ReadUncommitted, target.config.Consumer.IsolationLevel)
+
+	target = &consumeCmd{}
+	target.parseArgs([]string{"-topic", "hans", "-isolation", "read_committed"})
+	require.Equal(t, sarama.ReadCommitted, target.config.Consumer.IsolationLevel)
+}
+
+func TestConsumeParseArgsClientRack(t *testing.T) {
+	os.Setenv("KT_BROKERS", "")
+	target := &consumeCmd{}
+	target.parseArgs([]string{"-topic", "hans", "-client-rack", "eu-west-1a"})
+	require.Equal(t, "eu-west-1a", target.config.RackID)
+}
+
+func TestConsumedMessageTimestamp(t *testing.T) {
+	msg := &sarama.ConsumerMessage{Topic: "hans", Timestamp: time.Unix(1500000000, 123000000).UTC()}
+
+	target := &consumeCmd{timestampTypes: map[string]string{"hans": "LogAppendTime"}}
+	buf, err := json.Marshal(consumedMessageOf(t, target, msg))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"topic":"hans","partition":0,"offset":0,"key":null,"value":null,"timestamp":"2017-07-14T02:40:00.123Z","timestampType":"LogAppendTime"}`, string(buf))
+
+	target = &consumeCmd{epochMillis: true}
+	buf, err = json.Marshal(consumedMessageOf(t, target, msg))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"topic":"hans","partition":0,"offset":0,"key":null,"value":null,"timestamp":1500000000123}`, string(buf))
+}
+
+func TestConsumeOutputPrint(t *testing.T) {
+	msg := &sarama.ConsumerMessage{Key: []byte("k"), Value: []byte("v")}
+
+	target := &consumeCmd{printField: "key", encodeKey: "string", encodeValue: "string"}
+	require.Equal(t, rawOutput("k"), target.output(consumedMessageOf(t, target, msg)))
+
+	target = &consumeCmd{printField: "value", encodeKey: "string", encodeValue: "hex"}
+	require.Equal(t, rawOutput("76"), target.output(consumedMessageOf(t, target, msg)))
+
+	target = &consumeCmd{printField: "key", encodeKey: "string", encodeValue: "string"}
+	require.Equal(t, rawOutput(""), target.output(consumedMessageOf(t, target, &sarama.ConsumerMessage{})))
+}
+
+func TestConsumedMessageInvalidUTF8(t *testing.T) {
+	target := &consumeCmd{encodeKey: "string", encodeValue: "string"}
+	buf, err := json.Marshal(consumedMessageOf(t, target, &sarama.ConsumerMessage{Key: []byte("k"), Value: []byte{0xff}}))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"topic":"","partition":0,"offset":0,"key":"k","value":"/w==","valueEncoding":"base64"}`, string(buf))
+
+	target = &consumeCmd{encodeKey: "hex", encodeValue: "string"}
+	buf, err = json.Marshal(consumedMessageOf(t, target, &sarama.ConsumerMessage{Key: []byte{0xff}, Value: []byte("v")}))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"topic":"","partition":0,"offset":0,"key":"ff","keyEncoding":"hex","value":"v"}`, string(buf))
+}
+
+func TestConsumedMessageDecodeKey(t *testing.T) {
+	decode := func(data []byte) (json.RawMessage, error) {
+		if data[0] != 0 {
+			return nil, errNotRegistryEncoded
+		}
+		return json.RawMessage(`{"id":1}`), nil
+	}
+	target := &consumeCmd{encodeKey: "string", encodeValue: "string", decodeKey: decode, decodeValue: decode}
+
+	buf, err := json.Marshal(consumedMessageOf(t, target, &sarama.ConsumerMessage{Key: []byte{0, 1}, Value: []byte("v")}))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"topic":"","partition":0,"offset":0,"key":{"id":1},"value":"v"}`, string(buf))
+}
+
+func TestConsumedMessageSchemaInfo(t *testing.T) {
+	decode := func(data []byte) (json.RawMessage, error) {
+		if data[0] != 0 {
+			return nil, errNotRegistryEncoded
+		}
+		return json.RawMessage(`{"id":1}`), nil
+	}
+	registry := newSchemaRegistry("http://localhost:8081")
+	registry.infos[7] = []schemaInfo{{Subject: "hans-value", Version: 3}}
+	target := &consumeCmd{encodeKey: "string", encodeValue: "string", decodeKey: decode, decodeValue: decode, registry: registry, schemaInfo: true}
+
+	buf, err := json.Marshal(consumedMessageOf(t, target, &sarama.ConsumerMessage{Topic: "hans", Key: []byte("k"), Value: registryEncoded(7)}))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"topic":"hans","partition":0,"offset":0,"key":"k","value":{"id":1},"valueSchema":{"id":7,"subject":"hans-value","version":3}}`, string(buf))
+}
+
+func TestConsumeParseArgsEncodings(t *testing.T) {
+	os.Setenv("KT_BROKERS", "")
+	target := &consumeCmd{}
+	target.parseArgs([]string{"-topic", "hans", "-key-encoding", "hex", "-value-encoding", "base64"})
+	require.Equal(t, "hex", target.encodeKey)
+	require.Equal(t, "base64", target.encodeValue)
+
+	target = &consumeCmd{}
+	target.parseArgs([]string{"-topic", "hans", "-encodekey", "base64", "-encodevalue", "hex"})
+	require.Equal(t, "base64", target.encodeKey)
+	require.Equal(t, "hex", target.encodeValue)
+}
+
+func TestReadOffsetsFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "kt-offsets")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`{"all": {"start": "oldest"}, "0": {"start": 10, "end": 20}, "2": {"start": "newest-5"}}`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	actual, err := readOffsetsFile(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, "0=10:20,2=newest-5:,all=oldest:", actual)
+
+	offsets, err := parseOffsets(actual)
+	require.NoError(t, err)
+	require.Equal(t, interval{start: offset{start: 10}, end: offset{start: 20}}, offsets[0])
+	require.Equal(t, offset{relative: true, start: sarama.OffsetNewest, diff: -5}, offsets[2].start)
+	require.Equal(t, offset{relative: true, start: sarama.OffsetOldest}, offsets[-1].start)
+
+	require.NoError(t, ioutil.WriteFile(f.Name(), []byte(`{"one": {"start": 1}}`), 0644))
+	_, err = readOffsetsFile(f.Name())
+	require.Error(t, err)
+}
+
+func TestOffsetsFilePath(t *testing.T) {
+	data := []struct {
+		str      string
+		path     string
+		expected bool
+	}{
+		{str: "", path: "", expected: false},
+		{str: "0=10:20,all=newest-5%", path: "0=10:20,all=newest-5%", expected: false},
+		{str: "offsets.json", path: "offsets.json", expected: true},
+		{str: "dir/offs", path: "dir/offs", expected: true},
+		{str: "@offs", path: "offs", expected: true},
+	}
+	for _, d := range data {
+		path, ok := offsetsFilePath(d.str)
+		require.Equal(t, d.expected, ok, d.str)
+		require.Equal(t, d.path, path, d.str)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/Shopify/sarama"
+)
+
+// copiedMessage returns msg as JSON message for produce, with base64 encoded
+// key and value so that binary data is copied as is. With partition, the
+// message keeps its partition.
+func copiedMessage(msg *sarama.ConsumerMessage, partition bool) (string, error) {
+	m := message{Timestamp: &messageTimestamp{Time: msg.Timestamp}}
+	if msg.Key != nil {
+		key := base64.StdEncoding.EncodeToString(msg.Key)
+		m.Key, m.KeyEncoding = &key, "base64"
+	}
+	if msg.Value != nil {
+		value := base64.StdEncoding.EncodeToString(msg.Value)
+		m.Value, m.ValueEncoding = &value, "base64"
+	}
+	if len(msg.Headers) > 0 {
+		m.Headers = make(map[string]string, len(msg.Headers))
+		for _, h := range msg.Headers {
+			m.Headers[string(h.Key)] = string(h.Value)
+		}
+	}
+	if partition {
+		m.Partition = &msg.Partition
+	}
+
+	buf, err := json.Marshal(m)
+	return string(buf), err
+}
+
+// readTopic sends the messages that topic contains when reading starts to out,
+// see copiedMessage, and closes out once all partitions are read or quit is
+// closed. Partitions are read at the same time, so that only the order of
+// messages within a partition is kept.
+func readTopic(client sarama.Client, topic string, partition bool, quit <-chan struct{}, out chan string) error {
+	defer close(out)
+
+	partitions, err := client.Partitions(topic)
+	if err != nil {
+		return fmt.Errorf("failed to read partitions of topic %v err=%v", topic, err)
+	}
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return fmt.Errorf("failed to create consumer err=%v", err)
+	}
+	defer consumer.Close()
+
+	type partitionRange struct {
+		pc     sarama.PartitionConsumer
+		newest int64
+	}
+	var ranges []partitionRange
+	defer func() {
+		for _, r := range ranges {
+			r.pc.Close()
+		}
+	}()
+	for _, p := range partitions {
+		oldest, err := client.GetOffset(topic, p, sarama.OffsetOldest)
+		if err != nil {
+			return fmt.Errorf("failed to read oldest offset of topic %v partition %v err=%v", topic, p, err)
+		}
+		newest, err := client.GetOffset(topic, p, sarama.OffsetNewest)
+		if err != nil {
+			return fmt.Errorf("failed to read newest offset of topic %v partition %v err=%v", topic, p, err)
+		}
+		if oldest >= newest {
+			continue
+		}
+
+		pc, err := consumer.ConsumePartition(topic, p, oldest)
+		if err != nil {
+			return fmt.Errorf("failed to consume topic %v partition %v err=%v", topic, p, err)
+		}
+		ranges = append(ranges, partitionRange{pc: pc, newest: newest})
+	}
+
+	var (
+		wg   sync.WaitGroup
+		errs = make(chan error, len(ranges))
+	)
+	for _, r := range ranges {
+		wg.Add(1)
+		go func(pc sarama.PartitionConsumer, newest int64) {
+			defer wg.Done()
+			for {
+				select {
+				case msg := <-pc.Messages():
+					l, err := copiedMessage(msg, partition)
+					if err != nil {
+						errs <- err
+						return
+					}
+					select {
+					case out <- l:
+					case <-quit:
+						return
+					}
+					if msg.Offset >= newest-1 {
+						return
+					}
+				case err := <-pc.Errors():
+					errs <- fmt.Errorf("failed to consume topic %v partition %v err=%v", err.Topic, err.Partition, err.Err)
+					return
+				case <-quit:
+					return
+				}
+			}
+		}(r.pc, r.newest)
+	}
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopiedMessage(t *testing.T) {
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	msg := &sarama.ConsumerMessage{
+		Key:       []byte{0xff, 'a'},
+		Value:     []byte("b"),
+		Partition: 2,
+		Timestamp: ts,
+		Headers:   []*sarama.RecordHeader{{Key: []byte("trace-id"), Value: []byte("abc")}},
+	}
+
+	actual, err := copiedMessage(msg, true)
+	require.NoError(t, err)
+	require.Equal(t, `{"key":"/2E=","value":"Yg==","partition":2,"headers":{"trace-id":"abc"},"timestamp":"2020-01-02T03:04:05Z","topic":null,"keyEncoding":"base64","valueEncoding":"base64"}`, actual)
+
+	actual, err = copiedMessage(&sarama.ConsumerMessage{Value: []byte("b"), Partition: 2, Timestamp: ts}, false)
+	require.NoError(t, err)
+	require.Equal(t, `{"key":null,"value":"Yg==","partition":null,"headers":null,"timestamp":"2020-01-02T03:04:05Z","topic":null,"valueEncoding":"base64"}`, actual)
+}
+
+func TestReadTopic(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("orders", 0, broker.BrokerID()).
+			SetLeader("orders", 1, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("orders", 0, sarama.OffsetOldest, 5).
+			SetOffset("orders", 0, sarama.OffsetNewest, 7).
+			SetOffset("orders", 1, sarama.OffsetOldest, 3).
+			SetOffset("orders", 1, sarama.OffsetNewest, 3),
+		"FetchRequest": sarama.NewMockFetchResponse(t, 1).
+			SetMessage("orders", 0, 5, sarama.StringEncoder("a")).
+			SetMessage("orders", 0, 6, sarama.StringEncoder("b")).
+			SetMessage("orders", 0, 7, sarama.StringEncoder("not copied")).
+			SetHighWaterMark("orders", 0, 8),
+	})
+
+	client, err := sarama.NewClient([]string{broker.Addr()}, sarama.NewConfig())
+	require.NoError(t, err)
+	defer client.Close()
+
+	out := make(chan string, 10)
+	require.NoError(t, readTopic(client, "orders", false, make(chan struct{}), out))
+
+	actual := []string{}
+	for l := range out {
+		actual = append(actual, l)
+	}
+	require.Len(t, actual, 2)
+	require.Contains(t, actual[0], `"value":"YQ=="`)
+	require.Contains(t, actual[1], `"value":"Yg=="`)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// csvColumns selects the columns of CSV input that make up messages. A
+// keyColumn of -1 leaves keys null, no valueColumns use all columns but the
+// key column.
+type csvColumns struct {
+	keyColumn    int
+	valueColumns []int
+}
+
+// parseColumns parses a comma separated list of zero based column indices and
+// inclusive ranges, e.g. 1,3-5.
+func parseColumns(spec string) ([]int, error) {
+	var columns []int
+	for _, part := range strings.Split(spec, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+		from, err := strconv.Atoi(bounds[0])
+		if err != nil || from < 0 {
+			return nil, fmt.Errorf("invalid column %#v in %#v", part, spec)
+		}
+		to := from
+		if len(bounds) == 2 {
+			if to, err = strconv.Atoi(bounds[1]); err != nil || to < from {
+				return nil, fmt.Errorf("invalid column range %#v in %#v", part, spec)
+			}
+		}
+		for c := from; c <= to; c++ {
+			columns = append(columns, c)
+		}
+	}
+	return columns, nil
+}
+
+// readCSV sends a JSON message per record of the CSV input r to out and
+// closes it once r is read. The first record is the header row, its fields
+// name the fields of the JSON object that is assembled from the value columns
+// as value.
+func readCSV(name string, r io.Reader, columns csvColumns, out chan string) error {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err == io.EOF {
+		close(out)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%v: invalid header err=%v", name, err)
+	}
+
+	valueColumns := columns.valueColumns
+	if len(valueColumns) == 0 {
+		for c := range header {
+			if c != columns.keyColumn {
+				valueColumns = append(valueColumns, c)
+			}
+		}
+	}
+	for _, c := range valueColumns {
+		if c >= len(header) {
+			return fmt.Errorf("%v: value column %v not in header of %v columns", name, c, len(header))
+		}
+	}
+	if columns.keyColumn >= len(header) {
+		return fmt.Errorf("%v: key column %v not in header of %v columns", name, columns.keyColumn, len(header))
+	}
+
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%v: invalid record err=%v", name, err)
+		}
+
+		value := make(map[string]string, len(valueColumns))
+		for _, c := range valueColumns {
+			value[header[c]] = record[c]
+		}
+		buf, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+
+		msg := message{Value: new(string)}
+		*msg.Value = string(buf)
+		if columns.keyColumn >= 0 {
+			msg.Key = &record[columns.keyColumn]
+		}
+		if buf, err = json.Marshal(msg); err != nil {
+			return err
+		}
+		out <- string(buf)
+	}
+
+	close(out)
+	return nil
+}
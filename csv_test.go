@@ -0,0 +1,104 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseColumns(t *testing.T) {
+	data := map[string][]int{
+		"0":       {0},
+		"1-5":     {1, 2, 3, 4, 5},
+		"1,3-4,7": {1, 3, 4, 7},
+	}
+	for spec, expected := range data {
+		actual, err := parseColumns(spec)
+		require.NoError(t, err, spec)
+		require.Equal(t, expected, actual, spec)
+	}
+
+	for _, spec := range []string{"", "a", "-1", "3-1", "1-b"} {
+		_, err := parseColumns(spec)
+		require.Error(t, err, spec)
+	}
+}
+
+func TestReadCSV(t *testing.T) {
+	input := "id,name,city\n23,Hans,\"Hamburg, Germany\"\n42,Peter,Berlin\n"
+	data := []struct {
+		name     string
+		columns  csvColumns
+		input    string
+		expected []string
+		err      string
+	}{
+		{
+			name:    "key-and-values",
+			columns: csvColumns{keyColumn: 0, valueColumns: []int{1, 2}},
+			input:   input,
+			expected: []string{
+				`{"key":"23","value":"{\"city\":\"Hamburg, Germany\",\"name\":\"Hans\"}","partition":null,"headers":null,"timestamp":null,"topic":null}`,
+				`{"key":"42","value":"{\"city\":\"Berlin\",\"name\":\"Peter\"}","partition":null,"headers":null,"timestamp":null,"topic":null}`,
+			},
+		},
+		{
+			name:    "default-values",
+			columns: csvColumns{keyColumn: 1},
+			input:   input,
+			expected: []string{
+				`{"key":"Hans","value":"{\"city\":\"Hamburg, Germany\",\"id\":\"23\"}","partition":null,"headers":null,"timestamp":null,"topic":null}`,
+				`{"key":"Peter","value":"{\"city\":\"Berlin\",\"id\":\"42\"}","partition":null,"headers":null,"timestamp":null,"topic":null}`,
+			},
+		},
+		{
+			name:    "no-key",
+			columns: csvColumns{keyColumn: -1, valueColumns: []int{1}},
+			input:   input,
+			expected: []string{
+				`{"key":null,"value":"{\"name\":\"Hans\"}","partition":null,"headers":null,"timestamp":null,"topic":null}`,
+				`{"key":null,"value":"{\"name\":\"Peter\"}","partition":null,"headers":null,"timestamp":null,"topic":null}`,
+			},
+		},
+		{
+			name:     "empty",
+			columns:  csvColumns{keyColumn: -1},
+			expected: []string{},
+		},
+		{
+			name:    "unknown-column",
+			columns: csvColumns{keyColumn: 0, valueColumns: []int{3}},
+			input:   input,
+			err:     "test: value column 3 not in header of 3 columns",
+		},
+		{
+			name:    "unknown-key-column",
+			columns: csvColumns{keyColumn: 3},
+			input:   input,
+			err:     "test: key column 3 not in header of 3 columns",
+		},
+		{
+			name:    "invalid-record",
+			columns: csvColumns{keyColumn: 0},
+			input:   "id,name\n23\n",
+			err:     "test: invalid record err=record on line 2: wrong number of fields",
+		},
+	}
+
+	for _, d := range data {
+		out := make(chan string, 10)
+		err := readCSV("test", strings.NewReader(d.input), d.columns, out)
+		if d.err != "" {
+			require.EqualError(t, err, d.err, d.name)
+			continue
+		}
+		require.NoError(t, err, d.name)
+
+		actual := []string{}
+		for l := range out {
+			actual = append(actual, l)
+		}
+		require.Equal(t, d.expected, actual, d.name)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// compressedExtension returns the extension of path that marks it as
+// compressed, e.g. .gz for orders.jsonl.gz, or an empty string.
+func compressedExtension(path string) string {
+	ext := filepath.Ext(path)
+	switch strings.ToLower(ext) {
+	case ".gz", ".gzip", ".zst", ".zstd":
+		return ext
+	}
+	return ""
+}
+
+// detectCompression returns gzip or zstd if r starts with their magic bytes,
+// and none otherwise. It returns a reader that still starts at the beginning.
+func detectCompression(r io.Reader) (string, io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return "", nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return "gzip", br, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		return "zstd", br, nil
+	}
+	return "none", br, nil
+}
+
+type decompressReader struct {
+	io.Reader
+	close func()
+}
+
+func (d decompressReader) Close() error {
+	d.close()
+	return nil
+}
+
+// decompressedReader returns r decompressed with compression, which is gzip,
+// zstd, none, or auto to detect gzip and zstd by their magic bytes.
+func decompressedReader(r io.Reader, compression string) (io.ReadCloser, error) {
+	if compression == "auto" {
+		var err error
+		if compression, r, err = detectCompression(r); err != nil {
+			return nil, fmt.Errorf("failed to detect compression err=%v", err)
+		}
+	}
+
+	switch compression {
+	case "gzip":
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read gzip input err=%v", err)
+		}
+		return decompressReader{Reader: gr, close: func() { gr.Close() }}, nil
+	case "zstd":
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read zstd input err=%v", err)
+		}
+		return decompressReader{Reader: zr, close: zr.Close}, nil
+	}
+	return decompressReader{Reader: r, close: func() {}}, nil
+}
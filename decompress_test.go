@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+func gzipped(t *testing.T, data string) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write([]byte(data))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func zstded(t *testing.T, data string) []byte {
+	w, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+	defer w.Close()
+	return w.EncodeAll([]byte(data), nil)
+}
+
+func TestDecompressedReader(t *testing.T) {
+	input := "{\"value\": \"a\"}\n"
+	data := []struct {
+		name        string
+		compression string
+		given       []byte
+		expected    string
+	}{
+		{name: "auto-gzip", compression: "auto", given: gzipped(t, input)},
+		{name: "auto-zstd", compression: "auto", given: zstded(t, input)},
+		{name: "auto-none", compression: "auto", given: []byte(input)},
+		{name: "auto-short", compression: "auto", given: []byte("a"), expected: "a"},
+		{name: "gzip", compression: "gzip", given: gzipped(t, input)},
+		{name: "zstd", compression: "zstd", given: zstded(t, input)},
+		{name: "none", compression: "none", given: gzipped(t, input), expected: string(gzipped(t, input))},
+	}
+
+	for _, d := range data {
+		r, err := decompressedReader(bytes.NewReader(d.given), d.compression)
+		require.NoError(t, err, d.name)
+		actual, err := ioutil.ReadAll(r)
+		require.NoError(t, err, d.name)
+		require.NoError(t, r.Close(), d.name)
+
+		expected := d.expected
+		if expected == "" {
+			expected = input
+		}
+		require.Equal(t, expected, string(actual), d.name)
+	}
+
+	_, err := decompressedReader(bytes.NewReader([]byte(input)), "gzip")
+	require.Error(t, err)
+}
+
+func TestCompressedExtension(t *testing.T) {
+	require.Equal(t, ".gz", compressedExtension("orders.json.gz"))
+	require.Equal(t, ".zst", compressedExtension("orders.jsonl.zst"))
+	require.Equal(t, "", compressedExtension("orders.json"))
+
+	format, err := inputFormat("orders.json.gz", "")
+	require.NoError(t, err)
+	require.Equal(t, "json", format)
+}
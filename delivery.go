@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+type deliveryReport struct {
+	Topic     string    `json:"topic"`
+	Partition int32     `json:"partition"`
+	Offset    int64     `json:"offset"`
+	Timestamp time.Time `json:"timestamp"`
+	Duration  string    `json:"duration"`
+}
+
+// partitionDeliveries returns a report per message of pb, which the leader
+// acknowledged with block after d. Without block, i.e. with acks 0, offsets
+// are -1. The timestamp is the broker's LogAppendTime if the topic is
+// configured with it, and the message's CreateTime otherwise.
+func partitionDeliveries(pb *partitionBatch, block *sarama.ProduceResponseBlock, d time.Duration) []deliveryReport {
+	reports := make([]deliveryReport, len(pb.timestamps))
+	for i, ts := range pb.timestamps {
+		r := deliveryReport{Topic: pb.topic, Partition: pb.partition, Offset: -1, Timestamp: ts, Duration: d.String()}
+		if block != nil {
+			r.Offset = block.Offset + int64(i)
+			if !block.Timestamp.IsZero() {
+				r.Timestamp = block.Timestamp
+			}
+		}
+		reports[i] = r
+	}
+	return reports
+}
+
+type produceSummary struct {
+	Messages int64  `json:"messages"`
+	Failed   int64  `json:"failed"`
+	Skipped  int64  `json:"skipped"`
+	Duration string `json:"duration"`
+}
+
+// failed returns the number of messages that were sent but neither delivered
+// nor skipped.
+func (cmd *produceCmd) failed() int64 {
+	return atomic.LoadInt64(&cmd.sent) - atomic.LoadInt64(&cmd.delivered) - atomic.LoadInt64(&cmd.skipped)
+}
+
+// printSummary prints the number of messages delivered, failed and skipped to
+// stderr.
+func (cmd *produceCmd) printSummary(d time.Duration) {
+	summary := produceSummary{Messages: atomic.LoadInt64(&cmd.delivered), Failed: cmd.failed(), Skipped: atomic.LoadInt64(&cmd.skipped), Duration: d.String()}
+	buf, err := json.Marshal(summary)
+	if err != nil {
+		failf("failed to marshal summary err=%v", err)
+	}
+	fmt.Fprintln(os.Stderr, string(buf))
+}
+
+// requestStats counts the produce requests and partition batches sent, with
+// their messages and bytes of keys and values. Requests that are sent again
+// for retries are counted again.
+type requestStats struct {
+	// accessed atomically
+	requests int64
+	batches  int64
+	messages int64
+	bytes    int64
+}
+
+// record adds a request of the batches parts.
+func (s *requestStats) record(parts []*partitionBatch) {
+	var messages, bytes int
+	for _, pb := range parts {
+		messages += len(pb.input)
+		for _, m := range pb.input {
+			bytes += m.size()
+		}
+	}
+	atomic.AddInt64(&s.requests, 1)
+	atomic.AddInt64(&s.batches, int64(len(parts)))
+	atomic.AddInt64(&s.messages, int64(messages))
+	atomic.AddInt64(&s.bytes, int64(bytes))
+}
+
+type requestReport struct {
+	Requests           int64   `json:"requests"`
+	Batches            int64   `json:"batches"`
+	MessagesPerRequest float64 `json:"messagesPerRequest"`
+	MessagesPerBatch   float64 `json:"messagesPerBatch"`
+	AverageBatchBytes  float64 `json:"averageBatchBytes"`
+	RequestsPerSecond  float64 `json:"requestsPerSecond"`
+	Duration           string  `json:"duration"`
+}
+
+// report returns the averages of the requests sent over d.
+func (s *requestStats) report(d time.Duration) requestReport {
+	r := requestReport{
+		Requests: atomic.LoadInt64(&s.requests),
+		Batches:  atomic.LoadInt64(&s.batches),
+		Duration: d.String(),
+	}
+	messages, bytes := float64(atomic.LoadInt64(&s.messages)), float64(atomic.LoadInt64(&s.bytes))
+	if r.Requests > 0 {
+		r.MessagesPerRequest = messages / float64(r.Requests)
+	}
+	if r.Batches > 0 {
+		r.MessagesPerBatch = messages / float64(r.Batches)
+		r.AverageBatchBytes = bytes / float64(r.Batches)
+	}
+	if secs := d.Seconds(); secs > 0 {
+		r.RequestsPerSecond = float64(r.Requests) / secs
+	}
+	return r
+}
+
+// print prints the report of the requests sent over d to stderr.
+func (s *requestStats) print(d time.Duration) {
+	buf, err := json.Marshal(s.report(d))
+	if err != nil {
+		failf("failed to marshal batch statistics err=%v", err)
+	}
+	fmt.Fprintln(os.Stderr, string(buf))
+}
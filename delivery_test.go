@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartitionDeliveries(t *testing.T) {
+	ts := time.Unix(1500000000, 0)
+	appended := time.Unix(1600000000, 0)
+	pb := &partitionBatch{topic: "hans", partition: 1, timestamps: []time.Time{ts, ts.Add(time.Second)}}
+
+	actual := partitionDeliveries(pb, &sarama.ProduceResponseBlock{Offset: 23}, time.Millisecond)
+	require.Equal(t, []deliveryReport{
+		{Topic: "hans", Partition: 1, Offset: 23, Timestamp: ts, Duration: "1ms"},
+		{Topic: "hans", Partition: 1, Offset: 24, Timestamp: ts.Add(time.Second), Duration: "1ms"},
+	}, actual)
+
+	actual = partitionDeliveries(pb, &sarama.ProduceResponseBlock{Offset: 5, Timestamp: appended}, time.Millisecond)
+	require.Equal(t, appended, actual[0].Timestamp)
+	require.Equal(t, appended, actual[1].Timestamp)
+
+	actual = partitionDeliveries(pb, nil, time.Millisecond)
+	require.Equal(t, int64(-1), actual[0].Offset)
+	require.Equal(t, int64(-1), actual[1].Offset)
+}
+
+func TestRequestStats(t *testing.T) {
+	stats := &requestStats{}
+	require.Equal(t, requestReport{Duration: "0s"}, stats.report(0))
+
+	a, b := "a", "bcd"
+	stats.record([]*partitionBatch{
+		{input: []message{{Value: &a}, {Key: &a, Value: &b}}},
+		{input: []message{{Value: &b}}},
+	})
+	stats.record([]*partitionBatch{{input: []message{{Key: &a}}}})
+
+	require.Equal(t, requestReport{
+		Requests:           2,
+		Batches:            3,
+		MessagesPerRequest: 2,
+		MessagesPerBatch:   4.0 / 3,
+		AverageBatchBytes:  3,
+		RequestsPerSecond:  1,
+		Duration:           "2s",
+	}, stats.report(2*time.Second))
+}
+
+func TestProduceFailed(t *testing.T) {
+	target := &produceCmd{sent: 10, delivered: 6, skipped: 1}
+	require.Equal(t, int64(3), target.failed())
+
+	target = &produceCmd{sent: 10, delivered: 9, skipped: 1}
+	require.Zero(t, target.failed())
+}
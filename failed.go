@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// failedMessage is a message that couldn't be produced, in the input format
+// so that the failures can be produced again, with the error.
+type failedMessage struct {
+	message
+	Error string `json:"error"`
+}
+
+// failedWriter writes failed messages to the -failed-out file, a JSON object
+// per line.
+type failedWriter struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func newFailedWriter(path string) (*failedWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create failed-out file err=%v", err)
+	}
+	return &failedWriter{f: f}, nil
+}
+
+// write appends msgs with err, unbuffered so that the failures are kept when
+// kt is interrupted.
+func (fw *failedWriter) write(msgs []message, err error) error {
+	var buf []byte
+	for _, msg := range msgs {
+		line, merr := json.Marshal(failedMessage{message: msg, Error: err.Error()})
+		if merr != nil {
+			return merr
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if _, err := fw.f.Write(buf); err != nil {
+		return fmt.Errorf("failed to write failed-out file err=%v", err)
+	}
+	return nil
+}
+
+func (fw *failedWriter) close() error {
+	return fw.f.Close()
+}
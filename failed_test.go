@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailedWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kt-failed")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "failed.jsonl")
+	fw, err := newFailedWriter(path)
+	require.NoError(t, err)
+
+	key, value, partition := "id-23", "a", int32(2)
+	ts := &messageTimestamp{Time: time.Unix(1500000000, 0).UTC()}
+	msgs := []message{{Key: &key, Value: &value, Partition: &partition, Timestamp: ts}, {Value: &value, Partition: &partition}}
+	require.NoError(t, fw.write(msgs, fmt.Errorf("hans")))
+	require.NoError(t, fw.close())
+
+	buf, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(buf)), "\n")
+	require.Equal(t, []string{
+		`{"key":"id-23","value":"a","partition":2,"headers":null,"timestamp":"2017-07-14T02:40:00Z","topic":null,"error":"hans"}`,
+		`{"key":null,"value":"a","partition":2,"headers":null,"timestamp":null,"topic":null,"error":"hans"}`,
+	}, lines)
+
+	var actual message
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &actual))
+	require.Equal(t, key, *actual.Key)
+	require.Equal(t, partition, *actual.Partition)
+	require.True(t, ts.Equal(actual.Timestamp.Time))
+
+	_, err = newFailedWriter(filepath.Join(dir, "missing", "failed.jsonl"))
+	require.Error(t, err)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// generateData is passed to the -generate template for every message.
+type generateData struct {
+	Seq int64
+}
+
+var generateFuncs = template.FuncMap{
+	"int":    generateInt,
+	"float":  generateFloat,
+	"string": generateString,
+	"uuid":   generateUUID,
+	"now":    func() string { return time.Now().UTC().Format(time.RFC3339Nano) },
+	"millis": func() int64 { return time.Now().UnixNano() / int64(time.Millisecond) },
+	"enum":   generateEnum,
+	"env":    os.Getenv,
+}
+
+func parseGenerateTemplate(text string) (*template.Template, error) {
+	return template.New("generate").Funcs(generateFuncs).Option("missingkey=error").Parse(text)
+}
+
+// generateInt returns a random integer between min and max, inclusive.
+func generateInt(min, max int) (int, error) {
+	if max < min {
+		return 0, fmt.Errorf("int max %v is less than min %v", max, min)
+	}
+	return min + rand.Intn(max-min+1), nil
+}
+
+// generateFloat returns a random float between min and max.
+func generateFloat(min, max float64) (float64, error) {
+	if max < min {
+		return 0, fmt.Errorf("float max %v is less than min %v", max, min)
+	}
+	return min + rand.Float64()*(max-min), nil
+}
+
+// generateString returns a random alphanumeric string of length n.
+func generateString(n int) string {
+	const chars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	buf := make([]byte, n)
+	for i := range buf {
+		buf[i] = chars[rand.Intn(len(chars))]
+	}
+	return string(buf)
+}
+
+// generateUUID returns a random version 4 UUID.
+func generateUUID() string {
+	var u [16]byte
+	rand.Read(u[:])
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
+}
+
+// generateEnum returns one of the given values, which are picked according to
+// their optional weight suffix, e.g. "EUR:3" is picked three times as often as
+// "USD" or "USD:1".
+func generateEnum(values ...string) (string, error) {
+	if len(values) == 0 {
+		return "", fmt.Errorf("enum requires at least one value")
+	}
+
+	var (
+		choices = make([]string, len(values))
+		weights = make([]int, len(values))
+		total   int
+	)
+	for i, v := range values {
+		choices[i], weights[i] = v, 1
+		if j := strings.LastIndex(v, ":"); j >= 0 {
+			w, err := strconv.Atoi(v[j+1:])
+			if err != nil || w < 0 {
+				return "", fmt.Errorf("invalid enum weight in %#v", v)
+			}
+			choices[i], weights[i] = v[:j], w
+		}
+		total += weights[i]
+	}
+	if total == 0 {
+		return "", fmt.Errorf("enum weights must not all be zero")
+	}
+
+	n := rand.Intn(total)
+	for i, w := range weights {
+		if n < w {
+			return choices[i], nil
+		}
+		n -= w
+	}
+	panic("unreachable")
+}
+
+// generateLines sends count lines executed from tmpl to out, or unlimited
+// lines for count 0, and closes out once done or quit is closed.
+func generateLines(tmpl *template.Template, count int64, quit <-chan struct{}, out chan string) error {
+	var buf bytes.Buffer
+	for seq := int64(0); count == 0 || seq < count; seq++ {
+		buf.Reset()
+		if err := tmpl.Execute(&buf, generateData{Seq: seq}); err != nil {
+			return fmt.Errorf("failed to generate message %v err=%v", seq, err)
+		}
+
+		select {
+		case out <- buf.String():
+		case <-quit:
+			close(out)
+			return nil
+		}
+	}
+
+	close(out)
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateLines(t *testing.T) {
+	tmpl, err := parseGenerateTemplate(`{"key": "{{uuid}}", "value": "{{.Seq}} {{int 1 3}} {{float 0.5 1.5}} {{string 4}} {{enum "a:2" "b" "c:0"}} {{now}} {{millis}}"}`)
+	require.NoError(t, err)
+
+	out := make(chan string, 10)
+	require.NoError(t, generateLines(tmpl, 3, make(chan struct{}), out))
+
+	pattern := regexp.MustCompile(`^(\d+) ([1-3]) ([01](\.\d+)?) ([a-zA-Z0-9]{4}) ([ab]) (\S+Z) (\d+)$`)
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	seqs := []string{}
+	for l := range out {
+		var msg message
+		require.NoError(t, json.Unmarshal([]byte(l), &msg), l)
+		require.Regexp(t, uuid, *msg.Key)
+		m := pattern.FindStringSubmatch(*msg.Value)
+		require.NotNil(t, m, *msg.Value)
+		seqs = append(seqs, m[1])
+	}
+	require.Equal(t, []string{"0", "1", "2"}, seqs)
+
+	quit := make(chan struct{})
+	close(quit)
+	out = make(chan string)
+	require.NoError(t, generateLines(tmpl, 0, quit, out))
+	_, ok := <-out
+	require.False(t, ok)
+
+	tmpl, err = parseGenerateTemplate(`{{int 3 1}}`)
+	require.NoError(t, err)
+	require.Error(t, generateLines(tmpl, 1, make(chan struct{}), make(chan string, 1)))
+}
+
+func TestGenerateEnum(t *testing.T) {
+	counts := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		v, err := generateEnum("a:3", "b", "c:0")
+		require.NoError(t, err)
+		counts[v]++
+	}
+	require.Zero(t, counts["c"])
+	require.True(t, counts["a"] > counts["b"], "%v", counts)
+
+	for _, values := range [][]string{{}, {"a:x"}, {"a:-1"}, {"a:0"}} {
+		_, err := generateEnum(values...)
+		require.Error(t, err, "%v", values)
+	}
+}
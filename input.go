@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// inputFormat returns the format of the input file at path, which is given or
+// derived from the extension: json for .json files and jsonl otherwise. The
+// extension of compressed files is ignored, e.g. .gz for orders.json.gz.
+func inputFormat(path, format string) (string, error) {
+	switch format {
+	case "jsonl", "json", "text":
+		return format, nil
+	case "":
+		path = strings.TrimSuffix(path, compressedExtension(path))
+		if strings.EqualFold(filepath.Ext(path), ".json") {
+			return "json", nil
+		}
+		return "jsonl", nil
+	}
+	return "", fmt.Errorf("unsupported file-format %#v, only jsonl, json and text are supported", format)
+}
+
+// readInputFile sends the messages in the file at path to out and closes it
+// once the whole file is read. jsonl files contain a JSON message per line,
+// json files a JSON array of messages or strings used as values, and text
+// files a value per line. Invalid messages are reported with their position.
+// The file is decompressed according to decompress, see decompressedReader.
+func readInputFile(path, format, decompress string, max int, out chan string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open input file err=%v", err)
+	}
+	defer f.Close()
+
+	r, err := decompressedReader(f, decompress)
+	if err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	defer r.Close()
+
+	if format == "json" {
+		err = readJSONArray(path, r, out)
+	} else {
+		err = readLines(path, format, r, max, out)
+	}
+	if err != nil {
+		return err
+	}
+
+	close(out)
+	return nil
+}
+
+func readLines(path, format string, r io.Reader, max int, out chan string) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, max), max)
+
+	if format == "" {
+		scanMessages(scanner, max, out)
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("failed to read %v err=%v", path, err)
+		}
+		return nil
+	}
+
+	for n := 1; scanner.Scan(); n++ {
+		l := scanner.Text()
+		if format == "jsonl" {
+			if strings.TrimSpace(l) == "" {
+				continue
+			}
+			var msg message
+			if err := json.Unmarshal([]byte(l), &msg); err != nil {
+				return fmt.Errorf("%v:%d: invalid message err=%v", path, n, err)
+			}
+		}
+		out <- l
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read %v err=%v", path, err)
+	}
+	return nil
+}
+
+// scanMessages sends the lines that scanner reads to out, but JSON objects
+// that span multiple lines, e.g. pretty printed by jq, are compacted and sent
+// as a single line. Lines that start an object are decoded until the object
+// is complete, lines that turn out not to be JSON, or that add up to more than
+// max bytes without completing an object, are sent as they are.
+func scanMessages(scanner *bufio.Scanner, max int, out chan string) {
+	var (
+		pending []string
+		size    int
+	)
+	flush := func() {
+		for _, l := range pending {
+			out <- l
+		}
+		pending, size = nil, 0
+	}
+
+	for scanner.Scan() {
+		l := scanner.Text()
+		if len(pending) == 0 && !strings.HasPrefix(strings.TrimSpace(l), "{") {
+			out <- l
+			continue
+		}
+
+		pending, size = append(pending, l), size+len(l)+1
+		input := strings.Join(pending, "\n")
+		dec := json.NewDecoder(strings.NewReader(input))
+		var raw json.RawMessage
+		err := dec.Decode(&raw)
+		switch {
+		case err == io.ErrUnexpectedEOF && size <= max:
+			continue
+		case err == nil && len(pending) > 1 && strings.TrimSpace(input[dec.InputOffset():]) == "":
+			var buf bytes.Buffer
+			if err := json.Compact(&buf, raw); err != nil {
+				flush()
+				continue
+			}
+			out <- buf.String()
+			pending, size = nil, 0
+		default:
+			flush()
+		}
+	}
+
+	flush()
+}
+
+func readJSONArray(path string, r io.Reader, out chan string) error {
+	dec := json.NewDecoder(r)
+	if t, err := dec.Token(); err != nil || t != json.Delim('[') {
+		return fmt.Errorf("%v: expected a JSON array of messages", path)
+	}
+
+	for i := 1; dec.More(); i++ {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return fmt.Errorf("%v: invalid message %d at offset %d err=%v", path, i, dec.InputOffset(), err)
+		}
+
+		var value string
+		if err := json.Unmarshal(raw, &value); err == nil {
+			buf, err := json.Marshal(message{Value: &value})
+			if err != nil {
+				return err
+			}
+			raw = buf
+		} else if err := json.Unmarshal(raw, &message{}); err != nil {
+			return fmt.Errorf("%v: invalid message %d ending at offset %d err=%v", path, i, dec.InputOffset(), err)
+		}
+
+		out <- string(raw)
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return fmt.Errorf("%v: invalid end of JSON array err=%v", path, err)
+	}
+	return nil
+}
+
+// readKeyValueFiles sends a message per line of the files at keyPath and
+// valuePath to out, with line N of the key file as key of line N of the value
+// file, and closes out once both are read. Both files must have the same
+// number of lines.
+func readKeyValueFiles(keyPath, valuePath, decompress string, max int, out chan string) error {
+	open := func(path string) (*bufio.Scanner, func(), error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open input file err=%v", err)
+		}
+		r, err := decompressedReader(f, decompress)
+		if err != nil {
+			f.Close()
+			return nil, nil, fmt.Errorf("%v: %v", path, err)
+		}
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, max), max)
+		return scanner, func() { r.Close(); f.Close() }, nil
+	}
+
+	keys, closeKeys, err := open(keyPath)
+	if err != nil {
+		return err
+	}
+	defer closeKeys()
+	values, closeValues, err := open(valuePath)
+	if err != nil {
+		return err
+	}
+	defer closeValues()
+
+	for n := 1; ; n++ {
+		hasKey, hasValue := keys.Scan(), values.Scan()
+		if err := keys.Err(); err != nil {
+			return fmt.Errorf("failed to read %v err=%v", keyPath, err)
+		}
+		if err := values.Err(); err != nil {
+			return fmt.Errorf("failed to read %v err=%v", valuePath, err)
+		}
+		if !hasKey && !hasValue {
+			break
+		}
+		if hasKey != hasValue {
+			return fmt.Errorf("%v and %v differ in length, only one has line %d", keyPath, valuePath, n)
+		}
+
+		key, value := keys.Text(), values.Text()
+		buf, err := json.Marshal(message{Key: &key, Value: &value})
+		if err != nil {
+			return err
+		}
+		out <- string(buf)
+	}
+
+	close(out)
+	return nil
+}
+
+// followPoll is how often a followed file is checked for new lines.
+const followPoll = 250 * time.Millisecond
+
+// followFile sends the lines that are appended to the file at path to out,
+// starting at its current end like tail -F, until quit is closed. When the
+// file is replaced, e.g. by log rotation, the old file is read to its end
+// before the new one is read from the start. A truncated file is read from
+// the start again. Lines are only sent once complete, except for the last
+// line of a replaced file. Invalid jsonl lines are reported and skipped.
+func followFile(path, format string, max int, poll time.Duration, quit <-chan struct{}, out chan string) error {
+	defer close(out)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open input file err=%v", err)
+	}
+	defer func() { f.Close() }()
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("failed to seek to the end of %v err=%v", path, err)
+	}
+
+	var (
+		r        = bufio.NewReader(f)
+		pending  []byte
+		last     []byte // the bytes before offset, to detect rewrites
+		rotating bool
+	)
+	send := func() bool {
+		l := strings.TrimSuffix(strings.TrimSuffix(string(pending), "\n"), "\r")
+		pending = pending[:0]
+		if format == "jsonl" {
+			if strings.TrimSpace(l) == "" {
+				return true
+			}
+			if err := json.Unmarshal([]byte(l), &message{}); err != nil {
+				fmt.Fprintf(os.Stderr, "%v: skipping invalid message [%v] err=%v\n", path, l, err)
+				return true
+			}
+		}
+		select {
+		case out <- l:
+			return true
+		case <-quit:
+			return false
+		}
+	}
+
+	for {
+		line, err := r.ReadBytes('\n')
+		pending = append(pending, line...)
+		offset += int64(len(line))
+		if last = append(last, line...); len(last) > followCheckBytes {
+			last = last[len(last)-followCheckBytes:]
+		}
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read %v err=%v", path, err)
+		}
+		if len(pending) > max {
+			return fmt.Errorf("%v: line exceeds buffersize of %v bytes", path, max)
+		}
+
+		if err == nil {
+			if !send() {
+				return nil
+			}
+			continue
+		}
+
+		if rotating { // the old file is read to its end
+			if nf, err := os.Open(path); err == nil {
+				if len(pending) > 0 && !send() {
+					return nil
+				}
+				f.Close()
+				f, offset, last, rotating = nf, 0, last[:0], false
+				r.Reset(f)
+				continue
+			}
+		}
+
+		select {
+		case <-time.After(poll):
+		case <-quit:
+			return nil
+		}
+		switch {
+		case rotating:
+		case replaced(f, path):
+			rotating = true
+		case truncated(f, offset, last):
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return fmt.Errorf("failed to seek to the start of %v err=%v", path, err)
+			}
+			offset, pending, last = 0, pending[:0], last[:0]
+			r.Reset(f)
+		}
+	}
+}
+
+// followCheckBytes is how many of the bytes read last are compared with the
+// file to detect that it was truncated and written again.
+const followCheckBytes = 64
+
+// replaced reports whether the file at path isn't f anymore.
+func replaced(f *os.File, path string) bool {
+	current, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	opened, err := f.Stat()
+	if err != nil {
+		return true
+	}
+	return !os.SameFile(current, opened)
+}
+
+// truncated reports whether f has less than offset bytes, or no longer
+// contains last before offset, i.e. it was truncated and written again.
+func truncated(f *os.File, offset int64, last []byte) bool {
+	fi, err := f.Stat()
+	if err != nil || fi.Size() < offset {
+		return err == nil
+	}
+	buf := make([]byte, len(last))
+	if _, err := f.ReadAt(buf, offset-int64(len(last))); err != nil {
+		return false
+	}
+	return !bytes.Equal(buf, last)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInputFormat(t *testing.T) {
+	data := []struct {
+		path     string
+		format   string
+		expected string
+	}{
+		{path: "messages.jsonl", expected: "jsonl"},
+		{path: "messages.JSON", expected: "json"},
+		{path: "messages.txt", expected: "jsonl"},
+		{path: "messages.json", format: "text", expected: "text"},
+	}
+
+	for _, d := range data {
+		actual, err := inputFormat(d.path, d.format)
+		require.NoError(t, err, d.path)
+		require.Equal(t, d.expected, actual, d.path)
+	}
+
+	_, err := inputFormat("messages.csv", "csv")
+	require.EqualError(t, err, `unsupported file-format "csv", only jsonl, json and text are supported`)
+}
+
+func TestReadInputFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kt-input")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	data := []struct {
+		name     string
+		format   string
+		content  string
+		expected []string
+		err      string
+	}{
+		{
+			name:     "jsonl",
+			format:   "jsonl",
+			content:  "{\"value\": \"a\"}\n\n{\"key\": \"k\", \"value\": \"b\"}\n",
+			expected: []string{`{"value": "a"}`, `{"key": "k", "value": "b"}`},
+		},
+		{
+			name:    "invalid-jsonl",
+			format:  "jsonl",
+			content: "{\"value\": \"a\"}\nhans\n",
+			err:     ":2: invalid message err=",
+		},
+		{
+			name:     "text",
+			format:   "text",
+			content:  "a\n{\"value\": \"b\"}\n",
+			expected: []string{"a", `{"value": "b"}`},
+		},
+		{
+			name:     "json",
+			format:   "json",
+			content:  "[\n  {\"key\": \"k\", \"value\": \"a\"},\n  \"b\"\n]\n",
+			expected: []string{`{"key": "k", "value": "a"}`, `{"key":null,"value":"b","partition":null,"headers":null,"timestamp":null,"topic":null}`},
+		},
+		{
+			name:    "invalid-json",
+			format:  "json",
+			content: `[{"value": "a"}, 23]`,
+			err:     ": invalid message 2 ending at offset 19 err=",
+		},
+		{
+			name:    "not-an-array",
+			format:  "json",
+			content: `{"value": "a"}`,
+			err:     ": expected a JSON array of messages",
+		},
+	}
+
+	for _, d := range data {
+		path := filepath.Join(dir, d.name)
+		require.NoError(t, ioutil.WriteFile(path, []byte(d.content), 0644), d.name)
+
+		out := make(chan string, 10)
+		err := readInputFile(path, d.format, "auto", 1024, out)
+		if d.err != "" {
+			require.Error(t, err, d.name)
+			require.Contains(t, err.Error(), path+d.err, d.name)
+			continue
+		}
+		require.NoError(t, err, d.name)
+
+		actual := []string{}
+		for l := range out {
+			actual = append(actual, l)
+		}
+		require.Equal(t, d.expected, actual, d.name)
+	}
+
+	path := filepath.Join(dir, "messages.jsonl.gz")
+	require.NoError(t, ioutil.WriteFile(path, gzipped(t, "{\"value\": \"a\"}\n"), 0644))
+	out := make(chan string, 1)
+	require.NoError(t, readInputFile(path, "jsonl", "auto", 1024, out))
+	require.Equal(t, `{"value": "a"}`, <-out)
+
+	err = readInputFile(filepath.Join(dir, "missing"), "jsonl", "auto", 1024, make(chan string))
+	require.Error(t, err)
+}
+
+func TestReadKeyValueFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kt-input")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	keys, values, short := filepath.Join(dir, "keys.txt"), filepath.Join(dir, "values.jsonl"), filepath.Join(dir, "short.txt")
+	require.NoError(t, ioutil.WriteFile(keys, []byte("k1\nk2\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(values, []byte("{\"id\": 1}\n{\"id\": 2}\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(short, []byte("k1\n"), 0644))
+
+	out := make(chan string, 10)
+	require.NoError(t, readKeyValueFiles(keys, values, "auto", 1024, out))
+	actual := []string{}
+	for l := range out {
+		actual = append(actual, l)
+	}
+	require.Equal(t, []string{
+		`{"key":"k1","value":"{\"id\": 1}","partition":null,"headers":null,"timestamp":null,"topic":null}`,
+		`{"key":"k2","value":"{\"id\": 2}","partition":null,"headers":null,"timestamp":null,"topic":null}`,
+	}, actual)
+
+	err = readKeyValueFiles(short, values, "auto", 1024, make(chan string, 10))
+	require.EqualError(t, err, short+" and "+values+" differ in length, only one has line 2")
+
+	err = readKeyValueFiles(filepath.Join(dir, "missing"), values, "auto", 1024, make(chan string))
+	require.Error(t, err)
+}
+
+func TestScanMessages(t *testing.T) {
+	data := []struct {
+		name     string
+		input    string
+		expected []string
+	}{
+		{
+			name:     "lines",
+			input:    "a\n{\"value\": \"b\"}\n\n",
+			expected: []string{"a", `{"value": "b"}`, ""},
+		},
+		{
+			name:     "pretty",
+			input:    "{\n  \"key\": \"k\",\n  \"value\": \"{\\\"a\\\": [1, 2]}\"\n}\n{\n  \"value\": \"}\"\n}\nc\n",
+			expected: []string{`{"key":"k","value":"{\"a\": [1, 2]}"}`, `{"value":"}"}`, "c"},
+		},
+		{
+			name:     "nested",
+			input:    "{\n  \"value\": \"a\",\n  \"headers\": {\n    \"h\": \"\\\\\"\n  }\n}\n",
+			expected: []string{`{"value":"a","headers":{"h":"\\"}}`},
+		},
+		{
+			name:     "unclosed",
+			input:    "{\nb\n",
+			expected: []string{"{", "b"},
+		},
+		{
+			name:     "not-json",
+			input:    "{foo\nbar\nbaz\n",
+			expected: []string{"{foo", "bar", "baz"},
+		},
+		{
+			name:     "braces-in-strings",
+			input:    "{\n  \"value\": \"{{{\"\n}\nc\n",
+			expected: []string{`{"value":"{{{"}`, "c"},
+		},
+		{
+			name:     "exceeds-max",
+			input:    "{\n  \"value\": \"01234567890123456789012345678901234567890123456789012345678901234567890123456789\",\n  \"key\": \"k\"\n}\n",
+			expected: []string{"{", `  "value": "01234567890123456789012345678901234567890123456789012345678901234567890123456789",`, `  "key": "k"`, "}"},
+		},
+	}
+
+	for _, d := range data {
+		out := make(chan string, 10)
+		scanMessages(bufio.NewScanner(strings.NewReader(d.input)), 80, out)
+		close(out)
+
+		actual := []string{}
+		for l := range out {
+			actual = append(actual, l)
+		}
+		require.Equal(t, d.expected, actual, d.name)
+	}
+}
+
+func TestFollowFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kt-input")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.log")
+	require.NoError(t, ioutil.WriteFile(path, []byte("old\n"), 0644))
+
+	quit, out, done := make(chan struct{}), make(chan string, 10), make(chan error)
+	go func() { done <- followFile(path, "text", 1024, time.Millisecond, quit, out) }()
+	time.Sleep(50 * time.Millisecond) // until the end of the file is found
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteString("a\nb")
+	require.NoError(t, err)
+	require.Equal(t, "a", <-out)
+	_, err = f.WriteString("c\r\n")
+	require.NoError(t, err)
+	require.Equal(t, "bc", <-out)
+	require.NoError(t, f.Close())
+
+	rotated := filepath.Join(dir, "app.log.1")
+	require.NoError(t, os.Rename(path, rotated))
+	require.NoError(t, ioutil.WriteFile(path, []byte("d\n"), 0644))
+	require.Equal(t, "d", <-out)
+
+	close(quit)
+	require.NoError(t, <-done)
+	_, ok := <-out
+	require.False(t, ok)
+}
+
+func TestFollowFileRotationAndTruncation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kt-input")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.jsonl")
+	require.NoError(t, ioutil.WriteFile(path, nil, 0644))
+
+	quit, out, done := make(chan struct{}), make(chan string, 10), make(chan error)
+	go func() { done <- followFile(path, "jsonl", 1024, 100*time.Millisecond, quit, out) }()
+	time.Sleep(50 * time.Millisecond) // until the end of the file is found
+
+	// lines written to the old file right before rotating aren't lost
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"value": "a"}` + "\nnot json\n" + `{"value": "b"}` + "\n")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, os.Rename(path, path+".1"))
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"value": "c"}`+"\n"), 0644))
+	require.Equal(t, `{"value": "a"}`, <-out)
+	require.Equal(t, `{"value": "b"}`, <-out)
+	require.Equal(t, `{"value": "c"}`, <-out)
+
+	// truncated and written again past the offset within a poll
+	time.Sleep(150 * time.Millisecond)
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"value": "ddddddddddddddddddd"}`+"\n"), 0644))
+	require.Equal(t, `{"value": "ddddddddddddddddddd"}`, <-out)
+
+	close(quit)
+	require.NoError(t, <-done)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/chzyer/readline"
+)
+
+const (
+	interactivePrompt     = "> "
+	interactiveContPrompt = "... "
+)
+
+// defaultHistoryFile returns the file that keeps the history of interactive
+// input, or no file when the home directory is unknown.
+func defaultHistoryFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".kt-produce-history")
+}
+
+// incompleteJSON reports whether input starts a JSON object or array that
+// isn't closed yet, so further lines belong to the same message.
+func incompleteJSON(input string) bool {
+	trimmed := strings.TrimSpace(input)
+	if !strings.HasPrefix(trimmed, "{") && !strings.HasPrefix(trimmed, "[") {
+		return false
+	}
+
+	var v interface{}
+	err := json.NewDecoder(strings.NewReader(trimmed)).Decode(&v)
+	return err == io.ErrUnexpectedEOF
+}
+
+// historyEntry returns input on a single line, as the history file keeps an
+// entry per line.
+func historyEntry(input string) string {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, []byte(input)); err == nil {
+		return buf.String()
+	}
+	return strings.Replace(input, "\n", " ", -1)
+}
+
+// readInteractiveLines reads messages with line editing and history until
+// EOF or interrupt, and sends them to out. JSON messages may span multiple
+// lines, they are sent once complete.
+func readInteractiveLines(historyFile string, out chan string) error {
+	rl, err := readline.NewEx(&readline.Config{
+		Prompt:                 interactivePrompt,
+		HistoryFile:            historyFile,
+		DisableAutoSaveHistory: true,
+		InterruptPrompt:        "^C",
+		EOFPrompt:              "exit",
+	})
+	if err != nil {
+		return err
+	}
+	defer rl.Close()
+	defer close(out)
+
+	var pending []string
+	for {
+		l, err := rl.Readline()
+		if err == readline.ErrInterrupt && len(pending) > 0 {
+			pending = nil
+			rl.SetPrompt(interactivePrompt)
+			continue
+		}
+		if err != nil { // EOF or interrupt
+			return nil
+		}
+
+		pending = append(pending, l)
+		input := strings.Join(pending, "\n")
+		if incompleteJSON(input) {
+			rl.SetPrompt(interactiveContPrompt)
+			continue
+		}
+
+		pending = nil
+		rl.SetPrompt(interactivePrompt)
+		if strings.TrimSpace(input) == "" {
+			continue
+		}
+		rl.SaveHistory(historyEntry(input))
+		out <- input
+	}
+}
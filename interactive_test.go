@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIncompleteJSON(t *testing.T) {
+	data := map[string]bool{
+		`{"key": "a",`:                     true,
+		"{\"key\": \"a\",\n\"value\": [1,": true,
+		`[1, 2`:                            true,
+		`{"key": "a"}`:                     false,
+		`{"key": "a"}}`:                    false,
+		`hans`:                             false,
+		`  {`:                              true,
+		``:                                 false,
+	}
+
+	for input, expected := range data {
+		require.Equal(t, expected, incompleteJSON(input), input)
+	}
+}
+
+func TestHistoryEntry(t *testing.T) {
+	require.Equal(t, `{"key":"a","value":"b c"}`, historyEntry("{\"key\": \"a\",\n  \"value\": \"b c\"}"))
+	require.Equal(t, `hans peter`, historyEntry("hans\npeter"))
+}
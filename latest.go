@@ -0,0 +1,69 @@
+package main
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/Shopify/sarama"
+)
+
+type latestMessage struct {
+	msg *sarama.ConsumerMessage
+	hwm int64
+}
+
+// latestMessages keeps the latest message per topic and key.
+type latestMessages struct {
+	sync.Mutex
+	byKey map[string]map[string]latestMessage
+}
+
+// add replaces the message stored for msg's key with msg, or removes it when
+// msg is a tombstone. Messages without key are ignored.
+func (l *latestMessages) add(msg *sarama.ConsumerMessage, hwm int64) {
+	if msg.Key == nil {
+		return
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	if l.byKey == nil {
+		l.byKey = map[string]map[string]latestMessage{}
+	}
+	if l.byKey[msg.Topic] == nil {
+		l.byKey[msg.Topic] = map[string]latestMessage{}
+	}
+
+	if msg.Value == nil {
+		delete(l.byKey[msg.Topic], string(msg.Key))
+		return
+	}
+	l.byKey[msg.Topic][string(msg.Key)] = latestMessage{msg: msg, hwm: hwm}
+}
+
+// sorted returns the stored messages ordered by topic, partition and offset.
+func (l *latestMessages) sorted() []latestMessage {
+	l.Lock()
+	defer l.Unlock()
+
+	res := []latestMessage{}
+	for _, ms := range l.byKey {
+		for _, m := range ms {
+			res = append(res, m)
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		a, b := res[i].msg, res[j].msg
+		if a.Topic != b.Topic {
+			return a.Topic < b.Topic
+		}
+		if a.Partition != b.Partition {
+			return a.Partition < b.Partition
+		}
+		return a.Offset < b.Offset
+	})
+
+	return res
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatestMessages(t *testing.T) {
+	target := &latestMessages{}
+	for _, m := range []*sarama.ConsumerMessage{
+		{Topic: "hans", Partition: 1, Offset: 1, Key: []byte("a"), Value: []byte("1")},
+		{Topic: "hans", Partition: 0, Offset: 1, Key: []byte("b"), Value: []byte("1")},
+		{Topic: "hans", Partition: 0, Offset: 2, Key: []byte("c"), Value: []byte("1")},
+		{Topic: "hans", Partition: 1, Offset: 2, Key: []byte("a"), Value: []byte("2")},
+		{Topic: "hans", Partition: 0, Offset: 3, Key: []byte("c")},
+		{Topic: "hans", Partition: 0, Offset: 4, Value: []byte("no key")},
+		{Topic: "gretel", Partition: 2, Offset: 1, Key: []byte("a"), Value: []byte("1")},
+	} {
+		target.add(m, 0)
+	}
+
+	actual := []string{}
+	for _, l := range target.sorted() {
+		actual = append(actual, l.msg.Topic+"/"+string(l.msg.Key)+"="+string(l.msg.Value))
+	}
+	require.Equal(t, []string{"gretel/a=1", "hans/b=1", "hans/a=2"}, actual)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+type mergedMessage struct {
+	latestMessage
+	received time.Time
+}
+
+type mergeHeap []mergedMessage
+
+func (h mergeHeap) Len() int      { return len(h) }
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h mergeHeap) Less(i, j int) bool {
+	a, b := h[i].msg, h[j].msg
+	if !a.Timestamp.Equal(b.Timestamp) {
+		return a.Timestamp.Before(b.Timestamp)
+	}
+	if a.Topic != b.Topic {
+		return a.Topic < b.Topic
+	}
+	if a.Partition != b.Partition {
+		return a.Partition < b.Partition
+	}
+	return a.Offset < b.Offset
+}
+
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(mergedMessage)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// mergedMessages buffers messages of all partitions to release them ordered
+// by timestamp.
+type mergedMessages struct {
+	sync.Mutex
+	window time.Duration
+	buf    mergeHeap
+}
+
+func (m *mergedMessages) add(msg *sarama.ConsumerMessage, hwm int64, now time.Time) {
+	m.Lock()
+	defer m.Unlock()
+
+	heap.Push(&m.buf, mergedMessage{latestMessage: latestMessage{msg: msg, hwm: hwm}, received: now})
+}
+
+// release removes and returns the buffered messages in timestamp order for as
+// long as the earliest one was received at least the merge window before now.
+// The zero time releases all messages.
+func (m *mergedMessages) release(now time.Time) []latestMessage {
+	m.Lock()
+	defer m.Unlock()
+
+	res := []latestMessage{}
+	for len(m.buf) > 0 && (now.IsZero() || !m.buf[0].received.Add(m.window).After(now)) {
+		res = append(res, heap.Pop(&m.buf).(mergedMessage).latestMessage)
+	}
+
+	return res
+}
+
+// writeMerged periodically writes the messages that are due until done is
+// closed.
+func (cmd *consumeCmd) writeMerged(out chan printContext, done <-chan struct{}) {
+	interval := cmd.merge.window / 10
+	if interval <= 0 || interval > 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, l := range cmd.merge.release(now) {
+				cmd.write(out, l.msg, l.hwm)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (cmd *consumeCmd) writeAllMerged(out chan printContext) {
+	for _, l := range cmd.merge.release(time.Time{}) {
+		cmd.write(out, l.msg, l.hwm)
+	}
+}
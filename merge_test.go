@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergedMessages(t *testing.T) {
+	now := time.Now()
+	ts := func(s int64) time.Time { return time.Unix(1500000000+s, 0) }
+	target := &mergedMessages{window: time.Second}
+	target.add(&sarama.ConsumerMessage{Partition: 0, Offset: 1, Timestamp: ts(3)}, 0, now)
+	target.add(&sarama.ConsumerMessage{Partition: 1, Offset: 1, Timestamp: ts(1)}, 0, now)
+	target.add(&sarama.ConsumerMessage{Partition: 0, Offset: 2, Timestamp: ts(4)}, 0, now)
+	target.add(&sarama.ConsumerMessage{Partition: 2, Offset: 1, Timestamp: ts(1)}, 0, now.Add(time.Second))
+	target.add(&sarama.ConsumerMessage{Partition: 1, Offset: 2, Timestamp: ts(2)}, 0, now.Add(time.Second))
+
+	offsets := func(ls []latestMessage) [][2]int64 {
+		res := [][2]int64{}
+		for _, l := range ls {
+			res = append(res, [2]int64{int64(l.msg.Partition), l.msg.Offset})
+		}
+		return res
+	}
+
+	require.Empty(t, target.release(now))
+	// partition 2's message was received later so it holds back the rest.
+	require.Equal(t, [][2]int64{{1, 1}}, offsets(target.release(now.Add(time.Second))))
+	require.Equal(t, [][2]int64{{2, 1}, {1, 2}, {0, 1}, {0, 2}}, offsets(target.release(now.Add(2*time.Second))))
+
+	target.add(&sarama.ConsumerMessage{Partition: 0, Offset: 3, Timestamp: ts(5)}, 0, now)
+	require.Equal(t, [][2]int64{{0, 3}}, offsets(target.release(time.Time{})))
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// pacer delays messages so that they are printed with the time between their
+// timestamps, divided by speed.
+type pacer struct {
+	sync.Mutex
+	speed float64
+	start time.Time
+	first time.Time
+}
+
+// delay returns how long to wait at now before printing a message with
+// timestamp ts. The first message is printed immediately and anchors the
+// following ones, messages that are already due are not delayed.
+func (p *pacer) delay(ts, now time.Time) time.Duration {
+	if ts.IsZero() {
+		return 0
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	if p.start.IsZero() {
+		p.start, p.first = now, ts
+		return 0
+	}
+
+	due := p.start.Add(time.Duration(float64(ts.Sub(p.first)) / p.speed))
+	if d := due.Sub(now); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// wait blocks until a message with timestamp ts is due, or until quit is
+// closed.
+func (p *pacer) wait(ts time.Time, quit <-chan struct{}) {
+	d := p.delay(ts, time.Now())
+	if d <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-quit:
+	}
+}
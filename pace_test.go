@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPacerDelay(t *testing.T) {
+	ts := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	data := []struct {
+		speed    float64
+		ts       time.Time
+		now      time.Time
+		expected time.Duration
+	}{
+		{speed: 1, ts: ts, now: now, expected: 0},
+		{speed: 1, ts: ts.Add(time.Second), now: now, expected: time.Second},
+		{speed: 1, ts: ts.Add(time.Second), now: now.Add(300 * time.Millisecond), expected: 700 * time.Millisecond},
+		{speed: 1, ts: ts.Add(time.Second), now: now.Add(2 * time.Second), expected: 0},
+		{speed: 1, ts: ts.Add(-time.Second), now: now, expected: 0},
+		{speed: 1, ts: time.Time{}, now: now, expected: 0},
+		{speed: 10, ts: ts.Add(time.Minute), now: now, expected: 6 * time.Second},
+		{speed: 0.5, ts: ts.Add(time.Second), now: now, expected: 2 * time.Second},
+	}
+
+	for _, d := range data {
+		p := &pacer{speed: d.speed}
+		require.Equal(t, time.Duration(0), p.delay(ts, now))
+		require.Equal(t, d.expected, p.delay(d.ts, d.now), "speed %v ts %v now %v", d.speed, d.ts, d.now)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+)
+
+// pauseGate holds back output while consumption is paused.
+type pauseGate struct {
+	sync.Mutex
+	resumed chan struct{}
+}
+
+func (g *pauseGate) pause() {
+	g.Lock()
+	defer g.Unlock()
+	if g.resumed == nil {
+		g.resumed = make(chan struct{})
+	}
+}
+
+func (g *pauseGate) resume() {
+	g.Lock()
+	defer g.Unlock()
+	if g.resumed != nil {
+		close(g.resumed)
+		g.resumed = nil
+	}
+}
+
+func (g *pauseGate) paused() bool {
+	g.Lock()
+	defer g.Unlock()
+	return g.resumed != nil
+}
+
+// wait blocks while paused, or until quit is closed.
+func (g *pauseGate) wait(quit <-chan struct{}) {
+	g.Lock()
+	resumed := g.resumed
+	g.Unlock()
+
+	if resumed != nil {
+		select {
+		case <-resumed:
+		case <-quit:
+		}
+	}
+}
+
+// pausable is implemented by sarama's consumer and consumer group.
+type pausable interface {
+	PauseAll()
+	ResumeAll()
+}
+
+// listenForPause pauses fetching and printing of messages on pauseSignal and
+// resumes on resumeSignal until consumption is stopped.
+func (cmd *consumeCmd) listenForPause(p pausable) {
+	if pauseSignal == nil {
+		return
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, pauseSignal, resumeSignal)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case sig := <-signals:
+			if sig == pauseSignal {
+				fmt.Fprintf(os.Stderr, "received signal %s, pausing\n", sig)
+				p.PauseAll()
+				cmd.pause.pause()
+			} else {
+				fmt.Fprintf(os.Stderr, "received signal %s, resuming\n", sig)
+				cmd.pause.resume()
+				p.ResumeAll()
+			}
+		case <-cmd.quit:
+			return
+		}
+	}
+}
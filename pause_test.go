@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPauseGate(t *testing.T) {
+	var g pauseGate
+	quit := make(chan struct{})
+	g.wait(quit)
+	require.False(t, g.paused())
+
+	g.pause()
+	g.pause()
+	require.True(t, g.paused())
+
+	done := make(chan struct{})
+	go func() { g.wait(quit); close(done) }()
+	select {
+	case <-done:
+		t.Fatal("wait returned while paused")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	g.resume()
+	<-done
+	require.False(t, g.paused())
+	g.resume()
+
+	g.pause()
+	close(quit)
+	g.wait(quit)
+}
@@ -0,0 +1,6 @@
+package main
+
+import "os"
+
+// pauseSignal and resumeSignal are not available on Windows.
+var pauseSignal, resumeSignal os.Signal
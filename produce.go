@@ -1,40 +1,145 @@
 package main
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"math/rand"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
 	"github.com/Shopify/sarama"
+	"github.com/santhosh-tekuri/jsonschema/v5"
 )
 
 type produceArgs struct {
-	topic       string
-	partition   int
-	brokers     string
-	batch       int
-	timeout     time.Duration
-	verbose     bool
-	pretty      bool
-	compression string
-	literal     bool
-	decodeKey   string
-	decodeValue string
-	partitioner string
-	bufferSize  int
-	conn        connectionArgs
+	topic          string
+	partition      int
+	broadcast      bool
+	remapParts     bool
+	brokers        string
+	batch          int
+	timeout        time.Duration
+	batchBytes     int
+	linger         time.Duration
+	maxInFlight    int
+	sync           bool
+	acks           string
+	retries        int
+	retryBackoff   time.Duration
+	requestTimeout time.Duration
+	idempotent     bool
+	keyField       string
+	validate       string
+	generate       string
+	count          string
+	bench          bool
+	size           string
+	repeat         int
+	loop           bool
+	interactive    bool
+	history        string
+	deliveries     bool
+	batchStats     bool
+	dryRun         bool
+	verbose        bool
+	pretty         bool
+	compression    string
+	literal        bool
+	tombstone      bool
+	decodeKey      string
+	decodeValue    string
+	partitioner    string
+	nullKeys       string
+	bufferSize     int
+	maxMsgBytes    int
+	headers        stringsFlag
+	valueCodec     string
+	registry       string
+	subject        string
+	schemaVersion  string
+	valueSchema    string
+	autoRegister   bool
+	subjectStrat   string
+	checkCompat    bool
+	file           string
+	follow         bool
+	fromTopic      string
+	keyFile        string
+	valueFile      string
+	failedOut      string
+	fileFormat     string
+	decompress     string
+	input          string
+	keyColumn      int
+	valueColumns   string
+	framing        string
+	rate           string
+	paceByTs       bool
+	speed          float64
+	maxByteRate    string
+	conn           connectionArgs
 }
 
 type message struct {
-	Key       *string `json:"key"`
-	Value     *string `json:"value"`
-	Partition *int32  `json:"partition"`
+	Key       *string           `json:"key"`
+	Value     *string           `json:"value"`
+	Partition *int32            `json:"partition"`
+	Headers   map[string]string `json:"headers"`
+	Timestamp *messageTimestamp `json:"timestamp"`
+	Topic     *string           `json:"topic"`
+
+	// as printed by consume, the encodings override -decodekey and
+	// -decodevalue, and the offset marks consumed messages.
+	KeyEncoding   string `json:"keyEncoding,omitempty"`
+	ValueEncoding string `json:"valueEncoding,omitempty"`
+	Offset        *int64 `json:"offset,omitempty"`
+
+	line int // position in the input, for errors
+}
+
+// keyEncoding returns the encoding of the key of msg.
+func (cmd *produceCmd) keyEncoding(msg message) string {
+	if msg.KeyEncoding != "" {
+		return msg.KeyEncoding
+	}
+	return cmd.decodeKey
+}
+
+// valueEncoding returns the encoding of the value of msg.
+func (cmd *produceCmd) valueEncoding(msg message) string {
+	if msg.ValueEncoding != "" {
+		return msg.ValueEncoding
+	}
+	return cmd.decodeValue
+}
+
+// isEnvelope reports whether l is a JSON object with an offset or partition,
+// i.e. meant as message rather than as value.
+func isEnvelope(l string) bool {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(l), &fields); err != nil {
+		return false
+	}
+	_, offset := fields["offset"]
+	_, partition := fields["partition"]
+	return offset || partition
+}
+
+func supportedEncoding(encoding string) bool {
+	return encoding == "" || encoding == "string" || encoding == "hex" || encoding == "base64"
 }
 
 func (cmd *produceCmd) read(as []string) produceArgs {
@@ -42,17 +147,71 @@ func (cmd *produceCmd) read(as []string) produceArgs {
 	flags := flag.NewFlagSet("produce", flag.ExitOnError)
 	flags.StringVar(&args.topic, "topic", "", "Topic to produce to (required).")
 	flags.IntVar(&args.partition, "partition", 0, "Partition to produce to (defaults to 0).")
+	flags.BoolVar(&args.broadcast, "broadcast", false, "Produce every message to all partitions of its topic, e.g. for control messages to partition-pinned consumers.")
+	flags.BoolVar(&args.remapParts, "remap-partitions", false, "Choose partitions with -partitioner for messages whose partition the topic doesn't have, rather than failing.")
 	flags.StringVar(&args.brokers, "brokers", "", "Comma separated list of brokers. Port defaults to 9092 when omitted (defaults to localhost:9092).")
 	flags.IntVar(&args.batch, "batch", 1, "Max size of a batch before sending it off")
 	flags.DurationVar(&args.timeout, "timeout", 50*time.Millisecond, "Duration to wait for batch to be filled before sending it off")
+	flags.IntVar(&args.batchBytes, "batch-bytes", 0, "Max size of the keys and values of a batch in bytes before sending it off (defaults to unlimited).")
+	flags.DurationVar(&args.linger, "linger", 0, "Max duration a message waits in a batch before sending it off, regardless of timeout (defaults to unlimited).")
+	flags.BoolVar(&args.deliveries, "delivery-reports", false, "Print a report per produced message rather than per partition, and a summary to stderr when done.")
+	flags.BoolVar(&args.batchStats, "batch-stats", false, "Print statistics of the requests and batches sent to stderr when done, to tune the batching flags.")
+	flags.BoolVar(&args.dryRun, "dry-run", false, "Print the messages with the partitions they would be sent to rather than producing them.")
+	flags.IntVar(&args.retries, "retries", 3, "Number of times to retry sending a batch after retriable errors like leader elections.")
+	flags.DurationVar(&args.retryBackoff, "retry-backoff", 100*time.Millisecond, "Backoff before the first retry, doubling with every retry.")
+	flags.DurationVar(&args.requestTimeout, "request-timeout", 10*time.Second, "Duration that brokers wait for the acknowledgements required by -acks.")
+	flags.StringVar(&args.acks, "acks", "all", "Acknowledgements required from the brokers (0|1|all): 0 doesn't wait for the leader, 1 waits for the leader, all for all in-sync replicas.")
+	flags.BoolVar(&args.idempotent, "idempotent", false, "Enable idempotent produce so that the brokers discard duplicates of batches that are sent again, requires acks all.")
+	flags.IntVar(&args.maxInFlight, "max-in-flight", 1, "Max number of batches sent at the same time, more than one may reorder messages on errors.")
+	flags.BoolVar(&args.sync, "sync", false, "Send each message on its own and wait for its acknowledgement before sending the next, rather than batching messages.")
 	flags.BoolVar(&args.verbose, "verbose", false, "Verbose output")
 	flags.BoolVar(&args.pretty, "pretty", true, "Control output pretty printing.")
 	flags.BoolVar(&args.literal, "literal", false, "Interpret stdin line literally and pass it as value, key as null.")
-	flags.StringVar(&args.compression, "compression", "", "Kafka message compression codec [gzip|snappy|lz4] (defaults to none)")
-	flags.StringVar(&args.partitioner, "partitioner", "", "Optional partitioner to use. Available: hashCode")
-	flags.StringVar(&args.decodeKey, "decodekey", "string", "Decode message value as (string|hex|base64), defaults to string.")
+	flags.BoolVar(&args.tombstone, "tombstone", false, "Interpret stdin line literally and pass it as key, value as null, to delete the key from compacted topics.")
+	flags.StringVar(&args.compression, "compression", "", "Kafka message compression codec [none|gzip|snappy|lz4|zstd] (defaults to none)")
+	flags.StringVar(&args.partitioner, "partitioner", "", "Optional partitioner to use. Available: manual, default (alias murmur2_random), jvm (alias hashCode), murmur2, random, roundrobin (defaults to manual).")
+	flags.StringVar(&args.nullKeys, "null-keys", "", "Partitions for messages without key with the hashing partitioners (partition|random|roundrobin): -partition, a random partition or the partitions in turn (defaults to random for the default partitioner, partition otherwise).")
+	flags.StringVar(&args.decodeKey, "decodekey", "string", "Decode message key as (string|hex|base64), defaults to string.")
+	flags.StringVar(&args.decodeKey, "key-decode", "string", "Alias for decodekey.")
 	flags.StringVar(&args.decodeValue, "decodevalue", "string", "Decode message value as (string|hex|base64), defaults to string.")
+	flags.StringVar(&args.decodeValue, "value-decode", "string", "Alias for decodevalue.")
+	flags.IntVar(&args.maxMsgBytes, "max-message-bytes", 0, "Max size of a message's key, value and headers in bytes, larger messages fail (defaults to 0 for unlimited).")
 	flags.IntVar(&args.bufferSize, "buffersize", 16777216, "Buffer size for scanning stdin, defaults to 16777216=16*1024*1024.")
+	flags.Var(&args.headers, "header", "Header key=value to add to every message. Can be repeated.")
+	flags.StringVar(&args.generate, "generate", "", "Generate messages from this template rather than reading input, see below.")
+	flags.StringVar(&args.count, "count", "", "Number of messages to generate, e.g. 1000 or 1M (defaults to unlimited).")
+	flags.BoolVar(&args.bench, "bench", false, "Produce generated values of -size bytes and print a report of throughput and latencies rather than results, see below.")
+	flags.StringVar(&args.size, "size", "100B", "Size of the values produced with -bench, e.g. 512B, 1KB or 1MB.")
+	flags.IntVar(&args.repeat, "repeat", 1, "Number of times to produce the input.")
+	flags.BoolVar(&args.loop, "loop", false, "Produce the input over and over until interrupted.")
+	flags.BoolVar(&args.interactive, "interactive", false, "Read input interactively with line editing and history.")
+	flags.StringVar(&args.history, "history", defaultHistoryFile(), "File to keep the history of interactive input in, empty to disable.")
+	flags.StringVar(&args.file, "file", "", "Read input from this file rather than stdin.")
+	flags.BoolVar(&args.follow, "follow", false, "Keep reading lines appended to -file like tail -f, until interrupted.")
+	flags.StringVar(&args.decompress, "decompress", "auto", "Decompress the input (auto|none|gzip|zstd), auto detects gzip and zstd files but leaves stdin as is.")
+	flags.StringVar(&args.fromTopic, "from-topic", "", "Copy the messages of this topic on the same cluster rather than reading input, see below.")
+	flags.StringVar(&args.keyFile, "key-file", "", "Read keys from this file, a key per line, paired with the lines of -value-file.")
+	flags.StringVar(&args.valueFile, "value-file", "", "Read values from this file, a value per line, paired with the lines of -key-file.")
+	flags.StringVar(&args.failedOut, "failed-out", "", "Write messages that fail to produce to this file with the error and keep going, rather than stopping at the first failure.")
+	flags.StringVar(&args.fileFormat, "file-format", "", "Format of the input file (jsonl|json|text), defaults to json for .json files and jsonl otherwise.")
+	flags.StringVar(&args.input, "input", "json", "Format of the input (json|csv|binary): JSON messages or lines, CSV records with a header row, or binary values, see below.")
+	flags.IntVar(&args.keyColumn, "key-column", -1, "Zero based index of the CSV column to use as key (defaults to null keys).")
+	flags.StringVar(&args.valueColumns, "value-columns", "", "CSV columns to assemble the JSON value from, e.g. 1-5 or 1,3,4 (defaults to all but the key column).")
+	flags.StringVar(&args.framing, "framing", "", "Framing of binary input (length|nul): a 4 byte big endian length before each value, or a NUL byte after each value (defaults to length).")
+	flags.StringVar(&args.validate, "validate", "", "JSON Schema file to validate message values against, invalid messages are skipped.")
+	flags.StringVar(&args.keyField, "key-field", "", "Dot separated path of a field in JSON values to use as key for messages without key, e.g. user.id.")
+	flags.StringVar(&args.rate, "rate", "", "Maximum rate of messages to produce, e.g. 500/s, 100/m or 1000/h (defaults to unlimited).")
+	flags.BoolVar(&args.paceByTs, "pace-by-timestamp", false, "Produce messages with the time between their timestamps, divided by -speed, to replay them as they arrived.")
+	flags.Float64Var(&args.speed, "speed", 1, "Speed factor of -pace-by-timestamp, e.g. 10 for 10x faster than the original spacing.")
+	flags.StringVar(&args.maxByteRate, "max-bytes-per-sec", "", "Maximum bytes of keys and values to produce per second, e.g. 512KB or 10MB (defaults to unlimited).")
+	flags.StringVar(&args.valueCodec, "value-codec", "", "Encode message value with (avro), requires registry.")
+	flags.StringVar(&args.registry, "registry", "", "URL of a Schema Registry to look up the schema to encode values with.")
+	flags.StringVar(&args.subject, "subject", "", "Subject of the schema to encode values with (defaults to the topic name followed by -value).")
+	flags.StringVar(&args.schemaVersion, "schema-version", "latest", "Version of the subject's schema to encode values with.")
+	flags.StringVar(&args.valueSchema, "value-schema", "", "File with the Avro schema to encode values with, which has to be registered under the subject unless -auto-register is given.")
+	flags.BoolVar(&args.autoRegister, "auto-register", false, "Register -value-schema under the subject if it isn't registered yet.")
+	flags.StringVar(&args.subjectStrat, "subject-strategy", "topic", "Naming strategy of the subject (topic|record|topic-record): topic-value, the record's full name, or topic-record.")
+	flags.BoolVar(&args.checkCompat, "check-compatibility", false, "Fail unless -value-schema is compatible with the latest schema of the subject.")
 	parseConnectionFlags(flags, &args.conn)
 
 	flags.Usage = func() {
@@ -110,21 +269,472 @@ func (cmd *produceCmd) parseArgs(as []string) {
 	cmd.decodeValue = args.decodeValue
 
 	if args.decodeKey != "string" && args.decodeKey != "hex" && args.decodeKey != "base64" {
-		cmd.failStartup(fmt.Sprintf(`unsupported decodekey argument %#v, only string, hex and base64 are supported.`, args.decodeValue))
+		cmd.failStartup(fmt.Sprintf(`unsupported decodekey argument %#v, only string, hex and base64 are supported.`, args.decodeKey))
 		return
 	}
 	cmd.decodeKey = args.decodeKey
 
 	cmd.batch = args.batch
 	cmd.timeout = args.timeout
+
+	if args.batchBytes < 0 {
+		cmd.failStartup("batch-bytes must not be negative.")
+	}
+	cmd.batchBytes = args.batchBytes
+
+	if args.linger < 0 {
+		cmd.failStartup("linger must not be negative.")
+	}
+	cmd.linger = args.linger
+
+	if args.maxInFlight < 1 {
+		cmd.failStartup("max-in-flight must be at least 1.")
+	}
+	cmd.maxInFlight = args.maxInFlight
 	cmd.verbose = args.verbose
 	cmd.pretty = args.pretty
 	cmd.literal = args.literal
+	cmd.deliveries = args.deliveries
+	cmd.dryRun = args.dryRun
+	if args.batchStats {
+		if args.dryRun {
+			cmd.failStartup("batch-stats cannot be combined with dry-run.")
+		}
+		cmd.requestStats = &requestStats{}
+	}
+	cmd.failedPath = args.failedOut
+	if args.tombstone && args.literal {
+		cmd.failStartup("tombstone cannot be combined with literal.")
+	}
+	cmd.tombstone = args.tombstone
 	cmd.partition = int32(args.partition)
-	cmd.partitioner = args.partitioner
+	cmd.remapParts = args.remapParts
+	if args.broadcast && (args.partitioner != "" || args.nullKeys != "" || args.remapParts) {
+		cmd.failStartup("broadcast cannot be combined with partitioner, null-keys or remap-partitions.")
+	}
+	cmd.broadcast = args.broadcast
+	switch args.partitioner {
+	case "", "manual":
+		cmd.partitioner = "manual"
+	case "jvm", "hashCode":
+		cmd.partitioner = "hashCode"
+	case "default", "murmur2_random":
+		cmd.partitioner = "default"
+	case "murmur2", "random", "roundrobin":
+		cmd.partitioner = args.partitioner
+	default:
+		cmd.failStartup(fmt.Sprintf(`unsupported partitioner argument %#v, only manual, default, jvm, murmur2, random and roundrobin are supported.`, args.partitioner))
+	}
+	switch args.nullKeys {
+	case "":
+		cmd.nullKeys = "partition"
+		if cmd.partitioner == "default" {
+			cmd.nullKeys = "random"
+		}
+	case "partition", "random", "roundrobin":
+		if cmd.partitioner != "default" && cmd.partitioner != "hashCode" && cmd.partitioner != "murmur2" {
+			cmd.failStartup("null-keys requires partitioner default, jvm or murmur2.")
+		}
+		cmd.nullKeys = args.nullKeys
+	default:
+		cmd.failStartup(fmt.Sprintf(`unsupported null-keys argument %#v, only partition, random and roundrobin are supported.`, args.nullKeys))
+	}
 	cmd.compression = kafkaCompression(args.compression)
 	cmd.bufferSize = args.bufferSize
+	if args.maxMsgBytes < 0 {
+		cmd.failStartup("max-message-bytes must not be negative.")
+	}
+	cmd.maxMsgBytes = args.maxMsgBytes
+
+	if args.keyField != "" {
+		cmd.keyField = strings.Split(args.keyField, ".")
+	}
+
+	if args.validate != "" {
+		var err error
+		if cmd.schema, err = compileSchema(args.validate); err != nil {
+			cmd.failStartup(err.Error() + ".")
+		}
+	}
+
+	if args.repeat < 1 {
+		cmd.failStartup("repeat must be at least 1.")
+	}
+	if args.loop && args.repeat > 1 {
+		cmd.failStartup("loop cannot be combined with repeat.")
+	}
+	cmd.repeat = args.repeat
+	if args.loop {
+		cmd.repeat = 0
+	}
+
+	if args.speed <= 0 {
+		cmd.failStartup("speed has to be a positive number.")
+	}
+	if args.paceByTs {
+		if args.bench || args.generate != "" {
+			cmd.failStartup("pace-by-timestamp cannot be combined with bench or generate.")
+		}
+		cmd.pace = &pacer{speed: args.speed}
+	} else if args.speed != 1 {
+		cmd.failStartup("speed requires pace-by-timestamp.")
+	}
+
+	if args.rate != "" {
+		interval, err := parseRate(args.rate)
+		if err != nil {
+			cmd.failStartup(err.Error() + ".")
+		}
+		cmd.rate = &rateLimiter{interval: interval}
+	}
+	if args.maxByteRate != "" {
+		perSecond, err := parseByteRate(args.maxByteRate)
+		if err != nil {
+			cmd.failStartup(err.Error() + ".")
+		}
+		cmd.byteRate = &byteRateLimiter{perSecond: perSecond}
+	}
+
+	if args.interactive {
+		if args.file != "" || args.generate != "" {
+			cmd.failStartup("interactive cannot be combined with file or generate.")
+		}
+		cmd.interactive = true
+		cmd.history = args.history
+	}
+
+	if args.generate != "" {
+		if args.file != "" {
+			cmd.failStartup("generate cannot be combined with file.")
+		}
+		var err error
+		if cmd.generate, err = parseGenerateTemplate(args.generate); err != nil {
+			cmd.failStartup(fmt.Sprintf("failed to parse generate template err=%v", err))
+		}
+	}
+	if args.count != "" {
+		if args.generate == "" && !args.bench {
+			cmd.failStartup("count requires generate or bench.")
+		}
+		var err error
+		if cmd.count, err = parseCount(args.count); err != nil {
+			cmd.failStartup(err.Error() + ".")
+		}
+	}
+
+	if args.bench {
+		if args.file != "" || args.interactive || args.generate != "" || args.input != "json" {
+			cmd.failStartup("bench cannot be combined with file, interactive, generate or input.")
+		}
+		if args.literal || args.tombstone || args.dryRun || args.deliveries {
+			cmd.failStartup("bench cannot be combined with literal, tombstone, dry-run or delivery-reports.")
+		}
+		size, err := parseSize(args.size)
+		if err != nil {
+			cmd.failStartup(err.Error() + ".")
+		}
+		if cmd.maxMsgBytes > 0 && size > int64(cmd.maxMsgBytes) {
+			cmd.failStartup(fmt.Sprintf("size of %v bytes exceeds max-message-bytes %v, all messages would fail.", size, cmd.maxMsgBytes))
+		}
+		cmd.bench = &benchStats{}
+		cmd.benchSize = int(size)
+	}
+
+	if args.file != "" {
+		var err error
+		if cmd.fileFormat, err = inputFormat(args.file, args.fileFormat); err != nil {
+			cmd.failStartup(err.Error() + ".")
+		}
+		if cmd.fileFormat == "json" && (cmd.literal || cmd.tombstone) {
+			cmd.failStartup("literal and tombstone cannot be combined with json file-format.")
+		}
+		cmd.file = args.file
+		cmd.literal = cmd.literal || (cmd.fileFormat == "text" && !cmd.tombstone)
+	} else if args.fileFormat != "" {
+		cmd.failStartup("file-format requires file.")
+	}
+
+	if args.follow {
+		if args.file == "" || args.input != "json" {
+			cmd.failStartup("follow requires file and input json.")
+		}
+		if cmd.fileFormat == "json" {
+			cmd.failStartup("follow cannot be combined with json file-format.")
+		}
+		if compressedExtension(args.file) != "" || (args.decompress != "auto" && args.decompress != "none") {
+			cmd.failStartup("follow cannot be combined with compressed files.")
+		}
+		if args.repeat > 1 || args.loop {
+			cmd.failStartup("follow cannot be combined with repeat or loop.")
+		}
+		cmd.follow = true
+	}
+
+	if args.input != "binary" && args.framing != "" {
+		cmd.failStartup("framing requires input binary.")
+	}
+	switch args.input {
+	case "", "json":
+		if args.keyColumn >= 0 || args.valueColumns != "" {
+			cmd.failStartup("key-column and value-columns require input csv.")
+		}
+	case "csv":
+		if cmd.literal || cmd.tombstone || cmd.interactive || cmd.generate != nil {
+			cmd.failStartup("input csv cannot be combined with literal, tombstone, interactive or generate.")
+		}
+		if args.fileFormat != "" {
+			cmd.failStartup("input csv cannot be combined with file-format.")
+		}
+		if args.keyColumn < -1 {
+			cmd.failStartup("key-column must not be negative.")
+		}
+		cmd.csv = &csvColumns{keyColumn: args.keyColumn}
+		if args.valueColumns != "" {
+			var err error
+			if cmd.csv.valueColumns, err = parseColumns(args.valueColumns); err != nil {
+				cmd.failStartup(err.Error() + ".")
+			}
+		}
+	case "binary":
+		if cmd.literal || cmd.interactive || cmd.generate != nil {
+			cmd.failStartup("input binary cannot be combined with literal, interactive or generate.")
+		}
+		if args.fileFormat != "" || args.keyColumn >= 0 || args.valueColumns != "" {
+			cmd.failStartup("input binary cannot be combined with file-format, key-column or value-columns.")
+		}
+		switch args.framing {
+		case "", "length":
+			cmd.framing = "length"
+		case "nul":
+			cmd.framing = "nul"
+		default:
+			cmd.failStartup(fmt.Sprintf(`unsupported framing argument %#v, only length and nul are supported.`, args.framing))
+		}
+		cmd.literal = !cmd.tombstone
+	default:
+		cmd.failStartup(fmt.Sprintf(`unsupported input argument %#v, only json, csv and binary are supported.`, args.input))
+	}
+
+	if args.keyFile != "" || args.valueFile != "" {
+		if args.keyFile == "" || args.valueFile == "" {
+			cmd.failStartup("key-file and value-file must be given together.")
+		}
+		if args.file != "" || cmd.interactive || cmd.generate != nil || cmd.bench != nil || args.input != "json" {
+			cmd.failStartup("key-file and value-file cannot be combined with file, interactive, generate, bench or input.")
+		}
+		if cmd.literal || cmd.tombstone {
+			cmd.failStartup("key-file and value-file cannot be combined with literal or tombstone.")
+		}
+		cmd.keyFile, cmd.valueFile = args.keyFile, args.valueFile
+	}
+
+	if args.fromTopic != "" {
+		if args.fromTopic == cmd.topic {
+			cmd.failStartup("from-topic must differ from topic.")
+		}
+		if args.file != "" || args.keyFile != "" || cmd.interactive || cmd.generate != nil || cmd.bench != nil || args.input != "json" {
+			cmd.failStartup("from-topic cannot be combined with file, key-file, interactive, generate, bench or input.")
+		}
+		if cmd.literal || cmd.tombstone {
+			cmd.failStartup("from-topic cannot be combined with literal or tombstone.")
+		}
+		cmd.fromTopic = args.fromTopic
+		cmd.fromParts = args.partitioner == ""
+	}
+
+	switch args.decompress {
+	case "", "auto":
+		cmd.decompress = "auto"
+		if args.file == "" && args.keyFile == "" {
+			cmd.decompress = "none"
+		}
+	case "none", "gzip", "zstd":
+		cmd.decompress = args.decompress
+	default:
+		cmd.failStartup(fmt.Sprintf(`unsupported decompress argument %#v, only auto, none, gzip and zstd are supported.`, args.decompress))
+	}
+	if cmd.decompress != "none" && (cmd.interactive || cmd.generate != nil || cmd.bench != nil) {
+		cmd.failStartup("decompress cannot be combined with interactive, generate or bench.")
+	}
+
+	for _, h := range args.headers {
+		i := strings.Index(h, "=")
+		if i < 0 {
+			cmd.failStartup(fmt.Sprintf(`invalid header %#v, expected key=value.`, h))
+		}
+		key, value := h[:i], h[i+1:]
+		if strings.Contains(value, "{{") {
+			tmpl, err := parseGenerateTemplate(value)
+			if err != nil {
+				cmd.failStartup(fmt.Sprintf("failed to parse template of header %v err=%v", key, err))
+			}
+			if cmd.headerTmpls == nil {
+				cmd.headerTmpls = map[string]*template.Template{}
+			}
+			cmd.headerTmpls[key] = tmpl
+			value = ""
+		}
+		if cmd.headers == nil {
+			cmd.headers = map[string]string{}
+		}
+		cmd.headers[key] = value
+	}
+
+	switch args.valueCodec {
+	case "":
+		if args.registry != "" {
+			cmd.failStartup("registry requires value-codec avro.")
+		}
+		if args.valueSchema != "" || args.autoRegister || args.checkCompat || args.subjectStrat != "topic" {
+			cmd.failStartup("value-schema, auto-register, check-compatibility and subject-strategy require value-codec avro.")
+		}
+	case "avro":
+		if args.registry == "" {
+			cmd.failStartup("value-codec avro requires registry.")
+		}
+		cmd.registry = newSchemaRegistry(args.registry)
+		cmd.schemaVersion = args.schemaVersion
+
+		if args.valueSchema != "" {
+			if args.schemaVersion != "latest" {
+				cmd.failStartup("value-schema cannot be combined with schema-version.")
+			}
+			buf, err := ioutil.ReadFile(args.valueSchema)
+			if err != nil {
+				cmd.failStartup(fmt.Sprintf("failed to read value-schema err=%v", err))
+			}
+			cmd.localSchema = string(buf)
+		} else if args.autoRegister || args.checkCompat {
+			cmd.failStartup("auto-register and check-compatibility require value-schema.")
+		}
+		cmd.autoRegister, cmd.checkCompat = args.autoRegister, args.checkCompat
+
+		var err error
+		if cmd.subject, err = valueSubject(args.subjectStrat, args.subject, cmd.topic, cmd.localSchema); err != nil {
+			cmd.failStartup(err.Error() + ".")
+		}
+	default:
+		cmd.failStartup(fmt.Sprintf(`unsupported value-codec argument %#v, only avro is supported.`, args.valueCodec))
+	}
+
 	cmd.config = saramaConfig(&args.conn, "produce")
+	cmd.config.Producer.RequiredAcks = parseAcks(args.acks)
+
+	if args.retries < 0 {
+		cmd.failStartup("retries must not be negative.")
+	}
+	cmd.retries = args.retries
+	if args.retryBackoff <= 0 {
+		cmd.failStartup("retry-backoff must be positive.")
+	}
+	cmd.retryBackoff = args.retryBackoff
+	if args.requestTimeout < time.Millisecond {
+		cmd.failStartup("request-timeout must be at least 1ms.")
+	}
+	cmd.requestTimeout = args.requestTimeout
+	if cmd.config.Net.ReadTimeout < cmd.requestTimeout+time.Second {
+		cmd.config.Net.ReadTimeout = cmd.requestTimeout + time.Second
+	}
+
+	if args.sync {
+		if args.batch > 1 || args.batchBytes > 0 || args.linger > 0 || args.maxInFlight > 1 {
+			cmd.failStartup("sync cannot be combined with batch, batch-bytes, linger or max-in-flight.")
+		}
+		if cmd.config.Producer.RequiredAcks == sarama.NoResponse {
+			cmd.failStartup("sync requires acks 1 or all.")
+		}
+		cmd.batch, cmd.maxInFlight = 1, 1
+	}
+
+	if args.idempotent {
+		if cmd.config.Producer.RequiredAcks != sarama.WaitForAll {
+			cmd.failStartup("idempotent requires acks all.")
+		}
+		if cmd.maxInFlight > 1 {
+			cmd.failStartup("idempotent cannot be combined with max-in-flight greater than 1.")
+		}
+		if args.failedOut != "" {
+			cmd.failStartup("idempotent cannot be combined with failed-out, as the brokers reject all batches following one that failed.")
+		}
+		cmd.idempotent = true
+	}
+	cmd.autoVersion = args.conn.version == ""
+}
+
+// valueSubject returns the subject of the values' schema, named by strategy
+// unless subject is given. The record strategies name subjects after the
+// record of schema.
+func valueSubject(strategy, subject, topic, schema string) (string, error) {
+	if subject != "" {
+		if strategy != "topic" {
+			return "", fmt.Errorf("subject cannot be combined with subject-strategy")
+		}
+		return subject, nil
+	}
+
+	switch strategy {
+	case "topic":
+		return topic + "-value", nil
+	case "record", "topic-record":
+		if schema == "" {
+			return "", fmt.Errorf("subject-strategy %v requires value-schema", strategy)
+		}
+		name, err := avroRecordName(schema)
+		if err != nil {
+			return "", fmt.Errorf("invalid value-schema, %v", err)
+		}
+		if strategy == "topic-record" {
+			return topic + "-" + name, nil
+		}
+		return name, nil
+	}
+	return "", fmt.Errorf("unsupported subject-strategy %#v, only topic, record and topic-record are supported", strategy)
+}
+
+// valueSchemaID returns the id of the schema to encode values with: the given
+// version of the subject's schema, or the id of -value-schema, which is
+// checked for compatibility and registered according to the flags.
+func (cmd *produceCmd) valueSchemaID() (int32, error) {
+	if cmd.localSchema == "" {
+		return cmd.registry.subjectSchema(cmd.subject, cmd.schemaVersion)
+	}
+
+	if cmd.checkCompat {
+		ok, err := cmd.registry.compatible(cmd.subject, cmd.localSchema)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			return 0, fmt.Errorf("value-schema is incompatible with the latest schema of subject %v", cmd.subject)
+		}
+	}
+	return cmd.registry.registerSchema(cmd.subject, cmd.localSchema, cmd.autoRegister)
+}
+
+// checkVersion fails when the features in use require a newer Kafka version
+// than the one in use.
+func (cmd *produceCmd) checkVersion() {
+	if len(cmd.headers) > 0 && !cmd.recordBatches() {
+		cmd.failStartup("header requires -version v0.11.0.0 or later.")
+	}
+
+	if cmd.compression != sarama.CompressionNone && !cmd.recordBatches() {
+		cmd.failStartup("compression requires -version v0.11.0.0 or later.")
+	}
+
+	if cmd.idempotent && !cmd.recordBatches() {
+		cmd.failStartup("idempotent requires -version v0.11.0.0 or later.")
+	}
+
+	if cmd.compression == sarama.CompressionZSTD && !cmd.config.Version.IsAtLeast(sarama.V2_1_0_0) {
+		cmd.failStartup("zstd compression requires -version v2.1.0.0 or later.")
+	}
+}
+
+// recordBatches reports whether messages are sent as record batches, which
+// support headers, rather than legacy message sets.
+func (cmd *produceCmd) recordBatches() bool {
+	return cmd.config.Version.IsAtLeast(sarama.V0_11_0_0)
 }
 
 func kafkaCompression(codecName string) sarama.CompressionCodec {
@@ -135,24 +745,40 @@ func kafkaCompression(codecName string) sarama.CompressionCodec {
 		return sarama.CompressionSnappy
 	case "lz4":
 		return sarama.CompressionLZ4
-	case "":
+	case "zstd":
+		return sarama.CompressionZSTD
+	case "", "none":
 		return sarama.CompressionNone
 	}
 
-	failf("unsupported compression codec %#v - supported: gzip, snappy, lz4", codecName)
+	failf("unsupported compression codec %#v - supported: none, gzip, snappy, lz4, zstd", codecName)
+	panic("unreachable")
+}
+
+func parseAcks(acks string) sarama.RequiredAcks {
+	switch acks {
+	case "0":
+		return sarama.NoResponse
+	case "1":
+		return sarama.WaitForLocal
+	case "all", "-1":
+		return sarama.WaitForAll
+	}
+
+	failf("unsupported acks %#v - supported: 0, 1, all", acks)
 	panic("unreachable")
 }
 
-func (cmd *produceCmd) findLeaders() {
+// findLeaders returns the leader brokers of the partitions of topic. Leaders
+// shared between topics use the same connection.
+func (cmd *produceCmd) findLeaders(topic string) (map[int32]*sarama.Broker, error) {
 	var (
 		err error
 		res *sarama.MetadataResponse
-		req = sarama.MetadataRequest{Topics: []string{cmd.topic}}
+		req = sarama.MetadataRequest{Topics: []string{topic}}
 		cfg = cmd.config
 	)
 
-	cfg.Producer.RequiredAcks = sarama.WaitForAll
-
 	if cmd.verbose {
 		fmt.Fprintf(os.Stderr, "sarama client configuration %#v\n", cfg)
 	}
@@ -169,7 +795,9 @@ loop:
 			continue loop
 		}
 
-		if res, err = broker.GetMetadata(&req); err != nil {
+		res, err = broker.GetMetadata(&req)
+		broker.Close()
+		if err != nil {
 			fmt.Fprintf(os.Stderr, "Failed to get metadata from %#v. err=%v\n", addr, err)
 			continue loop
 		}
@@ -180,63 +808,217 @@ loop:
 		}
 
 		for _, tm := range res.Topics {
-			if tm.Name == cmd.topic {
+			if tm.Name == topic {
 				if tm.Err != sarama.ErrNoError {
 					fmt.Fprintf(os.Stderr, "Failed to get metadata from %#v. err=%v\n", addr, tm.Err)
 					continue loop
 				}
 
-				cmd.leaders = map[int32]*sarama.Broker{}
+				leaders := map[int32]*sarama.Broker{}
 				for _, pm := range tm.Partitions {
-					b, ok := brokers[pm.Leader]
+					b, ok := cmd.brokerConns[pm.Leader]
 					if !ok {
-						failf("failed to find leader in broker response, giving up")
+						if b, ok = brokers[pm.Leader]; !ok {
+							return nil, fmt.Errorf("failed to find leader in broker response, giving up")
+						}
+
+						if err = b.Open(cfg); err != nil && err != sarama.ErrAlreadyConnected {
+							return nil, fmt.Errorf("failed to open broker connection err=%s", err)
+						}
+						if connected, err := b.Connected(); !connected && err != nil {
+							return nil, fmt.Errorf("failed to wait for broker connection to open err=%s", err)
+						}
+						cmd.brokerConns[pm.Leader] = b
 					}
 
-					if err = b.Open(cfg); err != nil && err != sarama.ErrAlreadyConnected {
-						failf("failed to open broker connection err=%s", err)
-					}
-					if connected, err := broker.Connected(); !connected && err != nil {
-						failf("failed to wait for broker connection to open err=%s", err)
-					}
-
-					cmd.leaders[pm.ID] = b
+					leaders[pm.ID] = b
 				}
-				return
+				return leaders, nil
 			}
 		}
 	}
 
-	failf("failed to find leader for given topic")
+	return nil, fmt.Errorf("failed to find leader for topic %v", topic)
+}
+
+// topicLeaders returns the leaders of topic, which are only requested once per
+// topic.
+func (cmd *produceCmd) topicLeaders(topic string) (map[int32]*sarama.Broker, error) {
+	cmd.leadersMu.Lock()
+	defer cmd.leadersMu.Unlock()
+
+	if leaders, ok := cmd.leaders[topic]; ok {
+		return leaders, nil
+	}
+
+	if cmd.leaders == nil {
+		cmd.leaders = map[string]map[int32]*sarama.Broker{}
+		cmd.brokerConns = map[int32]*sarama.Broker{}
+	}
+	leaders, err := cmd.findLeaders(topic)
+	if err != nil {
+		return nil, err
+	}
+	cmd.leaders[topic] = leaders
+	return leaders, nil
+}
+
+// refreshLeaders requests the leaders of topic again, e.g. after a leader
+// election.
+func (cmd *produceCmd) refreshLeaders(topic string) error {
+	cmd.leadersMu.Lock()
+	defer cmd.leadersMu.Unlock()
+
+	leaders, err := cmd.findLeaders(topic)
+	if err != nil {
+		return err
+	}
+	cmd.leaders[topic] = leaders
+	return nil
+}
+
+// messageTopic returns the topic of msg, which defaults to -topic.
+func (cmd *produceCmd) messageTopic(msg message) string {
+	if msg.Topic != nil && *msg.Topic != "" {
+		return *msg.Topic
+	}
+	return cmd.topic
 }
 
 type produceCmd struct {
-	topic       string
-	brokers     []string
-	batch       int
-	timeout     time.Duration
-	verbose     bool
-	pretty      bool
-	literal     bool
-	partition   int32
-	config      *sarama.Config
-	compression sarama.CompressionCodec
-	partitioner string
-	decodeKey   string
-	decodeValue string
-	bufferSize  int
-
-	leaders map[int32]*sarama.Broker
+	// accessed atomically, first to be 64-bit aligned
+	sent      int64
+	delivered int64
+	skipped   int64
+	headerSeq int64
+
+	topic          string
+	brokers        []string
+	batch          int
+	timeout        time.Duration
+	batchBytes     int
+	linger         time.Duration
+	maxInFlight    int
+	retries        int
+	retryBackoff   time.Duration
+	requestTimeout time.Duration
+	idempotent     bool
+	producerID     int64
+	producerEpoch  int16
+	sequences      map[string]map[int32]int32
+	nextPartition  int32
+	keyField       []string
+	schema         *jsonschema.Schema
+	generate       *template.Template
+	count          int64
+	bench          *benchStats
+	requestStats   *requestStats
+	benchSize      int
+	repeat         int
+	interactive    bool
+	history        string
+	verbose        bool
+	pretty         bool
+	literal        bool
+	tombstone      bool
+	deliveries     bool
+	dryRun         bool
+	partition      int32
+	broadcast      bool
+	remapParts     bool
+	config         *sarama.Config
+	compression    sarama.CompressionCodec
+	partitioner    string
+	nullKeys       string
+	decodeKey      string
+	decodeValue    string
+	bufferSize     int
+	maxMsgBytes    int
+	headers        map[string]string
+	headerTmpls    map[string]*template.Template
+	autoVersion    bool
+	registry       *schemaRegistry
+	subject        string
+	schemaVersion  string
+	localSchema    string
+	autoRegister   bool
+	checkCompat    bool
+	valueSchema    int32
+	file           string
+	follow         bool
+	fromTopic      string
+	fromParts      bool
+	keyFile        string
+	valueFile      string
+	failedPath     string
+	failedOut      *failedWriter
+	fileFormat     string
+	decompress     string
+	csv            *csvColumns
+	framing        string
+	rate           *rateLimiter
+	pace           *pacer
+	byteRate       *byteRateLimiter
+
+	leadersMu   sync.Mutex
+	leaders     map[string]map[int32]*sarama.Broker
+	brokerConns map[int32]*sarama.Broker
 }
 
 func (cmd *produceCmd) run(as []string) {
+	var failed int64
+	defer func() { // after the deferred cleanup
+		if failed > 0 {
+			os.Exit(1)
+		}
+	}()
+
 	cmd.parseArgs(as)
 	if cmd.verbose {
 		sarama.Logger = log.New(os.Stderr, "", log.LstdFlags)
+		fmt.Fprintf(os.Stderr, "Partitioning with %v, messages without key: %v.\n", cmd.partitioner, cmd.nullKeys)
+	}
+
+	if cmd.autoVersion {
+		if v, err := detectKafkaVersion(cmd.brokers, cmd.config); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to detect kafka version, falling back to %v err=%v\n", cmd.config.Version, err)
+		} else {
+			cmd.config.Version = v
+		}
+	}
+	cmd.checkVersion()
+
+	if cmd.registry != nil {
+		id, err := cmd.valueSchemaID()
+		if err != nil {
+			failf("%v", err)
+		}
+		cmd.valueSchema = id
+	}
+
+	if cmd.failedPath != "" && !cmd.dryRun {
+		fw, err := newFailedWriter(cmd.failedPath)
+		if err != nil {
+			failf("%v", err)
+		}
+		cmd.failedOut = fw
+		defer func() {
+			if err := cmd.failedOut.close(); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to close failed-out file. err=%v\n", err)
+			}
+		}()
 	}
 
 	defer cmd.close()
-	cmd.findLeaders()
+	leaders, err := cmd.topicLeaders(cmd.topic)
+	if err != nil {
+		failf("%v", err)
+	}
+	if cmd.idempotent && !cmd.dryRun {
+		if err := cmd.initProducerID(); err != nil {
+			failf("%v", err)
+		}
+	}
 	stdin := make(chan string)
 	lines := make(chan string)
 	messages := make(chan message)
@@ -244,43 +1026,237 @@ func (cmd *produceCmd) run(as []string) {
 	out := make(chan printContext)
 	q := make(chan struct{})
 
-	go readStdinLines(cmd.bufferSize, stdin)
+	if cmd.interactive {
+		go func() {
+			if err := readInteractiveLines(cmd.history, stdin); err != nil {
+				failf("failed to read interactive input err=%v", err)
+			}
+		}()
+	} else if cmd.bench != nil {
+		go benchLines(cmd.benchSize, cmd.count, q, stdin)
+	} else if cmd.generate != nil {
+		go func() {
+			if err := generateLines(cmd.generate, cmd.count, q, stdin); err != nil {
+				failf("%v", err)
+			}
+		}()
+	} else if cmd.csv != nil {
+		go func() {
+			err := cmd.readInputStream(func(name string, r io.Reader) error { return readCSV(name, r, *cmd.csv, stdin) })
+			if err != nil {
+				failf("%v", err)
+			}
+		}()
+	} else if cmd.framing != "" {
+		go func() {
+			err := cmd.readInputStream(func(name string, r io.Reader) error {
+				return readFrames(name, r, cmd.framing, cmd.bufferSize, stdin)
+			})
+			if err != nil {
+				failf("%v", err)
+			}
+		}()
+	} else if cmd.fromTopic != "" {
+		client, err := sarama.NewClient(cmd.brokers, cmd.config)
+		if err != nil {
+			failf("failed to create client err=%v", err)
+		}
+		defer client.Close()
+		go func() {
+			if err := readTopic(client, cmd.fromTopic, cmd.fromParts, q, stdin); err != nil {
+				failf("%v", err)
+			}
+		}()
+	} else if cmd.keyFile != "" {
+		go func() {
+			if err := readKeyValueFiles(cmd.keyFile, cmd.valueFile, cmd.decompress, cmd.bufferSize, stdin); err != nil {
+				failf("%v", err)
+			}
+		}()
+	} else if cmd.follow {
+		go func() {
+			if err := followFile(cmd.file, cmd.fileFormat, cmd.bufferSize, followPoll, q, stdin); err != nil {
+				failf("%v", err)
+			}
+		}()
+	} else if cmd.file != "" {
+		go func() {
+			if err := readInputFile(cmd.file, cmd.fileFormat, cmd.decompress, cmd.bufferSize, stdin); err != nil {
+				failf("%v", err)
+			}
+		}()
+	} else if cmd.decompress != "none" {
+		go func() {
+			err := cmd.readInputStream(func(name string, r io.Reader) error {
+				format := ""
+				if cmd.literal || cmd.tombstone {
+					format = "text"
+				}
+				if err := readLines(name, format, r, cmd.bufferSize, stdin); err != nil {
+					return err
+				}
+				close(stdin)
+				return nil
+			})
+			if err != nil {
+				failf("%v", err)
+			}
+		}()
+	} else {
+		go readStdinLines(cmd.bufferSize, cmd.literal || cmd.tombstone, stdin)
+	}
 	go print(out, cmd.pretty)
 
 	go listenForInterrupt(q)
 	go cmd.readInput(q, stdin, lines)
-	go cmd.deserializeLines(lines, messages, int32(len(cmd.leaders)))
+	go cmd.deserializeLines(q, lines, messages, int32(len(leaders)))
+	if cmd.dryRun {
+		cmd.printDryRun(messages, out)
+		return
+	}
 	go cmd.batchRecords(messages, batchedMessages)
+	start := time.Now()
 	cmd.produce(batchedMessages, out)
+	failed = cmd.failed()
+	if cmd.bench == nil && (cmd.deliveries || failed > 0 || atomic.LoadInt64(&cmd.skipped) > 0) {
+		cmd.printSummary(time.Since(start))
+	}
+	if cmd.requestStats != nil {
+		cmd.requestStats.print(time.Since(start))
+	}
+	if cmd.bench != nil {
+		delivered := atomic.LoadInt64(&cmd.delivered)
+		ctx := printContext{output: cmd.bench.report(delivered, failed, cmd.benchSize, time.Since(start)), done: make(chan struct{})}
+		out <- ctx
+		<-ctx.done
+	}
 }
 
-func (cmd *produceCmd) close() {
-	for _, b := range cmd.leaders {
-		var (
-			connected bool
-			err       error
-		)
+// readInputStream passes cmd.file, or stdin, with its name to read,
+// decompressed according to -decompress.
+func (cmd *produceCmd) readInputStream(read func(name string, r io.Reader) error) error {
+	name, in := "stdin", io.Reader(os.Stdin)
+	if cmd.file != "" {
+		f, err := os.Open(cmd.file)
+		if err != nil {
+			return fmt.Errorf("failed to open input file err=%v", err)
+		}
+		defer f.Close()
+		name, in = cmd.file, f
+	}
 
-		if connected, err = b.Connected(); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to check if broker is connected. err=%s\n", err)
+	r, err := decompressedReader(in, cmd.decompress)
+	if err != nil {
+		return fmt.Errorf("%v: %v", name, err)
+	}
+	defer r.Close()
+	return read(name, r)
+}
+
+type dryRunMessage struct {
+	Topic     string            `json:"topic"`
+	Partition int32             `json:"partition"`
+	Key       *string           `json:"key"`
+	Value     *string           `json:"value"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Timestamp time.Time         `json:"timestamp"`
+}
+
+// printDryRun prints the messages from in with the topic, partition and
+// headers they would be sent with. Messages that fail to encode are reported
+// on stderr.
+func (cmd *produceCmd) printDryRun(in chan message, out chan printContext) {
+	for msg := range in {
+		rec, err := cmd.makeRecord(msg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid message for partition %v. err=%v\n", *msg.Partition, err)
 			continue
 		}
-
-		if !connected {
+		if cmd.invalid(msg) {
+			continue
+		}
+		if err := cmd.checkSize(msg, recordSize(rec)); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid message for partition %v. err=%v\n", *msg.Partition, err)
 			continue
 		}
 
-		if err = b.Close(); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to close broker %v connection. err=%s\n", b, err)
+		dr := dryRunMessage{Topic: cmd.messageTopic(msg), Partition: *msg.Partition, Key: msg.Key, Value: msg.Value, Timestamp: msg.timestamp(time.Now())}
+		for _, h := range rec.Headers {
+			if dr.Headers == nil {
+				dr.Headers = map[string]string{}
+			}
+			dr.Headers[string(h.Key)] = string(h.Value)
 		}
+
+		ctx := printContext{output: dr, done: make(chan struct{})}
+		out <- ctx
+		<-ctx.done
 	}
 }
 
-func (cmd *produceCmd) deserializeLines(in chan string, out chan message, partitionCount int32) {
-	defer func() { close(out) }()
-	for {
-		select {
-		case l, ok := <-in:
+// initProducerID requests the producer id and epoch that identify the batches
+// of an idempotent producer.
+func (cmd *produceCmd) initProducerID() error {
+	for _, b := range cmd.brokerConns {
+		res, err := b.InitProducerID(&sarama.InitProducerIDRequest{})
+		if err != nil {
+			return fmt.Errorf("failed to init producer id err=%v", err)
+		}
+		if res.Err != sarama.ErrNoError {
+			return fmt.Errorf("failed to init producer id err=%v", res.Err)
+		}
+		cmd.producerID, cmd.producerEpoch = res.ProducerID, res.ProducerEpoch
+		cmd.sequences = map[string]map[int32]int32{}
+		return nil
+	}
+	return fmt.Errorf("failed to init producer id, no broker available")
+}
+
+// assignSequences marks the record batches with the producer id and epoch,
+// and the sequence number of their first record per topic and partition.
+func (cmd *produceCmd) assignSequences(parts []*partitionBatch) {
+	for _, pb := range parts {
+		if cmd.sequences[pb.topic] == nil {
+			cmd.sequences[pb.topic] = map[int32]int32{}
+		}
+		b := pb.records
+		b.ProducerID, b.ProducerEpoch = cmd.producerID, cmd.producerEpoch
+		b.FirstSequence = cmd.sequences[pb.topic][pb.partition]
+		cmd.sequences[pb.topic][pb.partition] += int32(len(b.Records))
+	}
+}
+
+func (cmd *produceCmd) close() {
+	for _, b := range cmd.brokerConns {
+		var (
+			connected bool
+			err       error
+		)
+
+		if connected, err = b.Connected(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to check if broker is connected. err=%s\n", err)
+			continue
+		}
+
+		if !connected {
+			continue
+		}
+
+		if err = b.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to close broker %v connection. err=%s\n", b, err)
+		}
+	}
+}
+
+// deserializeLines turns the lines from in into messages for out, until in
+// or q is closed.
+func (cmd *produceCmd) deserializeLines(q chan struct{}, in chan string, out chan message, partitionCount int32) {
+	defer func() { close(out) }()
+	for n := 1; ; n++ {
+		select {
+		case <-q:
+			return
+		case l, ok := <-in:
 			if !ok {
 				return
 			}
@@ -290,8 +1266,15 @@ func (cmd *produceCmd) deserializeLines(in chan string, out chan message, partit
 			case cmd.literal:
 				msg.Value = &l
 				msg.Partition = &cmd.partition
+			case cmd.tombstone:
+				msg.Key = &l
+			case cmd.bench != nil:
+				msg.Value = &l
 			default:
 				if err := json.Unmarshal([]byte(l), &msg); err != nil {
+					if isEnvelope(l) {
+						failf("input %d: failed to read message, key and value have to be strings or null err=%v", n, err)
+					}
 					if cmd.verbose {
 						fmt.Fprintf(os.Stderr, "Failed to unmarshal input [%v], falling back to defaults. err=%v\n", l, err)
 					}
@@ -301,28 +1284,203 @@ func (cmd *produceCmd) deserializeLines(in chan string, out chan message, partit
 					}
 					msg = message{Key: nil, Value: v}
 				}
+				if msg.Offset != nil { // consumed from its topic, produced to -topic
+					msg.Topic = nil
+				}
+				if !supportedEncoding(cmd.keyEncoding(msg)) || !supportedEncoding(cmd.valueEncoding(msg)) {
+					failf("input %d: unsupported keyEncoding or valueEncoding, only string, hex and base64 are supported", n)
+				}
 			}
 
-			var part int32 = 0
-			if msg.Key != nil && cmd.partitioner == "hashCode" {
-				part = hashCodePartition(*msg.Key, partitionCount)
+			if msg.Key == nil && msg.Value != nil && len(cmd.keyField) > 0 {
+				if key, err := cmd.fieldKey(*msg.Value, cmd.valueEncoding(msg)); err != nil {
+					if cmd.verbose {
+						fmt.Fprintf(os.Stderr, "Failed to find key field in value [%v]. err=%v\n", *msg.Value, err)
+					}
+				} else {
+					msg.Key = &key
+				}
+			}
+
+			count := partitionCount
+			if t := cmd.messageTopic(msg); t != cmd.topic {
+				leaders, err := cmd.topicLeaders(t)
+				if err != nil {
+					failf("%v", err)
+				}
+				count = int32(len(leaders))
+			}
+			if cmd.broadcast {
+				msg.Partition = nil
+			} else if err := cmd.checkPartition(&msg, count); err != nil {
+				failf("input %d: %v", n, err)
 			}
-			if msg.Partition == nil {
+			if msg.Partition == nil && !cmd.broadcast {
+				part := cmd.choosePartition(msg, count)
+				if !validPartition(part, count) {
+					failf("input %d: %v", n, partitionError(cmd.messageTopic(msg), part, count))
+				}
 				msg.Partition = &part
 			}
 
-			out <- msg
+			msg.line = n
+			if cmd.pace != nil && msg.Timestamp != nil {
+				cmd.pace.wait(msg.Timestamp.Time, q)
+				select {
+				case <-q:
+					return
+				default:
+				}
+			}
+
+			copies := []message{msg}
+			if cmd.broadcast {
+				copies = broadcastMessages(msg, count)
+			}
+			for _, m := range copies {
+				if cmd.byteRate != nil {
+					cmd.byteRate.wait(q, m.size())
+				}
+				select {
+				case out <- m:
+				case <-q:
+					return
+				}
+			}
 		}
 	}
 }
 
+// broadcastMessages returns a copy of msg for each of the count partitions of
+// its topic.
+func broadcastMessages(msg message, count int32) []message {
+	copies := make([]message, count)
+	for i := range copies {
+		part := int32(i)
+		copies[i] = msg
+		copies[i].Partition = &part
+	}
+	return copies
+}
+
+// checkPartition fails for a message with a partition that its topic of count
+// partitions doesn't have, or with -remap-partitions unsets the partition so
+// that it's chosen by -partitioner instead.
+func (cmd *produceCmd) checkPartition(msg *message, count int32) error {
+	if msg.Partition == nil || validPartition(*msg.Partition, count) {
+		return nil
+	}
+	err := partitionError(cmd.messageTopic(*msg), *msg.Partition, count)
+	if !cmd.remapParts {
+		return fmt.Errorf("%v, use -remap-partitions to choose another", err)
+	}
+	if cmd.verbose {
+		fmt.Fprintf(os.Stderr, "Choosing another partition for message. err=%v\n", err)
+	}
+	msg.Partition = nil
+	return nil
+}
+
+func validPartition(partition, count int32) bool {
+	return partition >= 0 && partition < count
+}
+
+func partitionError(topic string, partition, count int32) error {
+	return fmt.Errorf("topic %v has no partition %v, only %v partitions", topic, partition, count)
+}
+
+// fieldKey returns the field at cmd.keyField in the JSON value. Strings are
+// returned as is, other fields as JSON. Array elements are selected by index.
+func (cmd *produceCmd) fieldKey(value, encoding string) (string, error) {
+	data, err := decodeBytes(value, encoding)
+	if err != nil {
+		return "", err
+	}
+
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return "", err
+	}
+
+	for _, f := range cmd.keyField {
+		switch c := v.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if v, ok = c[f]; !ok {
+				return "", fmt.Errorf("missing field %#v", f)
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(f)
+			if err != nil || i < 0 || i >= len(c) {
+				return "", fmt.Errorf("invalid index %#v", f)
+			}
+			v = c[i]
+		default:
+			return "", fmt.Errorf("cannot select field %#v of %v", f, v)
+		}
+	}
+
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case nil:
+		return "", fmt.Errorf("field is null")
+	}
+	buf, err := json.Marshal(v)
+	return string(buf), err
+}
+
+// choosePartition returns the partition for msg without explicit partition.
+// The hashing partitioners choose partitions for messages without key
+// according to -null-keys.
+func (cmd *produceCmd) choosePartition(msg message, partitionCount int32) int32 {
+	switch {
+	case cmd.partitioner == "random", msg.Key == nil && cmd.nullKeys == "random":
+		return rand.Int31n(partitionCount)
+	case cmd.partitioner == "roundrobin", msg.Key == nil && cmd.nullKeys == "roundrobin":
+		part := cmd.nextPartition % partitionCount
+		cmd.nextPartition = part + 1
+		return part
+	case msg.Key == nil:
+		return cmd.partition
+	case cmd.partitioner == "hashCode", cmd.partitioner == "murmur2", cmd.partitioner == "default":
+		key, err := decodeBytes(*msg.Key, cmd.keyEncoding(msg))
+		if err != nil {
+			key = []byte(*msg.Key) // reported when the message is produced
+		}
+		if cmd.partitioner == "hashCode" {
+			return hashCodePartition(string(key), partitionCount)
+		}
+		return murmur2Partition(key, partitionCount)
+	}
+	return cmd.partition
+}
+
+// decodeBytes decodes s given in the encoding of -decodekey or -decodevalue.
+func decodeBytes(s, encoding string) ([]byte, error) {
+	switch encoding {
+	case "hex":
+		return hex.DecodeString(s)
+	case "base64":
+		return base64.StdEncoding.DecodeString(s)
+	default: // string
+		return []byte(s), nil
+	}
+}
+
 func (cmd *produceCmd) batchRecords(in chan message, out chan []message) {
 	defer func() { close(out) }()
 
-	messages := []message{}
+	var (
+		messages = []message{}
+		size     int
+		linger   <-chan time.Time
+	)
 	send := func() {
 		out <- messages
-		messages = []message{}
+		messages, size, linger = []message{}, 0, nil
 	}
 
 	for {
@@ -334,164 +1492,962 @@ func (cmd *produceCmd) batchRecords(in chan message, out chan []message) {
 			}
 
 			messages = append(messages, m)
-			if len(messages) > 0 && len(messages) >= cmd.batch {
+			size += m.size()
+			if len(messages) == 1 && cmd.linger > 0 {
+				linger = time.After(cmd.linger)
+			}
+			if len(messages) >= cmd.batch || (cmd.batchBytes > 0 && size >= cmd.batchBytes) {
 				send()
 			}
 		case <-time.After(cmd.timeout):
 			if len(messages) > 0 {
 				send()
 			}
+		case <-linger:
+			if len(messages) > 0 {
+				send()
+			}
 		}
 	}
 }
 
-type partitionProduceResult struct {
-	start int64
-	count int64
+// size returns the number of bytes of the key and value of msg as given.
+func (msg message) size() int {
+	var n int
+	if msg.Key != nil {
+		n += len(*msg.Key)
+	}
+	if msg.Value != nil {
+		n += len(*msg.Value)
+	}
+	return n
 }
 
 func (cmd *produceCmd) makeSaramaMessage(msg message) (*sarama.Message, error) {
 	var (
 		err error
-		sm  = &sarama.Message{Codec: cmd.compression}
+		sm  = &sarama.Message{}
 	)
 
 	if msg.Key != nil {
-		switch cmd.decodeKey {
-		case "hex":
-			if sm.Key, err = hex.DecodeString(*msg.Key); err != nil {
-				return sm, fmt.Errorf("failed to decode key as hex string, err=%v", err)
-			}
-		case "base64":
-			if sm.Key, err = base64.StdEncoding.DecodeString(*msg.Key); err != nil {
-				return sm, fmt.Errorf("failed to decode key as base64 string, err=%v", err)
-			}
-		default: // string
-			sm.Key = []byte(*msg.Key)
+		if sm.Key, err = decodeBytes(*msg.Key, cmd.keyEncoding(msg)); err != nil {
+			return sm, fmt.Errorf("failed to decode key as %v string, err=%v", cmd.keyEncoding(msg), err)
 		}
 	}
 
 	if msg.Value != nil {
-		switch cmd.decodeValue {
-		case "hex":
-			if sm.Value, err = hex.DecodeString(*msg.Value); err != nil {
-				return sm, fmt.Errorf("failed to decode value as hex string, err=%v", err)
-			}
-		case "base64":
-			if sm.Value, err = base64.StdEncoding.DecodeString(*msg.Value); err != nil {
-				return sm, fmt.Errorf("failed to decode value as base64 string, err=%v", err)
+		if sm.Value, err = decodeBytes(*msg.Value, cmd.valueEncoding(msg)); err != nil {
+			return sm, fmt.Errorf("failed to decode value as %v string, err=%v", cmd.valueEncoding(msg), err)
+		}
+
+		if cmd.registry != nil {
+			if sm.Value, err = cmd.registry.encode(cmd.valueSchema, sm.Value); err != nil {
+				return sm, fmt.Errorf("failed to encode value with schema %v, err=%v", cmd.valueSchema, err)
 			}
-		default: // string
-			sm.Value = []byte(*msg.Value)
 		}
 	}
 
 	return sm, nil
 }
 
-func (cmd *produceCmd) produceBatch(leaders map[int32]*sarama.Broker, batch []message, out chan printContext) error {
-	requests := map[*sarama.Broker]*sarama.ProduceRequest{}
+// makeRecord returns msg as a record with the headers of msg added to
+// cmd.headers. Templated headers are executed for every record.
+func (cmd *produceCmd) makeRecord(msg message) (*sarama.Record, error) {
+	sm, err := cmd.makeSaramaMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	rec := &sarama.Record{Key: sm.Key, Value: sm.Value}
+	headers := map[string]string{}
+	for k, v := range cmd.headers {
+		headers[k] = v
+	}
+	if len(cmd.headerTmpls) > 0 {
+		var buf bytes.Buffer
+		data := generateData{Seq: atomic.AddInt64(&cmd.headerSeq, 1) - 1}
+		for k, tmpl := range cmd.headerTmpls {
+			buf.Reset()
+			if err := tmpl.Execute(&buf, data); err != nil {
+				return nil, fmt.Errorf("failed to execute template of header %v err=%v", k, err)
+			}
+			headers[k] = buf.String()
+		}
+	}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		rec.Headers = append(rec.Headers, &sarama.RecordHeader{Key: []byte(k), Value: []byte(headers[k])})
+	}
+
+	return rec, nil
+}
+
+// partitionBatch holds the messages of a batch for one topic and partition,
+// as record batch or legacy messages depending on the request version. It's
+// kept to send it again when producing fails with a retriable error.
+type partitionBatch struct {
+	topic      string
+	partition  int32
+	records    *sarama.RecordBatch
+	messages   []*sarama.Message
+	timestamps []time.Time
+	input      []message
+}
+
+// addRecord appends rec with timestamp ts to the record batch.
+func (pb *partitionBatch) addRecord(rec *sarama.Record, ts time.Time, compression sarama.CompressionCodec) {
+	b := pb.records
+	if b == nil {
+		b = &sarama.RecordBatch{
+			Version:        2,
+			Codec:          compression,
+			FirstTimestamp: ts,
+			MaxTimestamp:   ts,
+			ProducerID:     -1,
+			ProducerEpoch:  -1,
+			FirstSequence:  -1,
+		}
+		pb.records = b
+	}
+
+	rec.OffsetDelta = int64(len(b.Records))
+	rec.TimestampDelta = ts.Sub(b.FirstTimestamp)
+	b.Records = append(b.Records, rec)
+	b.LastOffsetDelta = int32(len(b.Records) - 1)
+	if ts.After(b.MaxTimestamp) {
+		b.MaxTimestamp = ts
+	}
+	pb.timestamps = append(pb.timestamps, ts)
+}
+
+// timestamp returns the timestamp given for msg, or now.
+func (msg message) timestamp(now time.Time) time.Time {
+	if msg.Timestamp != nil {
+		return msg.Timestamp.Time
+	}
+	return now
+}
+
+// requestVersion returns the version of produce requests, which determines the
+// format that messages are sent in.
+func (cmd *produceCmd) requestVersion() int16 {
+	switch {
+	case cmd.compression == sarama.CompressionZSTD:
+		return 7
+	case cmd.recordBatches():
+		return 3
+	case cmd.config.Version.IsAtLeast(sarama.V0_10_0_0):
+		return 2
+	}
+	return 0
+}
+
+// partitionBatches splits batch into the batches per topic and partition, in
+// the order of their first message.
+func (cmd *produceCmd) partitionBatches(batch []message) ([]*partitionBatch, error) {
+	var (
+		parts   []*partitionBatch
+		indexed = map[string]map[int32]*partitionBatch{}
+		version = cmd.requestVersion()
+		now     = time.Now()
+	)
+
 	for _, msg := range batch {
-		broker, ok := leaders[*msg.Partition]
-		if !ok {
-			return fmt.Errorf("non-configured partition %v", *msg.Partition)
+		topic := cmd.messageTopic(msg)
+		rec, sm, err := cmd.encodeMessage(msg, topic, version, now)
+		if err == nil && cmd.invalid(msg) {
+			continue
 		}
-		req, ok := requests[broker]
+		if err == nil && rec != nil {
+			err = cmd.checkSize(msg, recordSize(rec))
+		} else if err == nil {
+			err = cmd.checkSize(msg, len(sm.Key)+len(sm.Value))
+		}
+		if err != nil {
+			if cmd.failedOut == nil {
+				return nil, err
+			}
+			cmd.writeFailed([]message{msg}, err)
+			continue
+		}
+
+		if indexed[topic] == nil {
+			indexed[topic] = map[int32]*partitionBatch{}
+		}
+		pb, ok := indexed[topic][*msg.Partition]
 		if !ok {
-			req = &sarama.ProduceRequest{RequiredAcks: sarama.WaitForAll, Timeout: 10000}
-			requests[broker] = req
+			pb = &partitionBatch{topic: topic, partition: *msg.Partition}
+			indexed[topic][*msg.Partition] = pb
+			parts = append(parts, pb)
 		}
 
-		sm, err := cmd.makeSaramaMessage(msg)
-		if err != nil {
-			return err
+		if rec != nil {
+			pb.addRecord(rec, msg.timestamp(now), cmd.compression)
+		} else {
+			pb.messages = append(pb.messages, sm)
+			pb.timestamps = append(pb.timestamps, sm.Timestamp)
 		}
-		req.AddMessage(cmd.topic, *msg.Partition, sm)
+		pb.input = append(pb.input, msg)
 	}
 
-	for broker, req := range requests {
-		resp, err := broker.Produce(req)
+	return parts, nil
+}
+
+// encodeMessage returns msg for topic as record for record batches, or as
+// message for requests of older versions.
+func (cmd *produceCmd) encodeMessage(msg message, topic string, version int16, now time.Time) (*sarama.Record, *sarama.Message, error) {
+	leaders, err := cmd.topicLeaders(topic)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, ok := leaders[*msg.Partition]; !ok {
+		return nil, nil, fmt.Errorf("non-configured partition %v of topic %v", *msg.Partition, topic)
+	}
+
+	if cmd.recordBatches() {
+		rec, err := cmd.makeRecord(msg)
+		return rec, nil, err
+	}
+
+	if len(msg.Headers) > 0 {
+		return nil, nil, fmt.Errorf("headers require -version v0.11.0.0 or later")
+	}
+	sm, err := cmd.makeSaramaMessage(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if version >= 2 {
+		sm.Version, sm.Timestamp = 1, msg.timestamp(now)
+	} else if msg.Timestamp != nil {
+		return nil, nil, fmt.Errorf("timestamps require -version v0.10.0.0 or later")
+	}
+	return nil, sm, nil
+}
+
+// writeFailed writes msgs that failed with err to -failed-out, if given.
+func (cmd *produceCmd) writeFailed(msgs []message, err error) {
+	if cmd.failedOut == nil {
+		return
+	}
+	if werr := cmd.failedOut.write(msgs, err); werr != nil {
+		failf("%v", werr)
+	}
+}
+
+// recordSize returns the number of bytes of the key, value and headers of rec.
+func recordSize(rec *sarama.Record) int {
+	n := len(rec.Key) + len(rec.Value)
+	for _, h := range rec.Headers {
+		n += len(h.Key) + len(h.Value)
+	}
+	return n
+}
+
+// checkSize returns an error with the line of msg if its size in bytes
+// exceeds -max-message-bytes.
+func (cmd *produceCmd) checkSize(msg message, size int) error {
+	if cmd.maxMsgBytes == 0 || size <= cmd.maxMsgBytes {
+		return nil
+	}
+	return fmt.Errorf("message on line %v of %v bytes exceeds max-message-bytes %v", msg.line, size, cmd.maxMsgBytes)
+}
+
+// invalid reports whether the value of msg doesn't match the -validate JSON
+// Schema, and if so reports it as skipped. Null values aren't validated.
+func (cmd *produceCmd) invalid(msg message) bool {
+	if cmd.schema == nil || msg.Value == nil {
+		return false
+	}
+
+	value, err := decodeBytes(*msg.Value, cmd.valueEncoding(msg))
+	if err == nil {
+		err = validateValue(cmd.schema, value)
+	}
+	if err == nil {
+		return false
+	}
+	atomic.AddInt64(&cmd.skipped, 1)
+	fmt.Fprintf(os.Stderr, "Skipping message on line %v, which doesn't match the validate schema. err=%v\n", msg.line, err)
+	return true
+}
+
+// produceBatch sends batch and retries the partitions that fail with
+// retriable errors up to cmd.retries times, with exponential backoff. The
+// messages that fail are written to -failed-out, and the last error returned.
+func (cmd *produceCmd) produceBatch(batch []message, out chan printContext) error {
+	atomic.AddInt64(&cmd.sent, int64(len(batch)))
+
+	parts, err := cmd.partitionBatches(batch)
+	if err != nil {
+		return err
+	}
+	if cmd.idempotent {
+		cmd.assignSequences(parts)
+	}
+
+	var failed error
+	for attempt := 0; ; attempt++ {
+		retry, retryErr, err := cmd.sendBatches(parts, out)
 		if err != nil {
-			return fmt.Errorf("failed to send request to broker %#v. err=%s", broker, err)
+			failed = err
+		}
+		if len(retry) == 0 {
+			return failed
+		}
+		if attempt >= cmd.retries {
+			failed = fmt.Errorf("giving up after %v retries, err=%v", attempt, retryErr)
+			for _, pb := range retry {
+				cmd.writeFailed(pb.input, failed)
+			}
+			return failed
+		}
+
+		backoff := jitter(retryBackoff(cmd.retryBackoff, attempt))
+		if cmd.verbose {
+			fmt.Fprintf(os.Stderr, "Retrying %v partitions in %v. err=%v\n", len(retry), backoff, retryErr)
 		}
+		time.Sleep(backoff)
+
+		refreshed := map[string]bool{}
+		for _, pb := range retry {
+			if !refreshed[pb.topic] {
+				refreshed[pb.topic] = true
+				if err := cmd.refreshLeaders(pb.topic); err != nil {
+					fmt.Fprintf(os.Stderr, "Failed to refresh leaders of topic %v. err=%v\n", pb.topic, err)
+				}
+			}
+		}
+		parts = retry
+	}
+}
+
+// sendBatches sends the batches in a request per leader. It returns the
+// batches to retry together with the last retriable error, and the last error
+// of the batches that failed otherwise, which are written to -failed-out.
+func (cmd *produceCmd) sendBatches(parts []*partitionBatch, out chan printContext) ([]*partitionBatch, error, error) {
+	var (
+		brokers  []*sarama.Broker
+		byBroker = map[*sarama.Broker][]*partitionBatch{}
+		retry    []*partitionBatch
+		retryErr error
+		failed   error
+	)
+	fail := func(pb *partitionBatch, err error) {
+		cmd.writeFailed(pb.input, err)
+		failed = err
+	}
 
-		offsets, err := readPartitionOffsetResults(resp)
+	for _, pb := range parts {
+		leaders, err := cmd.topicLeaders(pb.topic)
 		if err != nil {
+			fail(pb, err)
+			continue
+		}
+		broker, ok := leaders[pb.partition]
+		if !ok {
+			fail(pb, fmt.Errorf("non-configured partition %v of topic %v", pb.partition, pb.topic))
+			continue
+		}
+		if _, ok := byBroker[broker]; !ok {
+			brokers = append(brokers, broker)
+		}
+		byBroker[broker] = append(byBroker[broker], pb)
+	}
 
-			return fmt.Errorf("failed to read producer response err=%s", err)
+	for _, broker := range brokers {
+		req := &sarama.ProduceRequest{
+			RequiredAcks: cmd.config.Producer.RequiredAcks,
+			Timeout:      int32(cmd.requestTimeout / time.Millisecond),
+			Version:      cmd.requestVersion(),
+		}
+		for _, pb := range byBroker[broker] {
+			if pb.records != nil {
+				req.AddBatch(pb.topic, pb.partition, pb.records)
+				continue
+			}
+			for _, m := range pb.messages {
+				req.AddMessage(pb.topic, pb.partition, m)
+			}
 		}
 
-		for p, o := range offsets {
-			result := map[string]interface{}{"partition": p, "startOffset": o.start, "count": o.count}
-			ctx := printContext{output: result, done: make(chan struct{})}
-			out <- ctx
-			<-ctx.done
+		if cmd.requestStats != nil {
+			cmd.requestStats.record(byBroker[broker])
+		}
+		start := time.Now()
+		resp, err := broker.Produce(req)
+		if err != nil {
+			retry, retryErr = append(retry, byBroker[broker]...), fmt.Errorf("failed to send request to broker %#v. err=%s", broker.Addr(), err)
+			cmd.reconnect(broker)
+			continue
+		}
+
+		for _, pb := range byBroker[broker] {
+			var block *sarama.ProduceResponseBlock
+			if resp != nil { // no response with acks 0
+				if block = resp.GetBlock(pb.topic, pb.partition); block == nil {
+					fail(pb, fmt.Errorf("missing response for topic %v partition %v", pb.topic, pb.partition))
+					continue
+				}
+				switch {
+				case block.Err == sarama.ErrNoError, block.Err == sarama.ErrDuplicateSequenceNumber:
+				case retriableProduceError(block.Err):
+					retry, retryErr = append(retry, pb), fmt.Errorf("failed to produce to topic %v partition %v. err=%v", pb.topic, pb.partition, block.Err)
+					continue
+				default:
+					fmt.Fprintf(os.Stderr, "Failed to send message. err=%s\n", block.Err.Error())
+					fail(pb, fmt.Errorf("failed to read producer response err=%s", block.Err))
+					continue
+				}
+			}
+			cmd.reportDelivered(pb, block, time.Since(start), out)
 		}
 	}
 
-	return nil
+	return retry, retryErr, failed
 }
 
-func readPartitionOffsetResults(resp *sarama.ProduceResponse) (map[int32]partitionProduceResult, error) {
-	offsets := map[int32]partitionProduceResult{}
-	for _, blocks := range resp.Blocks {
-		for partition, block := range blocks {
-			if block.Err != sarama.ErrNoError {
-				fmt.Fprintf(os.Stderr, "Failed to send message. err=%s\n", block.Err.Error())
-				return offsets, block.Err
-			}
+// retriableProduceError reports whether producing may succeed when sending a
+// batch again, e.g. after a leader election.
+func retriableProduceError(err sarama.KError) bool {
+	switch err {
+	case sarama.ErrNotLeaderForPartition,
+		sarama.ErrLeaderNotAvailable,
+		sarama.ErrUnknownTopicOrPartition,
+		sarama.ErrRequestTimedOut,
+		sarama.ErrNotEnoughReplicas,
+		sarama.ErrNotEnoughReplicasAfterAppend,
+		sarama.ErrNetworkException,
+		sarama.ErrKafkaStorageError,
+		sarama.ErrBrokerNotAvailable:
+		return true
+	}
+	return false
+}
 
-			if r, ok := offsets[partition]; ok {
-				offsets[partition] = partitionProduceResult{start: block.Offset, count: r.count + 1}
-			} else {
-				offsets[partition] = partitionProduceResult{start: block.Offset, count: 1}
-			}
+// reconnect reopens the connection to broker after a failed request.
+func (cmd *produceCmd) reconnect(broker *sarama.Broker) {
+	broker.Close()
+	if err := broker.Open(cmd.config); err != nil && err != sarama.ErrAlreadyConnected {
+		fmt.Fprintf(os.Stderr, "Failed to reopen broker connection to %v. err=%s\n", broker.Addr(), err)
+	}
+}
+
+// reportDelivered prints the result for a partition batch that the leader
+// acknowledged with block, or without block for acks 0.
+func (cmd *produceCmd) reportDelivered(pb *partitionBatch, block *sarama.ProduceResponseBlock, d time.Duration, out chan printContext) {
+	atomic.AddInt64(&cmd.delivered, int64(len(pb.timestamps)))
+	if cmd.bench != nil {
+		cmd.bench.record(d, len(pb.timestamps))
+		return
+	}
+
+	var results []interface{}
+	switch {
+	case cmd.deliveries:
+		for _, r := range partitionDeliveries(pb, block, d) {
+			results = append(results, r)
 		}
+	case block != nil:
+		result := map[string]interface{}{"partition": pb.partition, "startOffset": block.Offset, "count": len(pb.timestamps)}
+		if pb.topic != cmd.topic {
+			result["topic"] = pb.topic
+		}
+		results = append(results, result)
+	}
+
+	for _, r := range results {
+		ctx := printContext{output: r, done: make(chan struct{})}
+		out <- ctx
+		<-ctx.done
 	}
-	return offsets, nil
 }
 
+// produce sends up to cmd.maxInFlight batches at the same time, and stops
+// sending further batches after the first failure unless failures are written
+// to -failed-out.
 func (cmd *produceCmd) produce(in chan []message, out chan printContext) {
-	for {
+	var (
+		wg     sync.WaitGroup
+		slots  = make(chan struct{}, cmd.maxInFlight)
+		failed = make(chan struct{})
+		once   sync.Once
+	)
+	defer wg.Wait()
+
+	for b := range in {
+		slots <- struct{}{}
 		select {
-		case b, ok := <-in:
-			if !ok {
-				return
-			}
-			if err := cmd.produceBatch(cmd.leaders, b, out); err != nil {
+		case <-failed:
+			return
+		default:
+		}
+
+		wg.Add(1)
+		go func(b []message) {
+			defer wg.Done()
+			if err := cmd.produceBatch(b, out); err != nil {
 				fmt.Fprintln(os.Stderr, err.Error()) // TODO: failf
-				return
+				if cmd.failedOut == nil {
+					once.Do(func() { close(failed) })
+				}
 			}
-		}
+			<-slots
+		}(b)
 	}
 }
 
+// readInput passes the input lines on at cmd.rate. To repeat the input, the
+// lines are kept and sent again once the input is closed, cmd.repeat times in
+// total or over and over for 0.
 func (cmd *produceCmd) readInput(q chan struct{}, stdin chan string, out chan string) {
 	defer func() { close(out) }()
+
+	send := func(l string) bool {
+		if cmd.rate != nil {
+			cmd.rate.wait(q)
+		}
+		select {
+		case out <- l:
+			return true
+		case <-q:
+			return false
+		}
+	}
+
+	var lines []string
+read:
 	for {
 		select {
 		case l, ok := <-stdin:
 			if !ok {
+				break read
+			}
+			if cmd.repeat != 1 {
+				lines = append(lines, l)
+			}
+			if !send(l) {
 				return
 			}
-			out <- l
 		case <-q:
 			return
 		}
 	}
+
+	if len(lines) == 0 {
+		return
+	}
+	for i := 1; cmd.repeat == 0 || i < cmd.repeat; i++ {
+		for _, l := range lines {
+			if !send(l) {
+				return
+			}
+		}
+	}
 }
 
 var produceDocString = `
 The values for -topic and -brokers can also be set via environment variables KT_TOPIC and KT_BROKERS respectively.
 The values supplied on the command line win over environment variable values.
 
-Input is read from stdin and separated by newlines.
+Input is read from stdin and separated by newlines. JSON objects may span
+multiple lines, except with -literal and -tombstone, so that pretty printed
+output can be piped in as is:
+
+  jq . orders.json | kt produce -topic orders
+
+To enter messages by hand, use -interactive. It supports line editing and a
+history of the messages entered, which is kept in ~/.kt-produce-history unless
+-history is given. JSON messages may span multiple lines, they're sent once the
+object is closed:
+
+  > {"key": "id-23",
+  ... "value": "message content"}
+
+Ctrl-C discards a partial message, Ctrl-D or Ctrl-C on an empty prompt exit.
+
+To read input from a file instead, use -file. The file's format is derived from
+its extension unless -file-format is given:
+
+  jsonl  a JSON message per line, as on stdin (the default)
+  json   a JSON array of messages, or of strings that are used as values
+  text   a value per line, like -literal
+
+To produce CSV records, e.g. exports from a database or spreadsheet, use
+-input csv, on stdin or with -file. The first record is the header row. The
+value of each message is a JSON object of the columns given by -value-columns,
+all but the key column by default, with the header fields as names and the
+record fields as string values. -key-column selects the column used as key:
+
+  kt produce -topic users -input csv -key-column 0 -value-columns 1-5 -file users.csv
+
+produces the record 23,Hans,... of a file with the header id,name,... as
+
+  {"key": "23", "value": "{\"name\":\"Hans\",...}"}
+
+Binary keys and values can also be given as hex or base64 encoded strings,
+e.g. in JSON input files. -key-decode and -value-decode, aliases of -decodekey
+and -decodevalue, decode them to raw bytes before producing:
+
+  kt produce -topic images -key-decode hex -value-decode base64 -file images.jsonl
+
+To produce binary values like protobuf messages or images, which may contain
+newlines, use -input binary, on stdin or with -file. Every value is sent as is,
+or as key with -tombstone. -framing selects how values are separated:
+
+  length  a 4 byte big endian length precedes each value (the default)
+  nul     a NUL byte follows each value, e.g. from find -print0
+
+Values are limited to -buffersize bytes.
+
+To copy a topic to -topic on the same cluster, e.g. to repartition it or
+change its configuration, use -from-topic:
+
+  kt produce -topic orders-v2 -from-topic orders
+
+kt copies the messages that the topic contains when it starts, with their keys,
+values, headers and timestamps as they are, and stops once all partitions are
+copied. Messages keep their partition unless -partitioner is given, and
+messages of other partitions are copied at the same time, so only the order
+within partitions is kept. Combine with -remap-partitions when -topic has fewer
+partitions.
+
+To ship the lines appended to a growing file, e.g. an application's log,
+use -follow:
+
+  kt produce -topic logs -file app.log -file-format text -follow
+
+Like tail -F, kt starts at the end of the file and keeps reading lines as
+they're written until interrupted. When the file is replaced, e.g. by log
+rotation, the old file is read to its end before the new one is read from its
+start. A truncated file is read from its start again. Invalid lines of jsonl
+files are reported on stderr and skipped, so that kt keeps running.
+
+When keys and values come from different systems, give them in separate files.
+Line N of -key-file is the key of line N of -value-file, which is used as value
+as is:
+
+  kt produce -topic users -key-file keys.txt -value-file values.jsonl
+
+Both files must have the same number of lines.
+
+Files compressed with gzip or zstd, e.g. topic exports, are decompressed on the
+fly. kt detects them by their content. Their extension, e.g. .gz in
+orders.json.gz, is ignored for -file-format. To read compressed input from
+stdin, or to skip detection, give the compression with -decompress:
+
+  kt produce -topic orders -decompress gzip < orders.jsonl.gz
+
+Unlike on stdin, invalid JSON messages in files stop kt and are reported with
+their line number, or position in the array.
 
 To specify the key, value and partition individually pass it as a JSON object
 like the following:
 
     {"key": "id-23", "value": "message content", "partition": 0}
 
+Record headers can be given as a JSON object of strings:
+
+    {"value": "message content", "headers": {"trace-id": "abc", "event-type": "order"}}
+
+To add a header to every message, use -header, e.g.:
+
+  -header event-type=order -header source=backfill
+
+Header values may be templates like for -generate, see below, which are
+executed for every message. E.g. to tag replayed traffic with a trace id per
+message and the environment it was replayed from:
+
+  -header 'trace-id={{uuid}}' -header 'env={{env "ENV"}}' -header "replayed-by=$USER"
+
+Headers from the input line win over -header for the same key. Headers require
+Kafka v0.11.0.0 or later. Unless -version is given, kt asks the brokers which
+protocol version to use.
+
+To replay events with their original CreateTime, give a timestamp as
+milliseconds since the epoch or as RFC3339 string:
+
+    {"value": "message content", "timestamp": 1500000000000}
+    {"value": "message content", "timestamp": "2017-07-14T02:40:00Z"}
+
+To encode values with an Avro schema from a Schema Registry:
+
+  -value-codec avro -registry http://localhost:8081
+
+Values are then expected to be the JSON encoding of the Avro data, e.g. in
+combination with -literal:
+
+  echo '{"text": "hello"}' | kt produce -topic greetings -literal -value-codec avro -registry http://localhost:8081
+
+The latest schema of the subject greetings-value is used, unless -subject or
+-schema-version are given. Values are sent prefixed with the magic byte and
+schema id of the registry's wire format, null values are sent as is.
+
+To encode values with a local schema instead, give it with -value-schema. kt
+never registers schemas on its own, the schema has to be registered under the
+subject already unless -auto-register is given. With -check-compatibility, kt
+first asks the registry whether the schema is compatible with the subject's
+latest schema according to its compatibility level, and fails if it isn't:
+
+  -value-codec avro -registry http://localhost:8081 -value-schema greeting.avsc -check-compatibility -auto-register
+
+-subject-strategy names the subject like the Java serializers do: topic for
+<topic>-value (the default), record for the record's full name, e.g.
+com.example.Greeting, or topic-record for <topic>-<full name>. The record
+strategies require -value-schema.
+
+To generate synthetic messages, e.g. for load tests, give a template for the
+input lines together with -count and -rate:
+
+  kt produce -topic orders -count 1000 -rate 100/s -generate '{"key": "{{uuid}}", "value": "{\"amount\": {{int 1 100}}, \"currency\": \"{{enum "EUR:3" "USD:1"}}\"}"}'
+
+Templates use Go's text/template syntax with the following functions:
+
+  int MIN MAX     a random integer between MIN and MAX, inclusive
+  float MIN MAX   a random float between MIN and MAX
+  string N        a random alphanumeric string of length N
+  uuid            a random UUID
+  now             the current time as RFC3339 string
+  millis          the current time as milliseconds since the epoch
+  enum VALUE...   one of the values, weighted by an optional suffix like :3
+  env NAME        the value of the environment variable NAME
+
+{{.Seq}} is the number of the message, starting at 0. Without -count, messages
+are generated until kt is interrupted.
+
+To replay the input, e.g. a captured sample for soak testing, use -repeat N to
+produce it N times, or -loop to produce it until kt is interrupted:
+
+  kt produce -topic orders -file sample.jsonl -loop -rate 50/s
+
+The input is kept in memory to send it again.
+
+To throttle a replay into a shared cluster, limit the rate of messages:
+
+  -rate 500/s
+
+Messages are spaced evenly, e.g. 2ms apart for 500/s, and still batched
+according to -batch and -timeout.
+
+For topics with large payloads, limit the bandwidth instead, or as well:
+
+  -max-bytes-per-sec 10MB
+
+Each message is delayed by the time its key and value take at that rate, as
+given on input like for -batch-bytes. Sizes are in B, KB, MB or GB, which are
+multiples of 1024.
+
+Batches are sent once they contain -batch messages or -batch-bytes bytes of
+keys and values, or when no further message arrived for -timeout. To bound the
+time a message waits in a batch that keeps filling slowly, use -linger. For
+bulk loads, bigger batches and multiple batches in flight increase throughput:
+
+  -batch 1000 -batch-bytes 1048576 -linger 100ms -max-in-flight 4
+
+With -max-in-flight 1, the default, a batch is only sent once the previous one
+is acknowledged, so messages are written in input order. With more batches in
+flight, a failed batch stops kt while later batches may already be written.
+
+To see how messages were batched, -batch-stats prints the number of requests
+and partition batches sent, the messages per request and batch, the average
+bytes of keys and values per batch and the requests per second to stderr when
+done:
+
+  {"requests":120,"batches":480,"messagesPerRequest":833.3,"messagesPerBatch":208.3,"averageBatchBytes":53340.2,"requestsPerSecond":39.8,"duration":"3.015s"}
+
+Few messages per batch suggest a longer -linger or -timeout, batches that are
+close to -batch or -batch-bytes suggest raising those.
+
+For correctness critical loads, -sync sends every message on its own and only
+sends the next once the previous is acknowledged, so results are printed per
+message in input order and kt stops right at the first failure. For bulk
+backfills, leave -sync off and tune the batching flags above instead.
+
+By default, a batch is only acknowledged once all in-sync replicas have
+written it. For throwaway data, -acks 1 only waits for the partition leader and
+-acks 0 doesn't wait at all. As the brokers don't respond with acks 0, no
+offsets are printed and failed writes go unnoticed.
+
+To avoid duplicates when batches are sent again, e.g. during backfills, use
+-idempotent. kt then requests a producer id from the brokers and numbers the
+batches per partition, so that the brokers discard batches they already
+wrote. This requires Kafka v0.11.0.0 or later, -acks all and -max-in-flight 1.
+kt stops at the first batch that fails, so it cannot be combined with
+-failed-out: the brokers would reject every later batch to the partition as
+out of sequence.
+
+Partitions given on input are checked against the partitions of the topic
+before the messages are batched, and kt fails at the first message with a
+partition that doesn't exist. To produce such messages to partitions chosen by
+-partitioner instead, use -remap-partitions.
+
+The messages that consume prints can be produced as they are, to copy them
+between topics or clusters:
+
+  kt consume -topic orders -brokers old:9092 | kt produce -topic orders -brokers new:9092
+
+Consumed messages, which produce recognizes by their offset, keep their
+partition, timestamp and headers, and keys and values marked with
+"keyEncoding" or "valueEncoding" are decoded accordingly, which consume sets
+for keys and values encoded via -encodekey or -encodevalue hex or base64.
+They're produced to -topic rather than the topic they were consumed from.
+Objects with an offset or partition that cannot be read, e.g. because their
+value was decoded to JSON via -value-codec, fail with their line number.
+
+To replay recorded messages with their original spacing, e.g. for realistic
+load tests, use -pace-by-timestamp. Messages are produced with the time
+between their timestamps divided by -speed, starting with the first message
+right away. Messages without timestamp aren't delayed:
+
+  kt consume -topic orders -since 1h | kt produce -topic orders-load -pace-by-timestamp -speed 10
+
+To send control messages, e.g. flush markers, to consumers that are pinned to
+partitions, use -broadcast. Every message is then produced to all partitions of
+its topic, ignoring partitions given on input:
+
+  echo '{"value": "flush"}' | kt produce -topic orders -broadcast
+
+To produce to other topics than -topic, e.g. to demultiplex a stream, give the
+topic per message:
+
+    {"topic": "orders-eu", "key": "id-23", "value": "message content"}
+
+Partitions are assigned with the partition count of the message's topic. The
+output includes the topic for messages that weren't produced to -topic.
+
+To verify what was produced, e.g. in scripts, use -delivery-reports to print a
+report per message rather than per partition:
+
+    {"topic": "orders", "partition": 0, "offset": 23, "timestamp": "2017-07-14T02:40:00Z", "duration": "3.2ms"}
+
+The timestamp is the broker's LogAppendTime for topics configured with it, and
+the message's CreateTime otherwise. The duration is the time the brokers took
+to acknowledge the message's batch.
+
+When messages failed or were skipped, or with -delivery-reports, a summary of
+the messages delivered, failed and skipped is printed to stderr once done:
+
+    {"messages": 1000, "failed": 0, "skipped": 0, "duration": "1.5s"}
+
+When any message failed, kt exits with status 1, also when it kept going with
+-failed-out, so that scripts and CI jobs detect partial failures. Messages
+skipped for -validate don't fail the run. Messages that
+were never sent because kt stopped at the first failure aren't counted.
+
+To delete keys from a compacted topic, produce tombstones, i.e. messages with
+a null value:
+
+    {"key": "id-23", "value": null}
+
+Or pass -tombstone to use every input line as the key of a tombstone:
+
+  echo id-23 | kt produce -topic users -tombstone
+
+To derive the key of messages without key from their JSON value, give the path
+to the key's field, e.g. -key-field user.id for the key 23 of:
+
+    {"value": "{\"user\": {\"id\": 23}}"}
+
+or of the line {"user": {"id": 23}} with -literal.
+
+Array elements are selected by index, e.g. items.0.sku. Messages whose value
+doesn't contain the field are sent without key.
+
+Messages without partition are assigned one by -partitioner:
+
+  manual      -partition (the default)
+  default     murmur2 hash of the key, or a random partition for messages
+              without key (alias murmur2_random)
+  jvm         the JVM String#hashCode of the key (alias hashCode)
+  murmur2     murmur2 hash of the key
+  random      a random partition
+  roundrobin  the partitions in turn
+
+Messages without key can't be hashed. -null-keys chooses their partitions for
+the hashing partitioners default, jvm and murmur2:
+
+  partition   -partition (the default for jvm and murmur2)
+  random      a random partition (the default for default)
+  roundrobin  the partitions in turn
+
+With -verbose, kt prints the partitioner and -null-keys strategy in use.
+
+To send messages to the same partitions as applications using the Java
+client's default partitioner, or librdkafka's murmur2_random partitioner, use
+-partitioner default. Keys are hashed as sent, i.e. after -decodekey, so hex
+and base64 keys hash like the bytes a Java application serializes.
+
+Batches that fail with retriable errors, e.g. during leader elections or
+broker restarts, are sent again up to -retries times. The first retry waits
+for -retry-backoff, which doubles with every further retry. The leaders of the
+failed partitions are requested again before each retry. To avoid duplicates
+when a batch was written but not acknowledged, combine retries with
+-idempotent.
+
+By default kt stops at the first batch that fails to produce. To keep going,
+write the messages that fail, after retries, to a file with -failed-out. Every
+line holds a message in the input format, with its partition and an "error"
+field, so that a load can be resumed from just the failures:
+
+  kt produce -topic orders -file orders.jsonl -failed-out failed.jsonl
+  kt produce -topic orders -file failed.jsonl
+
+To check where messages would go without producing them, use -dry-run. kt still
+requests the partition count of the topic, chooses partitions with the given
+-partitioner and prints each message, e.g.:
+
+  echo '{"key": "id-23", "value": "a"}' | kt produce -topic hans -partitioner murmur2 -dry-run
+  {"topic":"hans","partition":2,"key":"id-23","value":"a","timestamp":"..."}
+
+To reject messages whose values don't match a JSON Schema before they're sent,
+use -validate:
+
+  kt produce -topic orders -file orders.jsonl -validate order.schema.json
+
+Invalid messages are skipped and reported on stderr with their line in the
+input and the violations. Values are validated as given, i.e. after
+-decodevalue and before -value-codec encodes them. Null values pass.
+
+To fail messages whose key, value and headers exceed a size, as decoded and
+encoded for sending, with their line in the input, rather than failing the
+whole batch with the broker's MESSAGE_TOO_LARGE error late in a large load:
+
+  kt produce -topic orders -file orders.jsonl -max-message-bytes 1000000
+
+Like other failures, they stop kt unless -failed-out is given, which they are
+written to, and make kt exit with status 1. By default sizes aren't limited.
+
+To benchmark producing to a topic, like kafka-producer-perf-test, use -bench.
+It produces -count values of -size random bytes, or until interrupted without
+-count, and prints a report of the throughput and the latencies until the
+brokers acknowledged the messages' batches rather than results:
+
+  kt produce -topic bench -bench -size 1KB -count 1M -batch 1000 -max-in-flight 5 -partitioner roundrobin
+  {"messages": 1000000, "failed": 0, "bytes": 1024000000, "duration": "12.3s", "messagesPerSecond": 81300.8,
+   "mbPerSecond": 79.4, "latency": {"p50": "9.8ms", "p95": "21ms", "p99": "35ms", "p99.9": "48ms", "max": "61ms"}}
+
+The batching, -acks, -compression and -partitioner flags apply as usual, the
+values have no keys. When -max-message-bytes is given, -size cannot exceed
+it.
+
+To compress messages, e.g. for bulk loads:
+
+  -compression zstd
+
+Supported codecs are none (the default), gzip, snappy, lz4 and zstd.
+Compression requires Kafka v0.11.0.0 or later, zstd v2.1.0.0 or later.
+
+Messages without timestamp get the time they are sent. Timestamps require
+Kafka v0.10.0.0 or later, and are overwritten by the broker for topics with
+message.timestamp.type LogAppendTime.
+
 In case the input line cannot be interpeted as a JSON object the key and value
 both default to the input line and partition to 0.
 
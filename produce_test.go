@@ -1,11 +1,19 @@
 package main
 
 import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/Shopify/sarama"
 	"github.com/davecgh/go-spew/spew"
 	"github.com/stretchr/testify/require"
 )
@@ -120,6 +128,65 @@ func TestHashCodePartition(t *testing.T) {
 	}
 }
 
+func TestMurmur2(t *testing.T) {
+	data := map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	}
+
+	for key, expected := range data {
+		require.Equal(t, expected, murmur2([]byte(key)), key)
+	}
+
+	require.Equal(t, int32(-1), murmur2Partition([]byte("21"), 0))
+	require.Equal(t, (int32(-973932308)&0x7fffffff)%6, murmur2Partition([]byte("21"), 6))
+}
+
+func TestChoosePartition(t *testing.T) {
+	target := &produceCmd{partitioner: "roundrobin"}
+	actual := []int32{}
+	for i := 0; i < 4; i++ {
+		actual = append(actual, target.choosePartition(newMessage("a", "", 0), 3))
+	}
+	require.Equal(t, []int32{0, 1, 2, 0}, actual)
+
+	target = &produceCmd{partitioner: "random"}
+	for i := 0; i < 10; i++ {
+		p := target.choosePartition(newMessage("", "", 0), 3)
+		require.True(t, p >= 0 && p < 3, p)
+	}
+
+	target = &produceCmd{partitioner: "murmur2", decodeKey: "hex", partition: 2}
+	require.Equal(t, murmur2Partition([]byte("abc"), 5), target.choosePartition(newMessage("616263", "", 0), 5))
+	require.Equal(t, int32(2), target.choosePartition(newMessage("", "", 0), 5))
+
+	target = &produceCmd{partitioner: "default", nullKeys: "random", decodeKey: "string", partition: 2}
+	require.Equal(t, murmur2Partition([]byte("abc"), 5), target.choosePartition(newMessage("abc", "", 0), 5))
+	seen := map[int32]bool{}
+	for i := 0; i < 100; i++ {
+		seen[target.choosePartition(newMessage("", "", 0), 5)] = true
+	}
+	require.True(t, len(seen) > 1, "%v", seen)
+
+	target = &produceCmd{partitioner: "hashCode"}
+	require.Equal(t, hashCodePartition("random", 5), target.choosePartition(newMessage("random", "", 0), 5))
+
+	target = &produceCmd{partitioner: "murmur2", nullKeys: "roundrobin", decodeKey: "string", partition: 2}
+	actual = []int32{}
+	for i := 0; i < 4; i++ {
+		actual = append(actual, target.choosePartition(newMessage("", "", 0), 3))
+	}
+	require.Equal(t, []int32{0, 1, 2, 0}, actual)
+	require.Equal(t, murmur2Partition([]byte("abc"), 3), target.choosePartition(newMessage("abc", "", 0), 3))
+
+	target = &produceCmd{partitioner: "manual", partition: 1}
+	require.Equal(t, int32(1), target.choosePartition(newMessage("a", "", 0), 5))
+}
+
 func TestProduceParseArgs(t *testing.T) {
 	expectedTopic := "test-topic"
 	givenBroker := "hans:9092"
@@ -197,6 +264,13 @@ func newMessage(key, value string, partition int32) message {
 	}
 }
 
+// inputMessage returns newMessage as read from the given line of the input.
+func inputMessage(line int, key, value string, partition int32) message {
+	msg := newMessage(key, value, partition)
+	msg.line = line
+	return msg
+}
+
 func TestMakeSaramaMessage(t *testing.T) {
 	target := &produceCmd{decodeKey: "string", decodeValue: "string"}
 	key, value := "key", "value"
@@ -223,6 +297,246 @@ func TestMakeSaramaMessage(t *testing.T) {
 	require.Equal(t, []byte("peter"), actual.Value)
 }
 
+func TestKafkaCompression(t *testing.T) {
+	data := map[string]sarama.CompressionCodec{
+		"":       sarama.CompressionNone,
+		"none":   sarama.CompressionNone,
+		"gzip":   sarama.CompressionGZIP,
+		"snappy": sarama.CompressionSnappy,
+		"lz4":    sarama.CompressionLZ4,
+		"zstd":   sarama.CompressionZSTD,
+	}
+
+	for name, expected := range data {
+		require.Equal(t, expected, kafkaCompression(name), name)
+	}
+}
+
+func TestProduceCheckVersionCompression(t *testing.T) {
+	target := &produceCmd{}
+	target.parseArgs([]string{"-topic", "hans", "-compression", "zstd", "-version", "2.1.0"})
+	require.Equal(t, sarama.CompressionZSTD, target.compression)
+	target.checkVersion()
+	require.True(t, target.recordBatches())
+}
+
+func TestProduceParseArgsValueCodec(t *testing.T) {
+	target := &produceCmd{}
+	target.parseArgs([]string{"-topic", "hans", "-value-codec", "avro", "-registry", "http://localhost:8081"})
+	require.NotNil(t, target.registry)
+	require.Equal(t, "hans-value", target.subject)
+	require.Equal(t, "latest", target.schemaVersion)
+
+	target = &produceCmd{}
+	target.parseArgs([]string{"-topic", "hans", "-value-codec", "avro", "-registry", "http://localhost:8081", "-subject", "greetings", "-schema-version", "3"})
+	require.Equal(t, "greetings", target.subject)
+	require.Equal(t, "3", target.schemaVersion)
+
+	target = &produceCmd{}
+	target.parseArgs([]string{"-topic", "hans"})
+	require.Nil(t, target.registry)
+}
+
+func TestProduceParseArgsFile(t *testing.T) {
+	target := &produceCmd{}
+	target.parseArgs([]string{"-topic", "hans", "-file", "messages.json"})
+	require.Equal(t, "messages.json", target.file)
+	require.Equal(t, "json", target.fileFormat)
+	require.False(t, target.literal)
+
+	target = &produceCmd{}
+	target.parseArgs([]string{"-topic", "hans", "-file", "messages.log", "-file-format", "text"})
+	require.Equal(t, "text", target.fileFormat)
+	require.True(t, target.literal)
+}
+
+func TestProduceParseArgsGenerate(t *testing.T) {
+	target := &produceCmd{}
+	target.parseArgs([]string{"-topic", "hans", "-generate", `{"value": "{{.Seq}}"}`, "-count", "10"})
+	require.NotNil(t, target.generate)
+	require.Equal(t, int64(10), target.count)
+}
+
+func TestProduceParseArgsRate(t *testing.T) {
+	target := &produceCmd{}
+	target.parseArgs([]string{"-topic", "hans", "-rate", "500/s"})
+	require.Equal(t, &rateLimiter{interval: 2 * time.Millisecond}, target.rate)
+
+	target = &produceCmd{}
+	target.parseArgs([]string{"-topic", "hans"})
+	require.Nil(t, target.rate)
+}
+
+func TestBatchRecords(t *testing.T) {
+	target := &produceCmd{batch: 10, batchBytes: 5, timeout: time.Hour}
+	in, out := make(chan message), make(chan []message)
+	go target.batchRecords(in, out)
+
+	in <- newMessage("a", "bc", 0)
+	in <- newMessage("", "de", 0)
+	require.Equal(t, []message{newMessage("a", "bc", 0), newMessage("", "de", 0)}, <-out)
+	close(in)
+	require.Empty(t, <-out)
+
+	target = &produceCmd{batch: 10, linger: 20 * time.Millisecond, timeout: time.Hour}
+	in, out = make(chan message), make(chan []message)
+	go target.batchRecords(in, out)
+
+	in <- newMessage("", "a", 0)
+	select {
+	case actual := <-out:
+		require.Equal(t, []message{newMessage("", "a", 0)}, actual)
+	case <-time.After(time.Second):
+		t.Fatal("expected batch to be sent after linger")
+	}
+	close(in)
+}
+
+func TestProduceParseArgsAcks(t *testing.T) {
+	data := map[string]sarama.RequiredAcks{
+		"0":   sarama.NoResponse,
+		"1":   sarama.WaitForLocal,
+		"all": sarama.WaitForAll,
+	}
+
+	for acks, expected := range data {
+		target := &produceCmd{}
+		target.parseArgs([]string{"-topic", "hans", "-acks", acks})
+		require.Equal(t, expected, target.config.Producer.RequiredAcks, acks)
+	}
+
+	target := &produceCmd{}
+	target.parseArgs([]string{"-topic", "hans"})
+	require.Equal(t, sarama.WaitForAll, target.config.Producer.RequiredAcks)
+}
+
+func TestAssignSequences(t *testing.T) {
+	target := &produceCmd{producerID: 23, producerEpoch: 1, sequences: map[string]map[int32]int32{}}
+	batch := func(topic string, partition int32, n int) *partitionBatch {
+		return &partitionBatch{topic: topic, partition: partition, records: &sarama.RecordBatch{ProducerID: -1, ProducerEpoch: -1, FirstSequence: -1, Records: make([]*sarama.Record, n)}}
+	}
+
+	parts := []*partitionBatch{batch("hans", 0, 2), batch("hans", 1, 1)}
+	target.assignSequences(parts)
+	require.Equal(t, int64(23), parts[0].records.ProducerID)
+	require.Equal(t, int16(1), parts[0].records.ProducerEpoch)
+	require.Equal(t, int32(0), parts[0].records.FirstSequence)
+	require.Equal(t, int32(0), parts[1].records.FirstSequence)
+
+	parts = []*partitionBatch{batch("hans", 0, 1), batch("hans", 1, 1), batch("peter", 0, 1)}
+	target.assignSequences(parts)
+	require.Equal(t, int32(2), parts[0].records.FirstSequence)
+	require.Equal(t, int32(1), parts[1].records.FirstSequence)
+	require.Equal(t, int32(0), parts[2].records.FirstSequence)
+	require.Equal(t, map[string]map[int32]int32{"hans": {0: 3, 1: 2}, "peter": {0: 1}}, target.sequences)
+}
+
+func TestFieldKey(t *testing.T) {
+	data := []struct {
+		field    string
+		value    string
+		expected string
+		err      bool
+	}{
+		{field: "user.id", value: `{"user": {"id": 23}}`, expected: "23"},
+		{field: "user.id", value: `{"user": {"id": 12345678901234567890}}`, expected: "12345678901234567890"},
+		{field: "user.name", value: `{"user": {"name": "hans"}}`, expected: "hans"},
+		{field: "user", value: `{"user": {"id": 23}}`, expected: `{"id":23}`},
+		{field: "items.1.sku", value: `{"items": [{"sku": "a"}, {"sku": "b"}]}`, expected: "b"},
+		{field: "items.2.sku", value: `{"items": [{"sku": "a"}, {"sku": "b"}]}`, err: true},
+		{field: "user.id", value: `{"user": {"name": "hans"}}`, err: true},
+		{field: "user.id", value: `{"user": null}`, err: true},
+		{field: "user.id", value: `{"user": {"id": null}}`, err: true},
+		{field: "user.id", value: `hans`, err: true},
+	}
+
+	for _, d := range data {
+		target := &produceCmd{decodeValue: "string", keyField: strings.Split(d.field, ".")}
+		actual, err := target.fieldKey(d.value, target.decodeValue)
+		if d.err {
+			require.Error(t, err, d.value)
+			continue
+		}
+		require.NoError(t, err, d.value)
+		require.Equal(t, d.expected, actual, d.value)
+	}
+}
+
+func TestDeserializeLinesKeyField(t *testing.T) {
+	target := &produceCmd{partitioner: "hashCode", keyField: []string{"id"}, decodeValue: "string"}
+	in, out := make(chan string, 3), make(chan message, 3)
+	in <- `{"value": "{\"id\": \"random\"}"}`
+	in <- `{"key": "a", "value": "{\"id\": \"random\"}"}`
+	in <- `{"value": "{}"}`
+	close(in)
+	target.deserializeLines(nil, in, out, 5)
+
+	require.Equal(t, inputMessage(1, "random", `{"id": "random"}`, 0), <-out)
+	require.Equal(t, inputMessage(2, "a", `{"id": "random"}`, 2), <-out)
+	require.Equal(t, inputMessage(3, "", `{}`, 0), <-out)
+}
+
+func TestReadInputRepeat(t *testing.T) {
+	data := []struct {
+		repeat   int
+		expected []string
+	}{
+		{repeat: 1, expected: []string{"a", "b"}},
+		{repeat: 3, expected: []string{"a", "b", "a", "b", "a", "b"}},
+		{repeat: 0, expected: []string{"a", "b", "a", "b", "a"}},
+	}
+
+	for _, d := range data {
+		target := &produceCmd{repeat: d.repeat}
+		q, in, out := make(chan struct{}), make(chan string, 2), make(chan string)
+		in <- "a"
+		in <- "b"
+		close(in)
+		go target.readInput(q, in, out)
+
+		actual := []string{}
+		for l := range out {
+			actual = append(actual, l)
+			if len(actual) == len(d.expected) && d.repeat == 0 {
+				close(q)
+				break
+			}
+		}
+		require.Equal(t, d.expected, actual, "repeat %v", d.repeat)
+	}
+}
+
+func TestProduceTombstones(t *testing.T) {
+	target := &produceCmd{tombstone: true, partitioner: "hashCode"}
+	in, out := make(chan string, 1), make(chan message, 1)
+	in <- "random"
+	close(in)
+	target.deserializeLines(nil, in, out, 5)
+	msg := <-out
+	require.Equal(t, inputMessage(1, "random", "", 0), msg)
+
+	target = &produceCmd{decodeKey: "string", decodeValue: "string"}
+	in, out = make(chan string, 1), make(chan message, 1)
+	in <- `{"key": "id-23", "value": null}`
+	close(in)
+	target.deserializeLines(nil, in, out, 1)
+	msg = <-out
+	require.Nil(t, msg.Value)
+
+	rec, err := target.makeRecord(msg)
+	require.NoError(t, err)
+	require.Equal(t, []byte("id-23"), rec.Key)
+	require.Nil(t, rec.Value)
+}
+
+func TestMessageTopic(t *testing.T) {
+	target := &produceCmd{topic: "hans"}
+	other, empty := "peter", ""
+	require.Equal(t, "hans", target.messageTopic(message{}))
+	require.Equal(t, "hans", target.messageTopic(message{Topic: &empty}))
+	require.Equal(t, "peter", target.messageTopic(message{Topic: &other}))
+}
+
 func TestDeserializeLines(t *testing.T) {
 	target := &produceCmd{}
 	target.partitioner = "hashCode"
@@ -258,6 +572,16 @@ func TestDeserializeLines(t *testing.T) {
 			partitionCount: 4,
 			expected:       newMessage("", `{"other":"json","values":"avail"}`, 2),
 		},
+		{
+			in:             `{"value":"123","headers":{"trace-id":"abc"}}`,
+			literal:        false,
+			partitionCount: 1,
+			expected: func() message {
+				m := newMessage("", "123", 0)
+				m.Headers = map[string]string{"trace-id": "abc"}
+				return m
+			}(),
+		},
 		{
 			in:             `so lange schon`,
 			literal:        false,
@@ -271,16 +595,682 @@ func TestDeserializeLines(t *testing.T) {
 		out := make(chan message)
 		target.literal = d.literal
 		target.partition = d.partition
-		go target.deserializeLines(in, out, d.partitionCount)
+		go target.deserializeLines(nil, in, out, d.partitionCount)
 		in <- d.in
 
 		select {
 		case <-time.After(50 * time.Millisecond):
 			t.Errorf("did not receive output in time")
 		case actual := <-out:
+			d.expected.line = 1 // every case is a single line
 			if !(reflect.DeepEqual(d.expected, actual)) {
 				t.Errorf(spew.Sprintf("\nexpected %#v\nactual   %#v", d.expected, actual))
 			}
 		}
 	}
 }
+
+func TestProduceParseArgsHeaders(t *testing.T) {
+	os.Setenv("KT_TOPIC", "")
+	os.Setenv("KT_BROKERS", "")
+	target := &produceCmd{}
+	target.parseArgs([]string{"-topic", "hans", "-header", "event-type=order", "-header", "query=a=b"})
+	require.Equal(t, map[string]string{"event-type": "order", "query": "a=b"}, target.headers)
+	require.True(t, target.autoVersion)
+}
+
+func TestMakeRecord(t *testing.T) {
+	target := &produceCmd{decodeKey: "string", decodeValue: "string", headers: map[string]string{"source": "kt", "event-type": "default"}}
+	key, value := "key", "value"
+	actual, err := target.makeRecord(message{Key: &key, Value: &value, Headers: map[string]string{"event-type": "order"}})
+	require.NoError(t, err)
+	require.Equal(t, []byte(key), actual.Key)
+	require.Equal(t, []byte(value), actual.Value)
+	require.Equal(t, []*sarama.RecordHeader{
+		{Key: []byte("event-type"), Value: []byte("order")},
+		{Key: []byte("source"), Value: []byte("kt")},
+	}, actual.Headers)
+
+	target.decodeValue = "hex"
+	_, err = target.makeRecord(message{Value: &value})
+	require.Error(t, err)
+}
+
+func TestAddRecord(t *testing.T) {
+	ts := time.Unix(1500000000, 0)
+	pb := &partitionBatch{topic: "hans", partition: 0}
+	pb.addRecord(&sarama.Record{Value: []byte("a")}, ts, sarama.CompressionNone)
+	pb.addRecord(&sarama.Record{Value: []byte("c")}, ts.Add(time.Minute), sarama.CompressionNone)
+	pb.addRecord(&sarama.Record{Value: []byte("d")}, ts.Add(-time.Second), sarama.CompressionNone)
+
+	b := pb.records
+	require.Len(t, b.Records, 3)
+	require.Equal(t, int32(2), b.LastOffsetDelta)
+	require.Equal(t, int64(1), b.Records[1].OffsetDelta)
+	require.Equal(t, time.Minute, b.Records[1].TimestampDelta)
+	require.Equal(t, -time.Second, b.Records[2].TimestampDelta)
+	require.Equal(t, ts, b.FirstTimestamp)
+	require.Equal(t, ts.Add(time.Minute), b.MaxTimestamp)
+	require.Equal(t, int64(-1), b.ProducerID)
+	require.Equal(t, []time.Time{ts, ts.Add(time.Minute), ts.Add(-time.Second)}, pb.timestamps)
+}
+
+func TestPartitionBatches(t *testing.T) {
+	broker := &sarama.Broker{}
+	target := &produceCmd{
+		topic:       "hans",
+		decodeKey:   "string",
+		decodeValue: "string",
+		config:      sarama.NewConfig(),
+		leaders:     map[string]map[int32]*sarama.Broker{"hans": {0: broker, 1: broker}, "peter": {0: broker}},
+	}
+	target.config.Version = sarama.V0_11_0_0
+
+	msg := func(topic string, partition int32, value string) message {
+		return message{Topic: &topic, Partition: &partition, Value: &value}
+	}
+	parts, err := target.partitionBatches([]message{msg("", 1, "a"), msg("peter", 0, "b"), msg("hans", 1, "c"), msg("", 0, "d")})
+	require.NoError(t, err)
+	require.Len(t, parts, 3)
+	require.Equal(t, []string{"hans", "peter", "hans"}, []string{parts[0].topic, parts[1].topic, parts[2].topic})
+	require.Equal(t, []int32{1, 0, 0}, []int32{parts[0].partition, parts[1].partition, parts[2].partition})
+	require.Len(t, parts[0].records.Records, 2)
+	require.Len(t, parts[0].timestamps, 2)
+
+	target.config.Version = sarama.V0_10_0_0
+	parts, err = target.partitionBatches([]message{msg("", 1, "a"), msg("", 1, "b")})
+	require.NoError(t, err)
+	require.Nil(t, parts[0].records)
+	require.Len(t, parts[0].messages, 2)
+
+	_, err = target.partitionBatches([]message{msg("", 2, "a")})
+	require.EqualError(t, err, "non-configured partition 2 of topic hans")
+}
+
+func TestPartitionBatchesMaxMessageBytes(t *testing.T) {
+	args := &produceCmd{}
+	args.parseArgs([]string{"-topic", "hans"})
+	require.Equal(t, 0, args.maxMsgBytes)
+
+	target := &produceCmd{
+		topic:       "hans",
+		decodeKey:   "string",
+		decodeValue: "string",
+		headers:     map[string]string{"ab": "c"},
+		maxMsgBytes: 5,
+		config:      sarama.NewConfig(),
+		leaders:     map[string]map[int32]*sarama.Broker{"hans": {0: {}, 1: {}}},
+	}
+	target.config.Version = sarama.V0_11_0_0
+
+	partition0, partition1 := int32(0), int32(1)
+	small, large := "ab", "abc"
+	batch := []message{
+		{Value: &small, Partition: &partition0, line: 1},
+		{Value: &large, Partition: &partition0, line: 2},
+		{Value: &large, Partition: &partition1, line: 3},
+	}
+	_, err := target.partitionBatches(batch)
+	require.EqualError(t, err, "message on line 2 of 6 bytes exceeds max-message-bytes 5")
+	require.Zero(t, target.skipped)
+
+	f, err := ioutil.TempFile("", "kt-failed-out")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	target.failedOut = &failedWriter{f: f}
+	parts, err := target.partitionBatches(batch)
+	require.NoError(t, err)
+	require.Len(t, parts, 1)
+	require.Len(t, parts[0].records.Records, 1)
+	require.Zero(t, target.skipped)
+	require.NoError(t, f.Close())
+	buf, err := ioutil.ReadFile(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, 2, strings.Count(string(buf), "exceeds max-message-bytes 5"))
+
+	target.failedOut = nil
+	target.config.Version = sarama.V0_10_0_0
+	target.headers = nil
+	parts, err = target.partitionBatches(batch)
+	require.NoError(t, err)
+	require.Len(t, parts, 2)
+
+	target.maxMsgBytes = 0
+	target.headers = map[string]string{"ab": "c"}
+	target.config.Version = sarama.V0_11_0_0
+	parts, err = target.partitionBatches(batch)
+	require.NoError(t, err)
+	require.Len(t, parts, 2)
+}
+
+func TestProduceBatchRetries(t *testing.T) {
+	leader := sarama.NewMockBroker(t, 1)
+	defer leader.Close()
+
+	metadata := sarama.NewMockMetadataResponse(t).
+		SetBroker(leader.Addr(), leader.BrokerID()).
+		SetLeader("hans", 0, leader.BrokerID())
+	leader.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": metadata,
+		"ProduceRequest": sarama.NewMockSequence(
+			sarama.NewMockProduceResponse(t).SetVersion(2).SetError("hans", 0, sarama.ErrNotLeaderForPartition),
+			sarama.NewMockProduceResponse(t).SetVersion(2).SetError("hans", 0, sarama.ErrNotLeaderForPartition),
+			sarama.NewMockProduceResponse(t).SetVersion(2),
+		),
+	})
+
+	target := &produceCmd{
+		topic:          "hans",
+		brokers:        []string{leader.Addr()},
+		decodeKey:      "string",
+		decodeValue:    "string",
+		config:         sarama.NewConfig(),
+		retryBackoff:   time.Millisecond,
+		requestTimeout: time.Second,
+	}
+	target.config.Version = sarama.V0_10_0_0
+	defer target.close()
+
+	partition, value := int32(0), "a"
+	out := make(chan printContext, 1)
+	go func() {
+		for ctx := range out {
+			close(ctx.done)
+		}
+	}()
+	defer close(out)
+
+	target.retries = 1
+	err := target.produceBatch([]message{{Partition: &partition, Value: &value}}, out)
+	require.EqualError(t, err, "giving up after 1 retries, err=failed to produce to topic hans partition 0. err=kafka server: Tried to send a message to a replica that is not the leader for some partition. Your metadata is out of date")
+	require.Equal(t, int64(0), target.delivered)
+
+	target.retries = 3
+	require.NoError(t, target.produceBatch([]message{{Partition: &partition, Value: &value}}, out))
+	require.Equal(t, int64(1), target.delivered)
+}
+
+func TestProduceBatchFailedOut(t *testing.T) {
+	leader := sarama.NewMockBroker(t, 1)
+	defer leader.Close()
+
+	leader.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(leader.Addr(), leader.BrokerID()).
+			SetLeader("hans", 0, leader.BrokerID()).
+			SetLeader("hans", 1, leader.BrokerID()).
+			SetLeader("hans", 2, leader.BrokerID()),
+		"ProduceRequest": sarama.NewMockProduceResponse(t).SetVersion(2).
+			SetError("hans", 0, sarama.ErrMessageSizeTooLarge).
+			SetError("hans", 2, sarama.ErrNotLeaderForPartition),
+	})
+
+	dir, err := ioutil.TempDir("", "kt-failed")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "failed.jsonl")
+	fw, err := newFailedWriter(path)
+	require.NoError(t, err)
+
+	target := &produceCmd{
+		topic:          "hans",
+		brokers:        []string{leader.Addr()},
+		decodeKey:      "string",
+		decodeValue:    "hex",
+		config:         sarama.NewConfig(),
+		retries:        1,
+		retryBackoff:   time.Millisecond,
+		requestTimeout: time.Second,
+		failedOut:      fw,
+	}
+	target.config.Version = sarama.V0_10_0_0
+	defer target.close()
+
+	out := make(chan printContext)
+	go func() {
+		for ctx := range out {
+			close(ctx.done)
+		}
+	}()
+	defer close(out)
+
+	msg := func(partition int32, value string) message {
+		return message{Partition: &partition, Value: &value}
+	}
+	batch := []message{msg(0, "61"), msg(1, "62"), msg(1, "invalid"), msg(2, "63")}
+	err = target.produceBatch(batch, out)
+	require.EqualError(t, err, "giving up after 1 retries, err=failed to produce to topic hans partition 2. err=kafka server: Tried to send a message to a replica that is not the leader for some partition. Your metadata is out of date")
+	require.Equal(t, int64(1), target.delivered)
+	require.NoError(t, fw.close())
+
+	buf, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	var failed []string
+	for _, l := range strings.Split(strings.TrimSpace(string(buf)), "\n") {
+		var fm struct {
+			Value string `json:"value"`
+			Error string `json:"error"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(l), &fm), l)
+		failed = append(failed, fm.Value+": "+fm.Error)
+	}
+	require.Equal(t, []string{
+		"invalid: failed to decode value as hex string, err=encoding/hex: invalid byte: U+0069 'i'",
+		"61: failed to read producer response err=kafka server: Message was too large, server rejected it to avoid allocation error",
+		"63: giving up after 1 retries, err=failed to produce to topic hans partition 2. err=kafka server: Tried to send a message to a replica that is not the leader for some partition. Your metadata is out of date",
+	}, failed)
+}
+
+func TestRetriableProduceError(t *testing.T) {
+	require.True(t, retriableProduceError(sarama.ErrNotLeaderForPartition))
+	require.True(t, retriableProduceError(sarama.ErrRequestTimedOut))
+	require.False(t, retriableProduceError(sarama.ErrMessageSizeTooLarge))
+	require.False(t, retriableProduceError(sarama.ErrInvalidMessage))
+}
+
+func TestProduceParseArgsRetries(t *testing.T) {
+	target := &produceCmd{}
+	target.parseArgs([]string{"-topic", "hans"})
+	require.Equal(t, 3, target.retries)
+	require.Equal(t, 100*time.Millisecond, target.retryBackoff)
+	require.Equal(t, 10*time.Second, target.requestTimeout)
+
+	target = &produceCmd{}
+	target.parseArgs([]string{"-topic", "hans", "-retries", "0", "-retry-backoff", "1s", "-request-timeout", "1m"})
+	require.Equal(t, 0, target.retries)
+	require.Equal(t, time.Second, target.retryBackoff)
+	require.Equal(t, time.Minute, target.requestTimeout)
+	require.True(t, target.config.Net.ReadTimeout > time.Minute)
+}
+
+func TestMessageTimestamp(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	data := []struct {
+		in       string
+		expected time.Time
+		err      bool
+	}{
+		{in: `{"value":"a"}`, expected: now},
+		{in: `{"value":"a","timestamp":1500000000123}`, expected: time.Unix(1500000000, 123000000)},
+		{in: `{"value":"a","timestamp":"2017-07-14T02:40:00.5Z"}`, expected: time.Date(2017, 7, 14, 2, 40, 0, 500000000, time.UTC)},
+		{in: `{"value":"a","timestamp":"yesterday"}`, err: true},
+		{in: `{"value":"a","timestamp":true}`, err: true},
+	}
+
+	for _, d := range data {
+		var msg message
+		err := json.Unmarshal([]byte(d.in), &msg)
+		if d.err {
+			require.Error(t, err, d.in)
+			continue
+		}
+		require.NoError(t, err, d.in)
+		require.True(t, d.expected.Equal(msg.timestamp(now)), "%v: expected %v, got %v", d.in, d.expected, msg.timestamp(now))
+	}
+}
+
+func TestProduceParseArgsInput(t *testing.T) {
+	target := &produceCmd{}
+	target.parseArgs([]string{"-topic", "hans"})
+	require.Nil(t, target.csv)
+
+	target = &produceCmd{}
+	target.parseArgs([]string{"-topic", "hans", "-input", "csv", "-key-column", "0", "-value-columns", "1-3"})
+	require.Equal(t, &csvColumns{keyColumn: 0, valueColumns: []int{1, 2, 3}}, target.csv)
+
+	target = &produceCmd{}
+	target.parseArgs([]string{"-topic", "hans", "-input", "csv"})
+	require.Equal(t, &csvColumns{keyColumn: -1}, target.csv)
+}
+
+func TestPrintDryRun(t *testing.T) {
+	target := &produceCmd{topic: "hans", decodeKey: "string", decodeValue: "hex", headers: map[string]string{"source": "kt"}}
+	ts := time.Unix(1500000000, 0)
+	key, valid, invalid, topic := "id-23", "6869", "hi", "peter"
+	partition := int32(2)
+
+	in := make(chan message, 3)
+	in <- message{Key: &key, Value: &valid, Partition: &partition, Timestamp: &messageTimestamp{Time: ts}}
+	in <- message{Value: &invalid, Partition: &partition}
+	in <- message{Value: &valid, Partition: &partition, Topic: &topic, Headers: map[string]string{"source": "test"}, Timestamp: &messageTimestamp{Time: ts}}
+	close(in)
+
+	out := make(chan printContext)
+	actual := []interface{}{}
+	go func() {
+		for ctx := range out {
+			actual = append(actual, ctx.output)
+			close(ctx.done)
+		}
+	}()
+	target.printDryRun(in, out)
+	close(out)
+
+	require.Equal(t, []interface{}{
+		dryRunMessage{Topic: "hans", Partition: 2, Key: &key, Value: &valid, Headers: map[string]string{"source": "kt"}, Timestamp: ts},
+		dryRunMessage{Topic: "peter", Partition: 2, Value: &valid, Headers: map[string]string{"source": "test"}, Timestamp: ts},
+	}, actual)
+}
+
+func TestProduceParseArgsBinary(t *testing.T) {
+	target := &produceCmd{}
+	target.parseArgs([]string{"-topic", "hans", "-input", "binary"})
+	require.Equal(t, "length", target.framing)
+	require.True(t, target.literal)
+
+	target = &produceCmd{}
+	target.parseArgs([]string{"-topic", "hans", "-input", "binary", "-framing", "nul", "-tombstone"})
+	require.Equal(t, "nul", target.framing)
+	require.False(t, target.literal)
+	require.True(t, target.tombstone)
+}
+
+func TestProduceParseArgsBench(t *testing.T) {
+	target := &produceCmd{}
+	target.parseArgs([]string{"-topic", "hans", "-bench", "-size", "1KB", "-count", "1M"})
+	require.NotNil(t, target.bench)
+	require.Equal(t, 1024, target.benchSize)
+	require.Equal(t, int64(1000000), target.count)
+
+	target = &produceCmd{}
+	target.parseArgs([]string{"-topic", "hans", "-bench"})
+	require.Equal(t, 100, target.benchSize)
+	require.Zero(t, target.count)
+
+	target = &produceCmd{}
+	target.parseArgs([]string{"-topic", "hans", "-bench", "-size", "2MB", "-max-message-bytes", "0"})
+	require.Equal(t, 2*1024*1024, target.benchSize)
+}
+
+func TestProduceParseArgsPartitioner(t *testing.T) {
+	data := map[string]string{
+		"":               "manual",
+		"jvm":            "hashCode",
+		"murmur2":        "murmur2",
+		"default":        "default",
+		"murmur2_random": "default",
+	}
+
+	for partitioner, expected := range data {
+		target := &produceCmd{}
+		target.parseArgs([]string{"-topic", "hans", "-partitioner", partitioner})
+		require.Equal(t, expected, target.partitioner, partitioner)
+	}
+
+	nullKeys := []struct {
+		partitioner string
+		nullKeys    string
+		expected    string
+	}{
+		{partitioner: "murmur2", expected: "partition"},
+		{partitioner: "jvm", expected: "partition"},
+		{partitioner: "default", expected: "random"},
+		{partitioner: "default", nullKeys: "roundrobin", expected: "roundrobin"},
+		{partitioner: "murmur2", nullKeys: "random", expected: "random"},
+	}
+	for _, d := range nullKeys {
+		target := &produceCmd{}
+		target.parseArgs([]string{"-topic", "hans", "-partitioner", d.partitioner, "-null-keys", d.nullKeys})
+		require.Equal(t, d.expected, target.nullKeys, "%v %v", d.partitioner, d.nullKeys)
+	}
+}
+
+func TestProduceParseArgsMaxBytesPerSec(t *testing.T) {
+	target := &produceCmd{}
+	target.parseArgs([]string{"-topic", "hans"})
+	require.Nil(t, target.byteRate)
+
+	target.parseArgs([]string{"-topic", "hans", "-max-bytes-per-sec", "10MB"})
+	require.Equal(t, float64(10<<20), target.byteRate.perSecond)
+}
+
+func TestProduceParseArgsDecompress(t *testing.T) {
+	data := []struct {
+		args     []string
+		expected string
+	}{
+		{args: []string{}, expected: "none"},
+		{args: []string{"-file", "orders.jsonl.gz"}, expected: "auto"},
+		{args: []string{"-decompress", "gzip"}, expected: "gzip"},
+		{args: []string{"-file", "orders.jsonl", "-decompress", "none"}, expected: "none"},
+	}
+
+	for _, d := range data {
+		target := &produceCmd{}
+		target.parseArgs(append([]string{"-topic", "hans"}, d.args...))
+		require.Equal(t, d.expected, target.decompress, "%v", d.args)
+	}
+}
+
+func TestProduceInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kt-validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "schema.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"type": "object", "required": ["id"]}`), 0644))
+
+	target := &produceCmd{}
+	target.parseArgs([]string{"-topic", "hans", "-validate", path, "-decodevalue", "hex"})
+	require.NotNil(t, target.schema)
+
+	valid, invalid := `{"id": 1}`, `{}`
+	hexed := func(s string) *string { h := hex.EncodeToString([]byte(s)); return &h }
+	require.False(t, target.invalid(message{Value: hexed(valid)}))
+	require.False(t, target.invalid(message{}))
+	require.True(t, target.invalid(message{Value: hexed(invalid), line: 2}))
+	require.True(t, target.invalid(message{Value: &valid}))
+	require.Equal(t, int64(2), target.skipped)
+}
+
+func TestMakeRecordHeaderTemplates(t *testing.T) {
+	os.Setenv("KT_TEST_ENV", "staging")
+	defer os.Unsetenv("KT_TEST_ENV")
+
+	target := &produceCmd{}
+	target.parseArgs([]string{"-topic", "hans", "-header", "trace-id={{uuid}}", "-header", `env={{env "KT_TEST_ENV"}}`, "-header", "seq={{.Seq}}", "-header", "source=kt"})
+	require.Len(t, target.headerTmpls, 3)
+
+	value := "a"
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	traceIDs := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		rec, err := target.makeRecord(message{Value: &value})
+		require.NoError(t, err)
+		headers := map[string]string{}
+		for _, h := range rec.Headers {
+			headers[string(h.Key)] = string(h.Value)
+		}
+		require.Equal(t, "staging", headers["env"])
+		require.Equal(t, "kt", headers["source"])
+		require.Equal(t, strconv.Itoa(i), headers["seq"])
+		require.Regexp(t, uuid, headers["trace-id"])
+		traceIDs[headers["trace-id"]] = true
+	}
+	require.Len(t, traceIDs, 2)
+
+	rec, err := target.makeRecord(message{Value: &value, Headers: map[string]string{"trace-id": "given"}})
+	require.NoError(t, err)
+	require.Contains(t, rec.Headers, &sarama.RecordHeader{Key: []byte("trace-id"), Value: []byte("given")})
+}
+
+func TestProduceParseArgsSync(t *testing.T) {
+	target := &produceCmd{}
+	target.parseArgs([]string{"-topic", "hans", "-sync"})
+	require.Equal(t, 1, target.batch)
+	require.Equal(t, 1, target.maxInFlight)
+	require.Equal(t, sarama.WaitForAll, target.config.Producer.RequiredAcks)
+
+	target = &produceCmd{}
+	target.parseArgs([]string{"-topic", "hans", "-sync", "-acks", "1"})
+	require.Equal(t, sarama.WaitForLocal, target.config.Producer.RequiredAcks)
+}
+
+func TestCheckPartition(t *testing.T) {
+	target := &produceCmd{topic: "hans"}
+	valid := inputMessage(1, "a", "b", 2)
+	require.NoError(t, target.checkPartition(&valid, 3))
+	require.Equal(t, int32(2), *valid.Partition)
+
+	unset := message{}
+	require.NoError(t, target.checkPartition(&unset, 3))
+	require.Nil(t, unset.Partition)
+
+	invalid := inputMessage(1, "a", "b", 3)
+	err := target.checkPartition(&invalid, 3)
+	require.EqualError(t, err, "topic hans has no partition 3, only 3 partitions, use -remap-partitions to choose another")
+
+	target.remapParts = true
+	require.NoError(t, target.checkPartition(&invalid, 3))
+	require.Nil(t, invalid.Partition)
+
+	negative := inputMessage(1, "a", "b", -1)
+	require.NoError(t, target.checkPartition(&negative, 3))
+	require.Nil(t, negative.Partition)
+}
+
+func TestDeserializeLinesRemapPartitions(t *testing.T) {
+	target := &produceCmd{topic: "hans", partitioner: "hashCode", remapParts: true}
+	in, out := make(chan string, 1), make(chan message, 1)
+	in <- `{"key": "a", "value": "b", "partition": 7}`
+	close(in)
+	target.deserializeLines(nil, in, out, 5)
+	require.Equal(t, inputMessage(1, "a", "b", hashCodePartition("a", 5)), <-out)
+}
+
+func TestProduceParseArgsDecodeAliases(t *testing.T) {
+	target := &produceCmd{}
+	target.parseArgs([]string{"-topic", "hans", "-key-decode", "base64", "-value-decode", "hex"})
+	require.Equal(t, "base64", target.decodeKey)
+	require.Equal(t, "hex", target.decodeValue)
+
+	target = &produceCmd{}
+	target.parseArgs([]string{"-topic", "hans", "-decodekey", "hex"})
+	require.Equal(t, "hex", target.decodeKey)
+	require.Equal(t, "string", target.decodeValue)
+}
+
+func TestDeserializeLinesPaceByTimestamp(t *testing.T) {
+	target := &produceCmd{pace: &pacer{speed: 10}}
+	in, out := make(chan string, 3), make(chan message, 3)
+	in <- `{"value": "a", "timestamp": "2020-01-01T00:00:00Z"}`
+	in <- `{"value": "b"}`
+	in <- `{"value": "c", "timestamp": "2020-01-01T00:00:01Z"}`
+	close(in)
+
+	start := time.Now()
+	target.deserializeLines(nil, in, out, 1)
+	require.True(t, time.Since(start) >= 100*time.Millisecond, "took %v", time.Since(start))
+	require.Len(t, out, 3)
+}
+
+func TestDeserializeLinesPaceByTimestampQuit(t *testing.T) {
+	target := &produceCmd{pace: &pacer{speed: 1}}
+	q, in, out := make(chan struct{}), make(chan string, 3), make(chan message, 3)
+	in <- `{"value": "a", "timestamp": "2020-01-01T00:00:00Z"}`
+	in <- `{"value": "b", "timestamp": "2020-01-01T01:00:00Z"}`
+	in <- `{"value": "c", "timestamp": "2020-01-01T02:00:00Z"}`
+	close(in)
+
+	done := make(chan struct{})
+	go func() { target.deserializeLines(q, in, out, 1); close(done) }()
+	time.Sleep(20 * time.Millisecond)
+	close(q)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("deserializeLines did not stop when quit was closed")
+	}
+	require.Equal(t, "a", *(<-out).Value)
+	require.Empty(t, out)
+}
+
+func TestDeserializeLinesConsumedMessages(t *testing.T) {
+	consumer := &consumeCmd{encodeKey: "string", encodeValue: "hex"}
+	consumed, err := consumer.newConsumedMessage(&sarama.ConsumerMessage{
+		Topic:     "orders",
+		Partition: 1,
+		Offset:    23,
+		Key:       []byte{0xff, 'a'},
+		Value:     []byte("b"),
+		Timestamp: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Headers:   []*sarama.RecordHeader{{Key: []byte("h"), Value: []byte("v")}},
+	})
+	require.NoError(t, err)
+	line, err := json.Marshal(consumed)
+	require.NoError(t, err)
+
+	target := &produceCmd{topic: "orders-copy", decodeKey: "string", decodeValue: "string"}
+	in, out := make(chan string, 1), make(chan message, 1)
+	in <- string(line)
+	close(in)
+	target.deserializeLines(nil, in, out, 2)
+	msg := <-out
+
+	require.Nil(t, msg.Topic)
+	require.Equal(t, "orders-copy", target.messageTopic(msg))
+	require.Equal(t, int32(1), *msg.Partition)
+	require.True(t, consumed.Timestamp.Equal(msg.Timestamp.Time))
+
+	rec, err := target.makeRecord(msg)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0xff, 'a'}, rec.Key)
+	require.Equal(t, []byte("b"), rec.Value)
+	require.Equal(t, []*sarama.RecordHeader{{Key: []byte("h"), Value: []byte("v")}}, rec.Headers)
+}
+
+func TestIsEnvelope(t *testing.T) {
+	data := map[string]bool{
+		`{"partition":1,"offset":2,"value":{"id":1}}`: true,
+		`{"offset":2,"key":1}`:                        true,
+		`{"id":1}`:                                    false,
+		`["offset"]`:                                  false,
+		`offset`:                                      false,
+	}
+	for l, expected := range data {
+		require.Equal(t, expected, isEnvelope(l), l)
+	}
+}
+
+func TestDeserializeLinesBroadcast(t *testing.T) {
+	target := &produceCmd{topic: "hans", partitioner: "manual", broadcast: true}
+	in, out := make(chan string, 1), make(chan message, 5)
+	in <- `{"key": "a", "value": "flush", "partition": 7}`
+	close(in)
+	target.deserializeLines(nil, in, out, 3)
+
+	for p := int32(0); p < 3; p++ {
+		require.Equal(t, inputMessage(1, "a", "flush", p), <-out)
+	}
+	_, ok := <-out
+	require.False(t, ok)
+}
+
+func TestValueSubject(t *testing.T) {
+	const schema = `{"type": "record", "name": "Greeting", "namespace": "com.example", "fields": []}`
+	data := []struct {
+		strategy string
+		subject  string
+		schema   string
+		expected string
+		err      string
+	}{
+		{strategy: "topic", expected: "greetings-value"},
+		{strategy: "topic", subject: "custom", expected: "custom"},
+		{strategy: "record", schema: schema, expected: "com.example.Greeting"},
+		{strategy: "topic-record", schema: schema, expected: "greetings-com.example.Greeting"},
+		{strategy: "record", err: "subject-strategy record requires value-schema"},
+		{strategy: "record", subject: "custom", schema: schema, err: "subject cannot be combined with subject-strategy"},
+		{strategy: "name", err: `unsupported subject-strategy "name", only topic, record and topic-record are supported`},
+	}
+
+	for _, d := range data {
+		actual, err := valueSubject(d.strategy, d.subject, "greetings", d.schema)
+		if d.err != "" {
+			require.EqualError(t, err, d.err, d.strategy)
+			continue
+		}
+		require.NoError(t, err, d.strategy)
+		require.Equal(t, d.expected, actual, d.strategy)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseRate parses rates like 500/s, 100/m or 1000/h into the interval
+// between two messages. A number without unit is per second.
+func parseRate(s string) (time.Duration, error) {
+	n, unit := s, "s"
+	if i := strings.Index(s, "/"); i >= 0 {
+		n, unit = s[:i], s[i+1:]
+	}
+
+	var per time.Duration
+	switch unit {
+	case "s":
+		per = time.Second
+	case "m":
+		per = time.Minute
+	case "h":
+		per = time.Hour
+	default:
+		return 0, fmt.Errorf("invalid rate %#v, unit must be one of s, m or h", s)
+	}
+
+	count, err := strconv.ParseFloat(n, 64)
+	if err != nil || count <= 0 {
+		return 0, fmt.Errorf("invalid rate %#v, expected a positive number of messages, e.g. 500/s", s)
+	}
+
+	return time.Duration(float64(per) / count), nil
+}
+
+// parseByteRate parses byte rates like 512KB, 10MB/s or 1GB into bytes per
+// second.
+func parseByteRate(s string) (float64, error) {
+	n, err := parseSize(strings.TrimSuffix(s, "/s"))
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid byte rate %#v, expected a positive number of bytes per second, e.g. 10MB", s)
+	}
+	return float64(n), nil
+}
+
+// rateLimiter spaces messages by interval. Messages that fall behind are sent
+// as soon as possible, without bursting to catch up.
+type rateLimiter struct {
+	interval time.Duration
+	next     time.Time
+}
+
+// delay returns how long to wait at now before sending the next message.
+func (r *rateLimiter) delay(now time.Time) time.Duration {
+	return r.reserve(now, r.interval)
+}
+
+// reserve returns how long to wait at now before sending, and delays the
+// following send by cost.
+func (r *rateLimiter) reserve(now time.Time, cost time.Duration) time.Duration {
+	if r.next.Before(now) {
+		r.next = now
+	}
+	d := r.next.Sub(now)
+	r.next = r.next.Add(cost)
+	return d
+}
+
+// wait blocks until the next message may be sent, or until quit is closed.
+func (r *rateLimiter) wait(quit <-chan struct{}) {
+	sleep(r.delay(time.Now()), quit)
+}
+
+// byteRateLimiter spaces messages by their size so that perSecond bytes are
+// sent per second.
+type byteRateLimiter struct {
+	rateLimiter
+	perSecond float64
+}
+
+// delay returns how long to wait at now before sending the next message of n
+// bytes.
+func (r *byteRateLimiter) delay(now time.Time, n int) time.Duration {
+	return r.reserve(now, time.Duration(float64(n)/r.perSecond*float64(time.Second)))
+}
+
+// wait blocks until the next message of n bytes may be sent, or until quit is
+// closed.
+func (r *byteRateLimiter) wait(quit <-chan struct{}, n int) {
+	sleep(r.delay(time.Now(), n), quit)
+}
+
+// sleep blocks for d, or until quit is closed.
+func sleep(d time.Duration, quit <-chan struct{}) {
+	if d <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-quit:
+	}
+}
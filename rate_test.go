@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRate(t *testing.T) {
+	data := []struct {
+		given    string
+		expected time.Duration
+	}{
+		{given: "500/s", expected: 2 * time.Millisecond},
+		{given: "500", expected: 2 * time.Millisecond},
+		{given: "60/m", expected: time.Second},
+		{given: "7200/h", expected: 500 * time.Millisecond},
+		{given: "0.5/s", expected: 2 * time.Second},
+	}
+
+	for _, d := range data {
+		actual, err := parseRate(d.given)
+		require.NoError(t, err, d.given)
+		require.Equal(t, d.expected, actual, d.given)
+	}
+
+	for _, given := range []string{"", "0/s", "-1/s", "500/d", "fast"} {
+		_, err := parseRate(given)
+		require.Error(t, err, given)
+	}
+}
+
+func TestRateLimiterDelay(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := &rateLimiter{interval: 100 * time.Millisecond}
+
+	require.Equal(t, time.Duration(0), r.delay(now))
+	require.Equal(t, 100*time.Millisecond, r.delay(now))
+	require.Equal(t, 150*time.Millisecond, r.delay(now.Add(50*time.Millisecond)))
+
+	// falling behind doesn't result in a burst
+	later := now.Add(time.Second)
+	require.Equal(t, time.Duration(0), r.delay(later))
+	require.Equal(t, 100*time.Millisecond, r.delay(later))
+}
+
+func TestParseByteRate(t *testing.T) {
+	data := map[string]float64{"512": 512, "512KB": 512 << 10, "10MB/s": 10 << 20, "1GB": 1 << 30}
+	for given, expected := range data {
+		actual, err := parseByteRate(given)
+		require.NoError(t, err, given)
+		require.Equal(t, expected, actual, given)
+	}
+
+	for _, given := range []string{"", "0", "-1MB", "10MB/m", "fast"} {
+		_, err := parseByteRate(given)
+		require.Error(t, err, given)
+	}
+}
+
+func TestByteRateLimiterDelay(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := &byteRateLimiter{perSecond: 1000}
+
+	require.Equal(t, time.Duration(0), r.delay(now, 500))
+	require.Equal(t, 500*time.Millisecond, r.delay(now, 100))
+	require.Equal(t, 500*time.Millisecond, r.delay(now.Add(100*time.Millisecond), 0))
+
+	// falling behind doesn't result in a burst
+	later := now.Add(time.Second)
+	require.Equal(t, time.Duration(0), r.delay(later, 2000))
+	require.Equal(t, 2*time.Second, r.delay(later, 1))
+}
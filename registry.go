@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bufbuild/protocompile"
+	"github.com/linkedin/goavro/v2"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// errNotRegistryEncoded is returned when decoding data that doesn't start
+// with the magic byte and schema id of the schema registry wire format.
+var errNotRegistryEncoded = errors.New("data is not in the schema registry wire format")
+
+// registryError is returned for responses of the schema registry with a
+// status other than 200.
+type registryError struct {
+	status int
+	msg    string
+}
+
+func (e *registryError) Error() string { return e.msg }
+
+// schemaRegistry decodes data in the wire format of the Confluent Schema
+// Registry, i.e. a zero magic byte and a big endian four byte schema id
+// followed by the Avro, Protobuf or JSON encoded data.
+type schemaRegistry struct {
+	url    string
+	client *http.Client
+
+	sync.Mutex
+	schemas map[int32]*registrySchema
+	infos   map[int32][]schemaInfo
+}
+
+type schemaReference struct {
+	Name    string `json:"name"`
+	Subject string `json:"subject"`
+	Version int    `json:"version"`
+}
+
+type registrySchema struct {
+	Schema     string            `json:"schema"`
+	SchemaType string            `json:"schemaType"`
+	References []schemaReference `json:"references"`
+
+	avro  *goavro.Codec
+	proto protoreflect.FileDescriptor
+}
+
+func newSchemaRegistry(u string) *schemaRegistry {
+	return &schemaRegistry{
+		url:     strings.TrimSuffix(u, "/"),
+		client:  &http.Client{Timeout: 10 * time.Second},
+		schemas: map[int32]*registrySchema{},
+		infos:   map[int32][]schemaInfo{},
+	}
+}
+
+func (r *schemaRegistry) get(path string, v interface{}) error {
+	res, err := r.client.Get(r.url + path)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		buf, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return &registryError{status: res.StatusCode, msg: fmt.Sprintf("schema registry responded to %v with %v: %s", path, res.Status, bytes.TrimSpace(buf))}
+	}
+
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// post sends v as JSON to path and decodes the response into res. It returns
+// the status of the response together with errors for statuses other than
+// 200.
+func (r *schemaRegistry) post(path string, v, res interface{}) (int, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := r.client.Post(r.url+path, "application/vnd.schemaregistry.v1+json", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		buf, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return resp.StatusCode, fmt.Errorf("schema registry responded to %v with %v: %s", path, resp.Status, bytes.TrimSpace(buf))
+	}
+
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(res)
+}
+
+// schema returns the schema with the given id, which is only requested from
+// the registry once. It returns errNotRegistryEncoded for unknown ids.
+func (r *schemaRegistry) schema(id int32) (*registrySchema, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if s, ok := r.schemas[id]; ok {
+		if s == nil {
+			return nil, errNotRegistryEncoded
+		}
+		return s, nil
+	}
+
+	s := &registrySchema{}
+	if err := r.get(fmt.Sprintf("/schemas/ids/%d", id), s); err != nil {
+		var rerr *registryError
+		if errors.As(err, &rerr) && rerr.status == http.StatusNotFound {
+			r.schemas[id] = nil
+			return nil, errNotRegistryEncoded
+		}
+		return nil, fmt.Errorf("failed to read schema %v err=%v", id, err)
+	}
+
+	var err error
+	switch s.SchemaType {
+	case "", "AVRO":
+		s.avro, err = goavro.NewCodec(s.Schema)
+	case "PROTOBUF":
+		s.proto, err = r.compileProto(s)
+	case "JSON":
+	default:
+		err = fmt.Errorf("unsupported schema type %v", s.SchemaType)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse schema %v err=%v", id, err)
+	}
+
+	r.schemas[id] = s
+	return s, nil
+}
+
+func (r *schemaRegistry) compileProto(s *registrySchema) (protoreflect.FileDescriptor, error) {
+	const name = "kt-registry-schema.proto"
+
+	sources := map[string]string{name: s.Schema}
+	if err := r.addProtoReferences(sources, s.References); err != nil {
+		return nil, err
+	}
+
+	compiler := protocompile.Compiler{
+		Resolver: protocompile.WithStandardImports(&protocompile.SourceResolver{
+			Accessor: protocompile.SourceAccessorFromMap(sources),
+		}),
+	}
+	files, err := compiler.Compile(context.Background(), name)
+	if err != nil {
+		return nil, err
+	}
+
+	return files[0], nil
+}
+
+// addProtoReferences adds the sources of the referenced schemas and their own
+// references to sources.
+func (r *schemaRegistry) addProtoReferences(sources map[string]string, refs []schemaReference) error {
+	for _, ref := range refs {
+		if _, ok := sources[ref.Name]; ok {
+			continue
+		}
+
+		var s registrySchema
+		if err := r.get(fmt.Sprintf("/subjects/%s/versions/%d", url.PathEscape(ref.Subject), ref.Version), &s); err != nil {
+			return fmt.Errorf("failed to read referenced schema %v err=%v", ref.Name, err)
+		}
+		sources[ref.Name] = s.Schema
+
+		if err := r.addProtoReferences(sources, s.References); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// schemaInfo identifies the schema that a key or value was decoded with.
+type schemaInfo struct {
+	ID      int32  `json:"id"`
+	Subject string `json:"subject,omitempty"`
+	Version int    `json:"version,omitempty"`
+}
+
+// info returns the schema id of data in the schema registry wire format, and
+// the subject and version it's registered under. If the schema id is
+// registered under multiple subjects, the given subject is preferred. The
+// subjects are only requested from the registry once per schema id, when that
+// fails only the id is returned together with the error.
+func (r *schemaRegistry) info(data []byte, subject string) (*schemaInfo, error) {
+	if len(data) < 5 || data[0] != 0 {
+		return nil, errNotRegistryEncoded
+	}
+	id := int32(binary.BigEndian.Uint32(data[1:5]))
+
+	r.Lock()
+	defer r.Unlock()
+
+	var err error
+	infos, ok := r.infos[id]
+	if !ok {
+		if err = r.get(fmt.Sprintf("/schemas/ids/%d/versions", id), &infos); err != nil {
+			err = fmt.Errorf("failed to read subjects of schema %v err=%v", id, err)
+		}
+		r.infos[id] = infos
+	}
+
+	for _, i := range infos {
+		if i.Subject == subject {
+			return &schemaInfo{ID: id, Subject: i.Subject, Version: i.Version}, err
+		}
+	}
+	if len(infos) > 0 {
+		return &schemaInfo{ID: id, Subject: infos[0].Subject, Version: infos[0].Version}, err
+	}
+	return &schemaInfo{ID: id}, err
+}
+
+// subjectSchema returns the id of the schema registered under subject with
+// the given version, or latest. The schema itself is cached for encode.
+func (r *schemaRegistry) subjectSchema(subject, version string) (int32, error) {
+	var res struct {
+		ID int32 `json:"id"`
+		registrySchema
+	}
+	if err := r.get(fmt.Sprintf("/subjects/%s/versions/%s", url.PathEscape(subject), url.PathEscape(version)), &res); err != nil {
+		return 0, fmt.Errorf("failed to read schema of subject %v err=%v", subject, err)
+	}
+
+	s := &res.registrySchema
+	switch s.SchemaType {
+	case "", "AVRO":
+	default:
+		return 0, fmt.Errorf("unsupported schema type %v of subject %v, only AVRO is supported", s.SchemaType, subject)
+	}
+
+	var err error
+	if s.avro, err = goavro.NewCodec(s.Schema); err != nil {
+		return 0, fmt.Errorf("failed to parse schema %v err=%v", res.ID, err)
+	}
+
+	r.Lock()
+	r.schemas[res.ID] = s
+	r.Unlock()
+
+	return res.ID, nil
+}
+
+// avroRecordName returns the full name of the Avro record schema, as used by
+// the record name strategies for subjects.
+func avroRecordName(schema string) (string, error) {
+	var s struct {
+		Type      string `json:"type"`
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	}
+	if err := json.Unmarshal([]byte(schema), &s); err != nil || s.Type != "record" || s.Name == "" {
+		return "", fmt.Errorf("expected an Avro record schema")
+	}
+	if s.Namespace == "" || strings.Contains(s.Name, ".") {
+		return s.Name, nil
+	}
+	return s.Namespace + "." + s.Name, nil
+}
+
+// registerSchema registers the Avro schema under subject, or with register
+// false only looks up the id it's already registered with. The schema is
+// cached for encode.
+func (r *schemaRegistry) registerSchema(subject, schema string, register bool) (int32, error) {
+	codec, err := goavro.NewCodec(schema)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse schema err=%v", err)
+	}
+
+	var (
+		res    struct{ ID int32 }
+		path   = fmt.Sprintf("/subjects/%s", url.PathEscape(subject))
+		status int
+	)
+	if register {
+		path += "/versions"
+	}
+	if status, err = r.post(path, map[string]string{"schema": schema}, &res); err != nil {
+		if !register && status == http.StatusNotFound {
+			return 0, fmt.Errorf("schema is not registered under subject %v err=%v", subject, err)
+		}
+		return 0, fmt.Errorf("failed to register schema under subject %v err=%v", subject, err)
+	}
+
+	r.Lock()
+	r.schemas[res.ID] = &registrySchema{Schema: schema, avro: codec}
+	r.Unlock()
+
+	return res.ID, nil
+}
+
+// compatible reports whether the Avro schema is compatible with the latest
+// version of subject according to the subject's compatibility level. Any
+// schema is compatible with subjects that don't exist yet.
+func (r *schemaRegistry) compatible(subject, schema string) (bool, error) {
+	var res struct {
+		IsCompatible bool `json:"is_compatible"`
+	}
+	path := fmt.Sprintf("/compatibility/subjects/%s/versions/latest", url.PathEscape(subject))
+	status, err := r.post(path, map[string]string{"schema": schema}, &res)
+	if status == http.StatusNotFound {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to check compatibility with subject %v err=%v", subject, err)
+	}
+	return res.IsCompatible, nil
+}
+
+// encode serializes the Avro JSON in data with the schema of the given id and
+// returns it in the schema registry wire format.
+func (r *schemaRegistry) encode(id int32, data []byte) ([]byte, error) {
+	s, err := r.schema(id)
+	if err == errNotRegistryEncoded {
+		return nil, fmt.Errorf("schema %v is not registered", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.avro == nil {
+		return nil, fmt.Errorf("schema %v is not an Avro schema", id)
+	}
+
+	native, _, err := s.avro.NativeFromTextual(data)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(buf[1:5], uint32(id))
+	return s.avro.BinaryFromNative(buf, native)
+}
+
+// decode transcodes data in the schema registry wire format into JSON. It
+// returns errNotRegistryEncoded for data in any other format, and for data
+// with a schema id that is unknown to the registry.
+func (r *schemaRegistry) decode(data []byte) (json.RawMessage, error) {
+	if len(data) < 5 || data[0] != 0 {
+		return nil, errNotRegistryEncoded
+	}
+
+	s, err := r.schema(int32(binary.BigEndian.Uint32(data[1:5])))
+	if err != nil {
+		return nil, err
+	}
+
+	payload := data[5:]
+	switch {
+	case s.avro != nil:
+		native, _, err := s.avro.NativeFromBinary(payload)
+		if err != nil {
+			return nil, err
+		}
+		return s.avro.TextualFromNative(nil, native)
+	case s.proto != nil:
+		return decodeRegistryProto(s.proto, payload)
+	default:
+		if !json.Valid(payload) {
+			return nil, fmt.Errorf("invalid JSON")
+		}
+		return json.RawMessage(payload), nil
+	}
+}
+
+// decodeRegistryProto decodes a protobuf message that is preceded by the
+// indexes of its message type within fd, as zigzag encoded varints.
+func decodeRegistryProto(fd protoreflect.FileDescriptor, data []byte) (json.RawMessage, error) {
+	n, l := binary.Varint(data)
+	if l <= 0 || n < 0 {
+		return nil, fmt.Errorf("invalid message indexes")
+	}
+	data = data[l:]
+
+	indexes := []int64{0}
+	if n > 0 {
+		indexes = make([]int64, n)
+		for i := range indexes {
+			if indexes[i], l = binary.Varint(data); l <= 0 {
+				return nil, fmt.Errorf("invalid message indexes")
+			}
+			data = data[l:]
+		}
+	}
+
+	var (
+		msgs = fd.Messages()
+		md   protoreflect.MessageDescriptor
+	)
+	for _, i := range indexes {
+		if i < 0 || int(i) >= msgs.Len() {
+			return nil, fmt.Errorf("invalid message index %v", i)
+		}
+		md = msgs.Get(int(i))
+		msgs = md.Messages()
+	}
+
+	msg := dynamicpb.NewMessage(md)
+	if err := proto.Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+	return protojson.Marshal(msg)
+}
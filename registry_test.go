@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func registryEncoded(id uint32, payload ...[]byte) []byte {
+	buf := []byte{0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(buf[1:], id)
+	for _, p := range payload {
+		buf = append(buf, p...)
+	}
+	return buf
+}
+
+func TestSchemaRegistryDecode(t *testing.T) {
+	const avroSchema = `{"type": "record", "name": "Greeting", "fields": [{"name": "text", "type": "string"}]}`
+	requests := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[r.URL.Path]++
+		switch r.URL.Path {
+		case "/schemas/ids/1":
+			json.NewEncoder(w).Encode(map[string]interface{}{"schema": avroSchema})
+		case "/schemas/ids/2":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"schemaType": "PROTOBUF",
+				"schema":     `syntax = "proto3"; import "common.proto"; message Outer { message Inner { common.Text text = 1; } }`,
+				"references": []map[string]interface{}{{"name": "common.proto", "subject": "common", "version": 1}},
+			})
+		case "/subjects/common/versions/1":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"schemaType": "PROTOBUF",
+				"schema":     `syntax = "proto3"; package common; message Text { string value = 1; }`,
+			})
+		case "/schemas/ids/3":
+			json.NewEncoder(w).Encode(map[string]interface{}{"schemaType": "JSON", "schema": `{"type": "object"}`})
+		case "/schemas/ids/5":
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	target := newSchemaRegistry(srv.URL + "/")
+
+	codec, err := goavro.NewCodec(avroSchema)
+	require.NoError(t, err)
+	avro, err := codec.BinaryFromNative(nil, map[string]interface{}{"text": "hello"})
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		actual, err := target.decode(registryEncoded(1, avro))
+		require.NoError(t, err)
+		require.JSONEq(t, `{"text": "hello"}`, string(actual))
+	}
+	require.Equal(t, 1, requests["/schemas/ids/1"])
+
+	// Outer.Inner{text: common.Text{value: "hello"}} has the message
+	// indexes [0, 0].
+	text := protowire.AppendString(protowire.AppendTag(nil, 1, protowire.BytesType), "hello")
+	inner := protowire.AppendBytes(protowire.AppendTag(nil, 1, protowire.BytesType), text)
+	actual, err := target.decode(registryEncoded(2, binary.AppendVarint(binary.AppendVarint(binary.AppendVarint(nil, 2), 0), 0), inner))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"text": {"value": "hello"}}`, string(actual))
+
+	actual, err = target.decode(registryEncoded(3, []byte(`{"a": 1}`)))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"a": 1}`, string(actual))
+
+	_, err = target.decode([]byte("plain"))
+	require.Equal(t, errNotRegistryEncoded, err)
+
+	for i := 0; i < 2; i++ {
+		_, err = target.decode(registryEncoded(4, avro))
+		require.Equal(t, errNotRegistryEncoded, err)
+	}
+	require.Equal(t, 1, requests["/schemas/ids/4"])
+
+	_, err = target.decode(registryEncoded(5, avro))
+	require.Error(t, err)
+	require.NotEqual(t, errNotRegistryEncoded, err)
+}
+
+func TestSchemaRegistryInfo(t *testing.T) {
+	requests := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[r.URL.Path]++
+		switch r.URL.Path {
+		case "/schemas/ids/1/versions":
+			json.NewEncoder(w).Encode([]map[string]interface{}{
+				{"subject": "shared", "version": 2},
+				{"subject": "hans-value", "version": 5},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	target := newSchemaRegistry(srv.URL)
+
+	for i := 0; i < 2; i++ {
+		actual, err := target.info(registryEncoded(1), "hans-value")
+		require.NoError(t, err)
+		require.Equal(t, &schemaInfo{ID: 1, Subject: "hans-value", Version: 5}, actual)
+	}
+	require.Equal(t, 1, requests["/schemas/ids/1/versions"])
+
+	actual, err := target.info(registryEncoded(1), "other-value")
+	require.NoError(t, err)
+	require.Equal(t, &schemaInfo{ID: 1, Subject: "shared", Version: 2}, actual)
+
+	actual, err = target.info(registryEncoded(2), "hans-value")
+	require.Error(t, err)
+	require.Equal(t, &schemaInfo{ID: 2}, actual)
+	actual, err = target.info(registryEncoded(2), "hans-value")
+	require.NoError(t, err)
+	require.Equal(t, &schemaInfo{ID: 2}, actual)
+	require.Equal(t, 1, requests["/schemas/ids/2/versions"])
+
+	_, err = target.info([]byte("plain"), "hans-value")
+	require.Equal(t, errNotRegistryEncoded, err)
+}
+
+func TestSchemaRegistryEncode(t *testing.T) {
+	const avroSchema = `{"type": "record", "name": "Greeting", "fields": [{"name": "text", "type": "string"}]}`
+	requests := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[r.URL.Path]++
+		switch r.URL.Path {
+		case "/subjects/greetings-value/versions/latest":
+			json.NewEncoder(w).Encode(map[string]interface{}{"subject": "greetings-value", "id": 7, "version": 2, "schema": avroSchema})
+		case "/subjects/greetings-value/versions/1":
+			json.NewEncoder(w).Encode(map[string]interface{}{"subject": "greetings-value", "id": 6, "version": 1, "schemaType": "JSON", "schema": `{}`})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	target := newSchemaRegistry(srv.URL)
+
+	id, err := target.subjectSchema("greetings-value", "latest")
+	require.NoError(t, err)
+	require.Equal(t, int32(7), id)
+
+	codec, err := goavro.NewCodec(avroSchema)
+	require.NoError(t, err)
+	avro, err := codec.BinaryFromNative(nil, map[string]interface{}{"text": "hello"})
+	require.NoError(t, err)
+
+	actual, err := target.encode(id, []byte(`{"text": "hello"}`))
+	require.NoError(t, err)
+	require.Equal(t, registryEncoded(7, avro), actual)
+	require.Zero(t, requests["/schemas/ids/7"])
+
+	decoded, err := target.decode(actual)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"text": "hello"}`, string(decoded))
+
+	_, err = target.encode(id, []byte(`{"txt": "hello"}`))
+	require.Error(t, err)
+
+	_, err = target.subjectSchema("greetings-value", "1")
+	require.Error(t, err)
+
+	_, err = target.subjectSchema("missing-value", "latest")
+	require.Error(t, err)
+}
+
+func TestSchemaRegistryRegisterSchema(t *testing.T) {
+	const avroSchema = `{"type": "record", "name": "Greeting", "fields": [{"name": "text", "type": "string"}]}`
+	var (
+		registered  bool
+		compatible  = true
+		contentType string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		var body struct{ Schema string }
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		require.Equal(t, avroSchema, body.Schema)
+
+		switch r.URL.Path {
+		case "/subjects/greetings-value/versions":
+			registered = true
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": 9})
+		case "/subjects/greetings-value":
+			if !registered {
+				http.Error(w, `{"error_code": 40403, "message": "Schema not found"}`, http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"subject": "greetings-value", "id": 9, "version": 1, "schema": avroSchema})
+		case "/compatibility/subjects/greetings-value/versions/latest":
+			json.NewEncoder(w).Encode(map[string]interface{}{"is_compatible": compatible})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	target := newSchemaRegistry(srv.URL)
+
+	_, err := target.registerSchema("greetings-value", avroSchema, false)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "schema is not registered under subject greetings-value")
+
+	id, err := target.registerSchema("greetings-value", avroSchema, true)
+	require.NoError(t, err)
+	require.Equal(t, int32(9), id)
+	require.Equal(t, "application/vnd.schemaregistry.v1+json", contentType)
+
+	id, err = target.registerSchema("greetings-value", avroSchema, false)
+	require.NoError(t, err)
+	require.Equal(t, int32(9), id)
+
+	actual, err := target.encode(id, []byte(`{"text": "hello"}`))
+	require.NoError(t, err)
+	require.Equal(t, []byte{0, 0, 0, 0, 9, 10, 'h', 'e', 'l', 'l', 'o'}, actual)
+
+	ok, err := target.compatible("greetings-value", avroSchema)
+	require.NoError(t, err)
+	require.True(t, ok)
+	compatible = false
+	ok, err = target.compatible("greetings-value", avroSchema)
+	require.NoError(t, err)
+	require.False(t, ok)
+	ok, err = target.compatible("other-value", avroSchema)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	_, err = target.registerSchema("greetings-value", `{"type": "nope"}`, true)
+	require.Error(t, err)
+}
+
+func TestAvroRecordName(t *testing.T) {
+	name, err := avroRecordName(`{"type": "record", "name": "Greeting", "namespace": "com.example", "fields": []}`)
+	require.NoError(t, err)
+	require.Equal(t, "com.example.Greeting", name)
+
+	name, err = avroRecordName(`{"type": "record", "name": "org.Greeting", "namespace": "com.example", "fields": []}`)
+	require.NoError(t, err)
+	require.Equal(t, "org.Greeting", name)
+
+	_, err = avroRecordName(`"string"`)
+	require.EqualError(t, err, "expected an Avro record schema")
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+type partitionStats struct {
+	Messages int64 `json:"messages"`
+	Bytes    int64 `json:"bytes"`
+	First    int64 `json:"first"`
+	Last     int64 `json:"last"`
+}
+
+// consumeStats tracks the messages received per topic and partition.
+type consumeStats struct {
+	sync.Mutex
+	messages   int64
+	bytes      int64
+	partitions map[string]map[int32]*partitionStats
+}
+
+func (s *consumeStats) record(msg *sarama.ConsumerMessage) {
+	s.Lock()
+	defer s.Unlock()
+
+	size := int64(len(msg.Key) + len(msg.Value))
+	s.messages++
+	s.bytes += size
+
+	if s.partitions == nil {
+		s.partitions = map[string]map[int32]*partitionStats{}
+	}
+	if s.partitions[msg.Topic] == nil {
+		s.partitions[msg.Topic] = map[int32]*partitionStats{}
+	}
+
+	ps, ok := s.partitions[msg.Topic][msg.Partition]
+	if !ok {
+		ps = &partitionStats{First: msg.Offset}
+		s.partitions[msg.Topic][msg.Partition] = ps
+	}
+	ps.Messages++
+	ps.Bytes += size
+	ps.Last = msg.Offset
+}
+
+type statsSnapshot struct {
+	Messages   int64                               `json:"messages"`
+	Bytes      int64                               `json:"bytes"`
+	Partitions map[string]map[int32]partitionStats `json:"partitions"`
+}
+
+func (s *consumeStats) snapshot() statsSnapshot {
+	s.Lock()
+	defer s.Unlock()
+
+	res := statsSnapshot{
+		Messages:   s.messages,
+		Bytes:      s.bytes,
+		Partitions: map[string]map[int32]partitionStats{},
+	}
+	for t, ps := range s.partitions {
+		res.Partitions[t] = map[int32]partitionStats{}
+		for p, st := range ps {
+			res.Partitions[t][p] = *st
+		}
+	}
+
+	return res
+}
+
+type statsReport struct {
+	MessagesPerSec float64                             `json:"messagesPerSec"`
+	BytesPerSec    float64                             `json:"bytesPerSec"`
+	Messages       int64                               `json:"messages"`
+	Bytes          int64                               `json:"bytes"`
+	Partitions     map[string]map[int32]partitionStats `json:"partitions"`
+}
+
+func newStatsReport(prev, cur statsSnapshot, elapsed time.Duration) statsReport {
+	secs := elapsed.Seconds()
+	if secs <= 0 {
+		secs = 1
+	}
+
+	return statsReport{
+		MessagesPerSec: float64(cur.Messages-prev.Messages) / secs,
+		BytesPerSec:    float64(cur.Bytes-prev.Bytes) / secs,
+		Messages:       cur.Messages,
+		Bytes:          cur.Bytes,
+		Partitions:     cur.Partitions,
+	}
+}
+
+// reportStats prints the consumption throughput to stderr at the given
+// interval until consumption is stopped.
+func (cmd *consumeCmd) reportStats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	prev, last := cmd.received.snapshot(), time.Now()
+	for {
+		select {
+		case now := <-ticker.C:
+			cur := cmd.received.snapshot()
+			buf, err := json.Marshal(newStatsReport(prev, cur, now.Sub(last)))
+			if err != nil {
+				failf("failed to marshal stats err=%v", err)
+			}
+			fmt.Fprintln(os.Stderr, string(buf))
+			prev, last = cur, now
+		case <-cmd.quit:
+			return
+		}
+	}
+}
+
+type consumeSummary struct {
+	statsSnapshot
+	Duration string `json:"duration"`
+}
+
+// printSummary prints the messages received so far to stderr.
+func (cmd *consumeCmd) printSummary(d time.Duration) {
+	buf, err := json.Marshal(consumeSummary{statsSnapshot: cmd.received.snapshot(), Duration: d.String()})
+	if err != nil {
+		failf("failed to marshal summary err=%v", err)
+	}
+	fmt.Fprintln(os.Stderr, string(buf))
+}
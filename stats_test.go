@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsumeStats(t *testing.T) {
+	var target consumeStats
+	prev := target.snapshot()
+
+	target.record(&sarama.ConsumerMessage{Topic: "hans", Partition: 0, Offset: 3, Key: []byte("k"), Value: []byte("123")})
+	target.record(&sarama.ConsumerMessage{Topic: "hans", Partition: 0, Offset: 4, Value: []byte("1234")})
+	target.record(&sarama.ConsumerMessage{Topic: "hans", Partition: 2, Offset: 10, Value: []byte("12")})
+
+	cur := target.snapshot()
+	require.Equal(t, int64(3), cur.Messages)
+	require.Equal(t, int64(10), cur.Bytes)
+	require.Equal(t, partitionStats{Messages: 2, Bytes: 8, First: 3, Last: 4}, cur.Partitions["hans"][0])
+	require.Equal(t, partitionStats{Messages: 1, Bytes: 2, First: 10, Last: 10}, cur.Partitions["hans"][2])
+
+	report := newStatsReport(prev, cur, 2*time.Second)
+	require.Equal(t, 1.5, report.MessagesPerSec)
+	require.Equal(t, 5.0, report.BytesPerSec)
+}
+
+func TestConsumeSummaryJSON(t *testing.T) {
+	var stats consumeStats
+	stats.record(&sarama.ConsumerMessage{Topic: "hans", Partition: 1, Offset: 3, Value: []byte("123")})
+
+	buf, err := json.Marshal(consumeSummary{statsSnapshot: stats.snapshot(), Duration: (90 * time.Second).String()})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"messages":1,"bytes":3,"duration":"1m30s","partitions":{"hans":{"1":{"messages":1,"bytes":3,"first":3,"last":3}}}}`, string(buf))
+}
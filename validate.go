@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// compileSchema reads the JSON Schema in the file at path.
+func compileSchema(path string) (*jsonschema.Schema, error) {
+	schema, err := jsonschema.NewCompiler().Compile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile JSON Schema %v err=%v", path, err)
+	}
+	return schema, nil
+}
+
+// validateValue validates the JSON value data against schema.
+func validateValue(schema *jsonschema.Schema, data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return fmt.Errorf("value is not JSON err=%v", err)
+	}
+	return schema.Validate(v)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateValue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kt-validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "order.schema.json")
+	schema := `{
+  "type": "object",
+  "required": ["id", "amount"],
+  "properties": {
+    "id": {"type": "string"},
+    "amount": {"type": "integer", "minimum": 1}
+  }
+}`
+	require.NoError(t, ioutil.WriteFile(path, []byte(schema), 0644))
+
+	compiled, err := compileSchema(path)
+	require.NoError(t, err)
+
+	data := map[string]bool{
+		`{"id": "a", "amount": 23}`:                true,
+		`{"id": "a", "amount": 12345678901234567}`: true,
+		`{"id": "a", "amount": 0}`:                 false,
+		`{"id": "a", "amount": 1.5}`:               false,
+		`{"id": 1, "amount": 23}`:                  false,
+		`{"amount": 23}`:                           false,
+		`hans`:                                     false,
+	}
+	for value, valid := range data {
+		err := validateValue(compiled, []byte(value))
+		if valid {
+			require.NoError(t, err, value)
+		} else {
+			require.Error(t, err, value)
+		}
+	}
+
+	_, err = compileSchema(filepath.Join(dir, "missing.json"))
+	require.Error(t, err)
+}